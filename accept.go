@@ -0,0 +1,43 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// ErrFallback is returned by Accept when the client did not authenticate and was served by the fallback.
+var ErrFallback = E.New("connection handled by fallback")
+
+// Accept runs the handshake on conn like NewConnection, but returns the established connection instead of
+// passing it to the Handler, the caller owns it from then on.
+// user is set for the Users of protocol version 2 and 3, connections accepted this way are not counted as active in Stats.
+func (s *Service) Accept(ctx context.Context, conn net.Conn, metadata M.Metadata) (net.Conn, *User, error) {
+	var handler acceptHandler
+	err := s.newConnection(ctx, conn, metadata, &handler)
+	if err != nil {
+		return nil, nil, err
+	}
+	if handler.conn == nil {
+		return nil, nil, ErrFallback
+	}
+	return handler.conn, handler.user, nil
+}
+
+type acceptedUserKey struct{}
+
+type acceptHandler struct {
+	conn net.Conn
+	user *User
+}
+
+func (h *acceptHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.conn = conn
+	h.user, _ = ctx.Value(acceptedUserKey{}).(*User)
+	return nil
+}
+
+func (h *acceptHandler) NewError(ctx context.Context, err error) {
+}
@@ -0,0 +1,54 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// sourceAllowed reports whether a client may authenticate, every source may without AllowedSources.
+func (s *Service) sourceAllowed(source M.Socksaddr) bool {
+	if len(s.allowedSources) == 0 {
+		return true
+	}
+	addr := source.Addr.Unmap()
+	for _, prefix := range s.allowedSources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayDisallowedSource relays a client outside AllowedSources to the handshake server without authenticating it,
+// the ClientHello is only read to pick the handshake server by SNI.
+func (s *Service) relayDisallowedSource(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	s.probeFallback(ctx, FallbackReasonSourceNotAllowed)
+	handshakeConfig := s.defaultHandshake(ctx)
+	var clientHelloFrame *buf.Buffer
+	if len(s.handshakeForServerName) > 0 || s.handshakeServerMapper != nil {
+		var err error
+		clientHelloFrame, err = s.extractClientHello(conn)
+		if err != nil {
+			return E.Cause(err, "read client handshake")
+		}
+		defer clientHelloFrame.Release()
+		handshakeConfig, _ = s.selectHandshake(ctx, clientHelloFrame)
+	}
+	handshakeConn, err := s.dialHandshake(ctx, handshakeConfig, conn, metadata)
+	if err != nil {
+		return E.Cause(err, "server handshake")
+	}
+	if clientHelloFrame != nil {
+		_, err = handshakeConn.Write(clientHelloFrame.Bytes())
+		if err != nil {
+			handshakeConn.Close()
+			return E.Cause(err, "write client handshake")
+		}
+	}
+	return bufio.CopyConn(ctx, conn, handshakeConn)
+}
@@ -0,0 +1,77 @@
+package shadowtls
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+const readBatchSize = 32 * 1024
+
+// batchReader reads as much as available from upstream at once, so that
+// several small records arriving together cost a single read.
+// The pooled buffer is taken by the first read and returned by release or reset.
+type batchReader struct {
+	upstream io.Reader
+	size     int
+	access   sync.Mutex
+	buffer   *buf.Buffer
+	released bool
+}
+
+func newBatchReader(upstream io.Reader, size int) *batchReader {
+	return &batchReader{
+		upstream: upstream,
+		size:     size,
+	}
+}
+
+// reset drops buffered data and reads from upstream from now on.
+func (r *batchReader) reset(upstream io.Reader) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.upstream = upstream
+	r.releaseBuffer()
+	r.released = false
+}
+
+// release returns the buffer to the pool, later reads fail. A blocked Read holds the buffer
+// until it returns, so the upstream should be closed first.
+func (r *batchReader) release() {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.releaseBuffer()
+	r.released = true
+}
+
+func (r *batchReader) releaseBuffer() {
+	if r.buffer != nil {
+		r.buffer.Release()
+		r.buffer = nil
+	}
+}
+
+func (r *batchReader) Read(p []byte) (n int, err error) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.released {
+		return 0, net.ErrClosed
+	}
+	if r.buffer == nil || r.buffer.IsEmpty() {
+		if len(p) >= r.size {
+			return r.upstream.Read(p)
+		}
+		if r.buffer == nil {
+			r.buffer = buf.NewSize(r.size)
+		} else {
+			r.buffer.Reset()
+		}
+		_, err = r.buffer.ReadOnceFrom(r.upstream)
+		if r.buffer.IsEmpty() {
+			return 0, err
+		}
+	}
+	return r.buffer.Read(p)
+}
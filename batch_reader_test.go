@@ -0,0 +1,120 @@
+package shadowtls
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+)
+
+type readCounter struct {
+	io.Reader
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (n int, err error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func TestBatchReaderReframes(t *testing.T) {
+	var stream []byte
+	for i := 0; i < 64; i++ {
+		stream = append(stream, testRecord(applicationData, bytes.Repeat([]byte{byte(i)}, 100+i))...)
+	}
+	// the last record is split across upstream reads
+	upstream := &readCounter{Reader: io.MultiReader(bytes.NewReader(stream[:len(stream)-50]), bytes.NewReader(stream[len(stream)-50:]))}
+	reader := newBatchReader(upstream, readBatchSize)
+	defer reader.release()
+	for i := 0; i < 64; i++ {
+		frame, err := extractFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame.Bytes()[tlsHeaderSize:], bytes.Repeat([]byte{byte(i)}, 100+i)) {
+			t.Fatal("record ", i, " corrupted")
+		}
+		frame.Release()
+	}
+	if upstream.reads > 2 {
+		t.Fatalf("%d upstream reads for two chunks", upstream.reads)
+	}
+	_, err := extractFrame(reader)
+	if err != io.EOF {
+		t.Fatal("expected EOF, got ", err)
+	}
+}
+
+func TestBatchReaderReleasesBuffer(t *testing.T) {
+	allocator := trackBuffers(t)
+	client, server := newVerifiedConnPair(t)
+	_, err := client.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data [4]byte
+	_, err = io.ReadFull(server, data[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+	_, err = server.Read(data[:])
+	if err == nil {
+		t.Fatal("read after close succeeded")
+	}
+	allocator.check(t, "closed connections")
+}
+
+// BenchmarkVerifiedConnRead compares batched reads with reading every record header and body from the
+// connection, over TCP loopback where every read is a syscall.
+func BenchmarkVerifiedConnRead(b *testing.B) {
+	for _, size := range []int{64, 1024, 16384} {
+		for _, batched := range []bool{false, true} {
+			name := strconv.Itoa(size) + "/direct"
+			if batched {
+				name = strconv.Itoa(size) + "/batched"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkVerifiedConnRead(b, size, batched)
+			})
+		}
+	}
+}
+
+func benchmarkVerifiedConnRead(b *testing.B, size int, batched bool) {
+	clientConn, serverConn := tcpPipe(b)
+	client, err := NewVerifiedConn(clientConn, testPassword, testPassword, testServerRandom, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := NewVerifiedConn(serverConn, testPassword, testPassword, testServerRandom, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !batched {
+		server.(*verifiedConn).reader = serverConn
+	}
+	payload := make([]byte, size)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			_, wErr := client.Write(payload)
+			if wErr != nil {
+				return
+			}
+		}
+	}()
+	readBuffer := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = io.ReadFull(server, readBuffer)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	client.Close()
+	server.Close()
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"net"
 	"os"
+	"time"
 
 	"github.com/sagernet/sing/common/debug"
 	E "github.com/sagernet/sing/common/exceptions"
@@ -16,60 +19,258 @@ import (
 )
 
 type ClientConfig struct {
-	Version      int
-	Password     string
-	Server       M.Socksaddr
-	Dialer       N.Dialer
-	StrictMode   bool
-	TLSHandshake TLSHandshakeFunc
-	Logger       logger.ContextLogger
+	Version           int
+	Password          string
+	Server            M.Socksaddr
+	ServerName        string // SNI sent by DefaultTLSHandshakeFunc independent of Server, see ClientConfig.HandshakeOptionsAware
+	Dialer            N.Dialer
+	StrictMode        bool
+	LegacyTLS12       bool           // for protocol version 3, see Features
+	Pacing            Pacing         // for protocol version 3
+	RecordVersion     [2]byte        // for protocol version 3, must match the server
+	FrameTransport    FrameTransport // for protocol version 3, must match the server
+	IdleTimeout       time.Duration  // for protocol version 3
+	MaxRecordSize     int            // for protocol version 3, see Features
+	KeepAliveInterval time.Duration  // for protocol version 3, see Features
+	MinVersion        uint16         // TLS version offered by DefaultTLSHandshakeFunc, see ClientConfig.HandshakeOptionsAware
+	MaxVersion        uint16         // TLS version offered by DefaultTLSHandshakeFunc, must allow TLS 1.3 for protocol version 3
+	Compression       bool           // for protocol version 3, see Features
+	WriteChunkSize    int            // for protocol version 3, see Features
+	SampleInterval    time.Duration  // for protocol version 3, see Features
+	MaxRecordRate     int            // for protocol version 3, see Features
+	RequireTLS13      *bool          // for protocol version 3, true if nil, see Features
+	RekeyBytes        int64          // for protocol version 3, see Features
+	ReuseReadBuffer   bool           // for protocol version 3, see Features
+	Padding           Padding        // for protocol version 3, must match the server, see Padding
+	// PinnedServerCertSHA256 is the SHA-256 of the handshake server leaf certificate in DER form.
+	// A client that checks the certificate is slightly distinguishable, but a swapped front is detected.
+	// It is applied by DefaultTLSHandshakeFunc, see ClientConfig.HandshakeOptionsAware.
+	PinnedServerCertSHA256 []byte
+	OnServerHello          func(frame []byte) // for protocol version 3, receives a copy of the relayed ServerHello record
+	// VerifyServerName rejects a handshake server whose certificate does not cover ServerName, which is required,
+	// so a wrong front is detected. Like pinning, a client that checks it is slightly distinguishable.
+	// It is applied by DefaultTLSHandshakeFunc, see ClientConfig.HandshakeOptionsAware.
+	VerifyServerName bool
+	// DisableGREASE removes the RFC 8701 values DefaultTLSHandshakeFunc adds like browsers do.
+	DisableGREASE bool
+	// ManualReadDeadline is for protocol version 3, see Features.
+	ManualReadDeadline bool
+	// ClientHelloTemplate is a complete ClientHello record sent instead of running TLSHandshake,
+	// the session id is replaced. For protocol version 3. The random and the key shares of X25519,
+	// the NIST curves and the hybrid ML-KEM groups are refreshed for every connection, see refreshClientHello.
+	// The encrypted server flight can not be read, so the client sends its first data record after the
+	// first application data record of the server instead of after the server Finished. Before the rest
+	// of the flight arrives, this timing distinguishes it from a real client.
+	ClientHelloTemplate []byte
+	// ClientHelloSpec is marshaled into the ClientHello template, it replaces ClientHelloTemplate.
+	ClientHelloSpec *ClientHelloSpec
+	// HandshakeRetries re-dials and restarts a failed handshake in DialContext,
+	// waiting HandshakeRetryBackoff before the first retry and doubling it after each one.
+	HandshakeRetries      int
+	HandshakeRetryBackoff time.Duration
+	TLSHandshake          TLSHandshakeFunc
+	// HandshakeOptionsAware is set if TLSHandshake applies the HandshakeOptions in its context
+	// like DefaultTLSHandshakeFunc, options other handshakes would ignore are rejected.
+	HandshakeOptionsAware bool
+	Logger                logger.ContextLogger
 }
 
 type Client struct {
-	version      int
-	password     string
-	strictMode   bool
-	server       M.Socksaddr
-	dialer       N.Dialer
-	tlsHandshake TLSHandshakeFunc
-	logger       logger.ContextLogger
+	version               int
+	password              string
+	features              Features
+	server                M.Socksaddr
+	dialer                N.Dialer
+	tlsHandshake          TLSHandshakeFunc
+	handshakeOptionsAware bool
+	handshakeOptions      *HandshakeOptions
+	handshakeOptionsUsed  string
+	onServerHello         func(frame []byte)
+	clientHelloTemplate   []byte
+	handshakeRetries      int
+	handshakeRetryBackoff time.Duration
+	logger                logger.ContextLogger
 }
 
 func NewClient(config ClientConfig) (*Client, error) {
+	return NewClientWithOptions(config)
+}
+
+// NewClientWithOptions creates a Client, options are applied on top of the features set in config.
+func NewClientWithOptions(config ClientConfig, options ...Option) (*Client, error) {
 	client := &Client{
-		version:      config.Version,
-		password:     config.Password,
-		strictMode:   config.StrictMode,
-		server:       config.Server,
-		dialer:       config.Dialer,
-		tlsHandshake: config.TLSHandshake,
-		logger:       config.Logger,
+		version:  config.Version,
+		password: config.Password,
+		features: newFeatures(Features{
+			StrictMode:         config.StrictMode,
+			LegacyTLS12:        config.LegacyTLS12,
+			Pacing:             config.Pacing,
+			RecordVersion:      config.RecordVersion,
+			FrameTransport:     config.FrameTransport,
+			IdleTimeout:        config.IdleTimeout,
+			MaxRecordSize:      config.MaxRecordSize,
+			KeepAliveInterval:  config.KeepAliveInterval,
+			Compression:        config.Compression,
+			WriteChunkSize:     config.WriteChunkSize,
+			SampleInterval:     config.SampleInterval,
+			MaxRecordRate:      config.MaxRecordRate,
+			RequireTLS13:       requireTLS13(config.RequireTLS13),
+			RekeyBytes:         config.RekeyBytes,
+			ReuseReadBuffer:    config.ReuseReadBuffer,
+			ManualReadDeadline: config.ManualReadDeadline,
+			Padding:            config.Padding,
+		}, options),
+		server:                config.Server,
+		dialer:                config.Dialer,
+		tlsHandshake:          config.TLSHandshake,
+		handshakeOptionsAware: config.HandshakeOptionsAware,
+		onServerHello:         config.OnServerHello,
+		handshakeRetries:      config.HandshakeRetries,
+		handshakeRetryBackoff: config.HandshakeRetryBackoff,
+		logger:                config.Logger,
 	}
 
+	if config.ServerName != "" {
+		err := checkServerName(config.ServerName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(config.PinnedServerCertSHA256) > 0 || config.VerifyServerName || config.DisableGREASE || client.features.LegacyTLS12 || config.MinVersion != 0 || config.MaxVersion != 0 || config.ServerName != "" {
+		client.handshakeOptions = &HandshakeOptions{
+			PinnedServerCertSHA256: config.PinnedServerCertSHA256,
+			LegacyTLS12:            client.features.LegacyTLS12,
+			MinVersion:             config.MinVersion,
+			MaxVersion:             config.MaxVersion,
+			ServerName:             config.ServerName,
+			VerifyServerName:       config.VerifyServerName,
+			DisableGREASE:          config.DisableGREASE,
+		}
+	}
+	if len(config.PinnedServerCertSHA256) > 0 {
+		client.handshakeOptionsUsed = "pinned server certificate"
+	} else if config.VerifyServerName {
+		client.handshakeOptionsUsed = "server name verification"
+	} else if config.MinVersion != 0 || config.MaxVersion != 0 {
+		client.handshakeOptionsUsed = "TLS min and max version"
+	}
+	if config.VerifyServerName && config.ServerName == "" {
+		return nil, E.New("server name verification requires a server name")
+	}
 	switch client.version {
 	case 1, 2, 3:
 	default:
 		return nil, E.New("unknown protocol version: ", client.version)
 	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, E.New("TLS min version is above max version")
+	}
+	if client.version == 3 {
+		if client.features.LegacyTLS12 && config.MinVersion > tls.VersionTLS12 {
+			return nil, E.New("TLS min version excludes TLS 1.2 in legacy mode")
+		} else if !client.features.LegacyTLS12 && config.MaxVersion != 0 && config.MaxVersion < tls.VersionTLS13 {
+			return nil, E.New("protocol version 3 requires TLS max version 1.3")
+		}
+	}
+	if config.ClientHelloSpec != nil {
+		if len(config.ClientHelloTemplate) > 0 {
+			return nil, E.New("both client hello template and spec set")
+		}
+		template, err := config.ClientHelloSpec.Marshal()
+		if err != nil {
+			return nil, E.Cause(err, "invalid client hello spec")
+		}
+		config.ClientHelloTemplate = template
+	}
+	if len(config.ClientHelloTemplate) > 0 {
+		if client.version != 3 {
+			return nil, E.New("client hello template requires protocol version 3")
+		}
+		err := validateClientHelloTemplate(config.ClientHelloTemplate, !client.features.LegacyTLS12)
+		if err != nil {
+			return nil, E.Cause(err, "invalid client hello template")
+		}
+		if config.ServerName != "" {
+			info, parseErr := parseClientHello(config.ClientHelloTemplate)
+			if parseErr != nil || info.serverName != config.ServerName {
+				return nil, E.New("client hello template does not carry server name ", config.ServerName)
+			}
+		}
+		client.clientHelloTemplate = append([]byte(nil), config.ClientHelloTemplate...)
+	}
+	err := client.checkHandshakeOptions()
+	if err != nil {
+		return nil, err
+	}
 	if client.dialer == nil {
 		client.dialer = N.SystemDialer
 	}
 	return client, nil
 }
 
+// checkHandshakeOptions rejects a configured option the ClientHello template or the TLS handshake would ignore.
+func (c *Client) checkHandshakeOptions() error {
+	optionsAware := c.tlsHandshake == nil || c.handshakeOptionsAware
+	if c.handshakeOptionsUsed != "" {
+		if c.clientHelloTemplate != nil {
+			return E.New(c.handshakeOptionsUsed, " is not supported with a client hello template")
+		}
+		if !optionsAware {
+			return E.New(c.handshakeOptionsUsed, " requires a handshake marked by HandshakeOptionsAware")
+		}
+	}
+	// the server name of a template is checked by NewClient
+	if c.clientHelloTemplate == nil && c.handshakeOptions != nil && c.handshakeOptions.ServerName != "" && !optionsAware {
+		return E.New("server name requires a handshake marked by HandshakeOptionsAware")
+	}
+	return nil
+}
+
+// SetHandshakeFunc replaces the TLS handshake, which is not assumed to be HandshakeOptionsAware.
 func (c *Client) SetHandshakeFunc(handshakeFunc TLSHandshakeFunc) {
 	c.tlsHandshake = handshakeFunc
+	c.handshakeOptionsAware = false
 }
 
+// DialContext dials the server and runs the handshake, retrying up to HandshakeRetries times.
+// A returned connection is never retried, so application data is never sent twice.
 func (c *Client) DialContext(ctx context.Context) (net.Conn, error) {
+	return c.DialContextWithPayload(ctx, nil)
+}
+
+// DialContextWithPayload is DialContext sending payload as the first data,
+// see DialContextConnWithPayload. A handshake is not retried once writing payload failed.
+func (c *Client) DialContextWithPayload(ctx context.Context, payload []byte) (net.Conn, error) {
 	if !c.server.IsValid() {
 		return nil, os.ErrInvalid
 	}
+	backoff := c.handshakeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := c.dialContext(ctx, payload)
+		var payloadErr *payloadWriteError
+		if err == nil || attempt >= c.handshakeRetries || ctx.Err() != nil || errors.Is(err, ErrServerCertificateMismatch) || errors.Is(err, ErrServerNameMismatch) || errors.As(err, &payloadErr) {
+			return conn, err
+		}
+		c.logger.DebugContext(ctx, E.Cause(err, "handshake attempt ", attempt+1, " failed, retrying"))
+		if backoff > 0 {
+			timer := c.features.Clock.NewTimer(backoff)
+			select {
+			case <-timer.C():
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (c *Client) dialContext(ctx context.Context, payload []byte) (net.Conn, error) {
 	conn, err := c.dialer.DialContext(ctx, N.NetworkTCP, c.server)
 	if err != nil {
 		return nil, err
 	}
-	shadowTLSConn, err := c.DialContextConn(ctx, conn)
+	shadowTLSConn, err := c.DialContextConnWithPayload(ctx, conn, payload)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -78,9 +279,34 @@ func (c *Client) DialContext(ctx context.Context) (net.Conn, error) {
 }
 
 func (c *Client) DialContextConn(ctx context.Context, conn net.Conn) (net.Conn, error) {
-	if c.tlsHandshake == nil {
+	return c.DialContextConnWithPayload(ctx, conn, nil)
+}
+
+type payloadWriteError struct {
+	error
+}
+
+func (e *payloadWriteError) Unwrap() error {
+	return e.error
+}
+
+// DialContextConnWithPayload runs the handshake and writes payload as the first data.
+// For protocol version 3 over TLS 1.3, the client Finished is held back and written together
+// with the first data record, so both leave in one write.
+func (c *Client) DialContextConnWithPayload(ctx context.Context, conn net.Conn, payload []byte) (net.Conn, error) {
+	if c.tlsHandshake == nil && c.clientHelloTemplate == nil {
 		return nil, os.ErrInvalid
 	}
+	if isWrapped(conn) {
+		return nil, ErrAlreadyWrapped
+	}
+	err := c.checkHandshakeOptions()
+	if err != nil {
+		return nil, err
+	}
+	if c.handshakeOptions != nil {
+		ctx = ContextWithHandshakeOptions(ctx, c.handshakeOptions)
+	}
 	switch c.version {
 	default:
 		fallthrough
@@ -90,6 +316,12 @@ func (c *Client) DialContextConn(ctx context.Context, conn net.Conn) (net.Conn,
 			return nil, err
 		}
 		c.logger.TraceContext(ctx, "clint handshake finished")
+		if len(payload) > 0 {
+			_, err = conn.Write(payload)
+			if err != nil {
+				return nil, &payloadWriteError{E.Cause(err, "write payload")}
+			}
+		}
 		return conn, nil
 	case 2:
 		hashConn := newHashReadConn(conn, c.password)
@@ -98,29 +330,55 @@ func (c *Client) DialContextConn(ctx context.Context, conn net.Conn) (net.Conn,
 			return nil, err
 		}
 		c.logger.TraceContext(ctx, "clint handshake finished")
-		return newClientConn(hashConn), nil
+		shadowConn := newClientConn(hashConn)
+		if len(payload) > 0 {
+			_, err = shadowConn.Write(payload)
+			if err != nil {
+				return nil, &payloadWriteError{E.Cause(err, "write payload")}
+			}
+		}
+		return shadowConn, nil
 	case 3:
 		stream := newStreamWrapper(conn, c.password)
-		err := c.tlsHandshake(ctx, stream, generateSessionID(c.password))
+		stream.onServerHello = c.onServerHello
+		stream.holdWrites = len(payload) > 0
+		var err error
+		if c.clientHelloTemplate != nil {
+			err = c.handshakeWithTemplate(conn, stream)
+		} else {
+			err = c.tlsHandshake(ctx, stream, generateSessionID(c.password))
+		}
 		if err != nil {
 			return nil, err
 		}
 		c.logger.TraceContext(ctx, "handshake success")
 		isTLS13, authorized, serverRandom, readHMAC := stream.Authorized()
-		if c.strictMode && !isTLS13 {
+		if c.features.RequireTLS13 && !c.features.LegacyTLS12 && !isTLS13 {
+			return nil, ErrTLS13Downgrade
+		} else if c.features.StrictMode && !c.features.LegacyTLS12 && !isTLS13 {
 			return nil, E.New("TLS1.3 is not supported")
 		} else if !authorized {
-			return nil, E.New("traffic hijacked")
+			return nil, E.New("traffic hijacked, or the server does not use protocol version 3")
 		}
 		if debug.Enabled {
 			c.logger.TraceContext(ctx, "authorized, server random extracted: ", hex.EncodeToString(serverRandom))
 		}
 		hmacAdd := hmac.New(sha1.New, []byte(c.password))
 		hmacAdd.Write(serverRandom)
-		hmacAdd.Write([]byte("C"))
+		hmacAdd.Write(c.features.chainRole("C"))
 		hmacVerify := hmac.New(sha1.New, []byte(c.password))
 		hmacVerify.Write(serverRandom)
-		hmacVerify.Write([]byte("S"))
-		return newVerifiedConn(conn, hmacAdd, hmacVerify, readHMAC), nil
+		hmacVerify.Write(c.features.chainRole("S"))
+		verifiedConn := newVerifiedConn(conn, hmacAdd, hmacVerify, readHMAC)
+		c.features.setupConn(verifiedConn, conn)
+		c.features.startSampler(ctx, c.logger, verifiedConn)
+		dataConn := c.features.wrapConn(verifiedConn)
+		if len(payload) > 0 {
+			err = writePayload(conn, verifiedConn, dataConn, stream.held, payload)
+			if err != nil {
+				return nil, &payloadWriteError{E.Cause(err, "write payload")}
+			}
+		}
+		return dataConn, nil
 	}
 }
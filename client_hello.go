@@ -0,0 +1,257 @@
+package shadowtls
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	extensionServerName     = 0
+	extensionSupportedCurve = 10
+	extensionPointFormats   = 11
+)
+
+type clientHelloInfo struct {
+	version           uint16
+	cipherSuites      []uint16
+	extensions        []uint16
+	curves            []uint16
+	pointFormats      []uint8
+	supportedVersions []uint16
+	serverName        string
+}
+
+// clientHelloServerName walks a ClientHello record to the server_name extension only,
+// it allocates nothing but the returned name.
+func clientHelloServerName(frame []byte) (string, error) {
+	if len(frame) < tlsHeaderSize || frame[0] != handshake {
+		return "", E.New("not a handshake record")
+	}
+	input := cryptobyte.String(frame[tlsHeaderSize:])
+	var (
+		messageType uint8
+		message     cryptobyte.String
+		skipped     cryptobyte.String
+	)
+	if !input.ReadUint8(&messageType) || messageType != clientHello || !input.ReadUint24LengthPrefixed(&message) {
+		return "", E.New("not a client hello")
+	}
+	if !message.Skip(2+tlsRandomSize) ||
+		!message.ReadUint8LengthPrefixed(&skipped) ||
+		!message.ReadUint16LengthPrefixed(&skipped) ||
+		!message.ReadUint8LengthPrefixed(&skipped) {
+		return "", E.New("malformed client hello")
+	}
+	if message.Empty() {
+		return "", nil
+	}
+	var extensions cryptobyte.String
+	if !message.ReadUint16LengthPrefixed(&extensions) {
+		return "", E.New("malformed extensions")
+	}
+	for !extensions.Empty() {
+		var (
+			extensionType uint16
+			extension     cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extensionType) || !extensions.ReadUint16LengthPrefixed(&extension) {
+			return "", E.New("malformed extensions")
+		}
+		if extensionType == extensionServerName {
+			serverName, loaded := readServerName(extension)
+			if !loaded {
+				return "", E.New("malformed server name")
+			}
+			return serverName, nil
+		}
+	}
+	return "", nil
+}
+
+func readServerName(extension cryptobyte.String) (string, bool) {
+	var (
+		nameList   cryptobyte.String
+		serverName string
+	)
+	if !extension.ReadUint16LengthPrefixed(&nameList) {
+		return "", false
+	}
+	for !nameList.Empty() {
+		var (
+			nameType uint8
+			name     cryptobyte.String
+		)
+		if !nameList.ReadUint8(&nameType) || !nameList.ReadUint16LengthPrefixed(&name) {
+			return "", false
+		}
+		if nameType == 0 {
+			serverName = string(name)
+		}
+	}
+	return serverName, true
+}
+
+func parseClientHello(frame []byte) (*clientHelloInfo, error) {
+	if len(frame) < tlsHeaderSize || frame[0] != handshake {
+		return nil, E.New("not a handshake record")
+	}
+	input := cryptobyte.String(frame[tlsHeaderSize:])
+	var (
+		messageType uint8
+		message     cryptobyte.String
+		info        clientHelloInfo
+	)
+	if !input.ReadUint8(&messageType) || messageType != clientHello || !input.ReadUint24LengthPrefixed(&message) {
+		return nil, E.New("not a client hello")
+	}
+	var sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !message.ReadUint16(&info.version) || !message.Skip(tlsRandomSize) ||
+		!message.ReadUint8LengthPrefixed(&sessionID) ||
+		!message.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!message.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, E.New("malformed client hello")
+	}
+	for !cipherSuites.Empty() {
+		var cipherSuite uint16
+		if !cipherSuites.ReadUint16(&cipherSuite) {
+			return nil, E.New("malformed cipher suites")
+		}
+		info.cipherSuites = append(info.cipherSuites, cipherSuite)
+	}
+	if message.Empty() {
+		return &info, nil
+	}
+	var extensions cryptobyte.String
+	if !message.ReadUint16LengthPrefixed(&extensions) {
+		return nil, E.New("malformed extensions")
+	}
+	for !extensions.Empty() {
+		var (
+			extensionType uint16
+			extension     cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extensionType) || !extensions.ReadUint16LengthPrefixed(&extension) {
+			return nil, E.New("malformed extensions")
+		}
+		info.extensions = append(info.extensions, extensionType)
+		switch extensionType {
+		case extensionServerName:
+			var loaded bool
+			info.serverName, loaded = readServerName(extension)
+			if !loaded {
+				return nil, E.New("malformed server name")
+			}
+		case extensionSupportedCurve:
+			var curves cryptobyte.String
+			if !extension.ReadUint16LengthPrefixed(&curves) {
+				return nil, E.New("malformed supported groups")
+			}
+			for !curves.Empty() {
+				var curve uint16
+				if !curves.ReadUint16(&curve) {
+					return nil, E.New("malformed supported groups")
+				}
+				info.curves = append(info.curves, curve)
+			}
+		case extensionPointFormats:
+			var pointFormats cryptobyte.String
+			if !extension.ReadUint8LengthPrefixed(&pointFormats) {
+				return nil, E.New("malformed point formats")
+			}
+			info.pointFormats = append(info.pointFormats, pointFormats...)
+		case extensionSupportedVersions:
+			var versions cryptobyte.String
+			if !extension.ReadUint8LengthPrefixed(&versions) {
+				return nil, E.New("malformed supported versions")
+			}
+			for !versions.Empty() {
+				var version uint16
+				if !versions.ReadUint16(&version) {
+					return nil, E.New("malformed supported versions")
+				}
+				info.supportedVersions = append(info.supportedVersions, version)
+			}
+		}
+	}
+	return &info, nil
+}
+
+// checkTLS13 reports a ClientHello that can not lead to a TLS 1.3 handshake,
+// which strict mode would only detect after relaying it.
+func (h *clientHelloInfo) checkTLS13() error {
+	if !common.Contains(h.supportedVersions, versionTLS13) {
+		return E.New("client does not offer TLS 1.3")
+	}
+	if !common.Any(h.cipherSuites, isTLS13CipherSuite) {
+		return E.New("client offers no TLS 1.3 cipher suite")
+	}
+	return nil
+}
+
+func isTLS13CipherSuite(cipherSuite uint16) bool {
+	return cipherSuite >= 0x1301 && cipherSuite <= 0x1305
+}
+
+// ja3 returns the JA3 fingerprint string, GREASE values are skipped.
+func (h *clientHelloInfo) ja3() string {
+	var builder strings.Builder
+	builder.WriteString(strconv.Itoa(int(h.version)))
+	for _, values := range [][]uint16{h.cipherSuites, h.extensions, h.curves} {
+		builder.WriteByte(',')
+		writeJA3List(&builder, values)
+	}
+	builder.WriteByte(',')
+	for i, pointFormat := range h.pointFormats {
+		if i > 0 {
+			builder.WriteByte('-')
+		}
+		builder.WriteString(strconv.Itoa(int(pointFormat)))
+	}
+	return builder.String()
+}
+
+func writeJA3List(builder *strings.Builder, values []uint16) {
+	var written bool
+	for _, value := range values {
+		if isGREASE(value) {
+			continue
+		}
+		if written {
+			builder.WriteByte('-')
+		}
+		builder.WriteString(strconv.Itoa(int(value)))
+		written = true
+	}
+}
+
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// ClientHelloFingerprint describes the ClientHello of an incoming v2 or v3 connection.
+type ClientHelloFingerprint struct {
+	ServerName string
+	JA3        string
+	JA3Hash    string // hex encoded MD5 of JA3
+}
+
+func newClientHelloFingerprint(frame []byte) (*ClientHelloFingerprint, error) {
+	info, err := parseClientHello(frame)
+	if err != nil {
+		return nil, err
+	}
+	ja3 := info.ja3()
+	ja3Hash := md5.Sum([]byte(ja3))
+	return &ClientHelloFingerprint{
+		ServerName: info.serverName,
+		JA3:        ja3,
+		JA3Hash:    hex.EncodeToString(ja3Hash[:]),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package shadowtls
+
+import (
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ClientHelloSpec describes a ClientHello field by field, e.g. to match a captured browser build.
+// Extensions are sent in the given order with the given contents, the session id carries the HMAC.
+// Like ClientHelloTemplate, the handshake is never finished, so key shares need no private key.
+type ClientHelloSpec struct {
+	Version            uint16 // legacy_version, TLS 1.2 if zero
+	Random             []byte // zero if empty, the Client replaces it for every connection
+	CipherSuites       []uint16
+	CompressionMethods []uint8 // null compression if empty
+	Extensions         []ClientHelloExtension
+}
+
+type ClientHelloExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// Marshal returns the ClientHello record with a zero session id.
+func (s *ClientHelloSpec) Marshal() ([]byte, error) {
+	if len(s.Random) != 0 && len(s.Random) != tlsRandomSize {
+		return nil, E.New("random must be ", tlsRandomSize, " bytes")
+	}
+	version := s.Version
+	if version == 0 {
+		version = 0x0303
+	}
+	compressionMethods := s.CompressionMethods
+	if len(compressionMethods) == 0 {
+		compressionMethods = []uint8{0}
+	}
+	var builder cryptobyte.Builder
+	builder.AddUint8(handshake)
+	builder.AddUint16(0x0301)
+	builder.AddUint16LengthPrefixed(func(builder *cryptobyte.Builder) {
+		builder.AddUint8(clientHello)
+		builder.AddUint24LengthPrefixed(func(builder *cryptobyte.Builder) {
+			builder.AddUint16(version)
+			if len(s.Random) > 0 {
+				builder.AddBytes(s.Random)
+			} else {
+				builder.AddBytes(make([]byte, tlsRandomSize))
+			}
+			builder.AddUint8LengthPrefixed(func(builder *cryptobyte.Builder) {
+				builder.AddBytes(make([]byte, tlsSessionIDSize))
+			})
+			builder.AddUint16LengthPrefixed(func(builder *cryptobyte.Builder) {
+				for _, cipherSuite := range s.CipherSuites {
+					builder.AddUint16(cipherSuite)
+				}
+			})
+			builder.AddUint8LengthPrefixed(func(builder *cryptobyte.Builder) {
+				builder.AddBytes(compressionMethods)
+			})
+			builder.AddUint16LengthPrefixed(func(builder *cryptobyte.Builder) {
+				for _, extension := range s.Extensions {
+					builder.AddUint16(extension.Type)
+					builder.AddUint16LengthPrefixed(func(builder *cryptobyte.Builder) {
+						builder.AddBytes(extension.Data)
+					})
+				}
+			})
+		})
+	})
+	record, err := builder.Bytes()
+	if err != nil {
+		return nil, E.Cause(err, "marshal client hello")
+	}
+	if len(record)-tlsHeaderSize > maxRecordPayloadSize {
+		return nil, E.New("client hello does not fit in one record")
+	}
+	return record, nil
+}
@@ -0,0 +1,299 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowtls/handshakeserver"
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// plainHandshake is a custom handshake that does not apply HandshakeOptions.
+func plainHandshake(ctx context.Context, conn net.Conn, sessionIDGenerator TLSSessionIDGeneratorFunc) error {
+	return DefaultTLSHandshakeFunc(testPassword, &tls.Config{
+		ServerName:         testServerName,
+		InsecureSkipVerify: true,
+	})(ctx, conn, sessionIDGenerator)
+}
+
+// testClientHelloSpec offers TLS 1.3 only.
+func testClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256},
+		Extensions: []ClientHelloExtension{
+			{Type: extensionSupportedVersions, Data: []byte{2, 0x03, 0x04}},
+		},
+	}
+}
+
+func TestClientRejectsIgnoredHandshakeOptions(t *testing.T) {
+	pin := make([]byte, sha256.Size)
+	for _, testCase := range []struct {
+		name   string
+		config ClientConfig
+		valid  bool
+	}{
+		{"template", ClientConfig{PinnedServerCertSHA256: pin, ClientHelloTemplate: testClientHello(t)}, false},
+		{"spec", ClientConfig{PinnedServerCertSHA256: pin, ClientHelloSpec: testClientHelloSpec()}, false},
+		{"custom handshake", ClientConfig{PinnedServerCertSHA256: pin, TLSHandshake: plainHandshake}, false},
+		{"default handshake", ClientConfig{PinnedServerCertSHA256: pin}, true},
+		{"marked handshake", ClientConfig{PinnedServerCertSHA256: pin, TLSHandshake: plainHandshake, HandshakeOptionsAware: true}, true},
+		{"unmarked default handshake", ClientConfig{PinnedServerCertSHA256: pin, TLSHandshake: DefaultTLSHandshakeFunc(testPassword, &tls.Config{InsecureSkipVerify: true})}, false},
+		{"custom handshake without options", ClientConfig{TLSHandshake: plainHandshake}, true},
+		{"TLS version with template", ClientConfig{MinVersion: tls.VersionTLS13, ClientHelloTemplate: testClientHello(t)}, false},
+		{"TLS version with custom handshake", ClientConfig{MaxVersion: tls.VersionTLS13, TLSHandshake: plainHandshake}, false},
+		{"TLS version with default handshake", ClientConfig{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13}, true},
+		{"server name with custom handshake", ClientConfig{ServerName: testServerName, TLSHandshake: plainHandshake}, false},
+		{"server name with marked handshake", ClientConfig{ServerName: testServerName, TLSHandshake: plainHandshake, HandshakeOptionsAware: true}, true},
+		{"server name carried by template", ClientConfig{ServerName: testServerName, ClientHelloTemplate: testClientHello(t)}, true},
+		{"server name verification without server name", ClientConfig{VerifyServerName: true}, false},
+		{"server name verification with template", ClientConfig{VerifyServerName: true, ServerName: testServerName, ClientHelloTemplate: testClientHello(t)}, false},
+		{"server name verification with custom handshake", ClientConfig{VerifyServerName: true, ServerName: testServerName, TLSHandshake: plainHandshake}, false},
+		{"server name verification", ClientConfig{VerifyServerName: true, ServerName: testServerName}, true},
+		{"server name missing from template", ClientConfig{ServerName: "other.example.com", ClientHelloTemplate: testClientHello(t)}, false},
+	} {
+		config := testCase.config
+		config.Version = 3
+		config.Password = testPassword
+		if config.TLSHandshake == nil && len(config.ClientHelloTemplate) == 0 && config.ClientHelloSpec == nil {
+			config.TLSHandshake = DefaultTLSHandshakeFunc(testPassword, &tls.Config{ServerName: testServerName, InsecureSkipVerify: true})
+			config.HandshakeOptionsAware = true
+		}
+		_, err := NewClient(config)
+		if testCase.valid && err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("%s: accepted", testCase.name)
+		}
+	}
+}
+
+func TestClientRejectsIgnoredHandshakeOptionsOnDial(t *testing.T) {
+	client := newTestClient(t, ClientConfig{PinnedServerCertSHA256: make([]byte, sha256.Size)})
+	client.SetHandshakeFunc(plainHandshake)
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	_, err := client.DialContextConn(context.Background(), conn)
+	if err == nil {
+		t.Fatal("dial with a handshake ignoring the pinned certificate succeeded")
+	}
+}
+
+// TestClientServerName sends ServerName as SNI instead of the name of the TLS configuration or the dialed address.
+func TestClientServerName(t *testing.T) {
+	client := newTestClient(t, ClientConfig{
+		Server:     M.ParseSocksaddr("203.0.113.1:443"),
+		ServerName: "front.example.org",
+	})
+	info, err := parseClientHello(captureTemplateClientHello(t, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.serverName != "front.example.org" {
+		t.Fatalf("server name %q, expected front.example.org", info.serverName)
+	}
+	for _, serverName := range []string{"203.0.113.1", "front..example.org", "-front.example.org", "front_example.org"} {
+		_, err = NewClient(ClientConfig{Version: 3, Password: testPassword, ServerName: serverName, TLSHandshake: DefaultTLSHandshakeFunc(testPassword, &tls.Config{})})
+		if err == nil {
+			t.Errorf("invalid server name %q accepted", serverName)
+		}
+	}
+}
+
+func TestClientVerifyServerName(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{
+		ServerName:       testServerName,
+		VerifyServerName: true,
+	}))
+	testEcho(t, conn, []byte("ping"), false)
+
+	client := newTestClient(t, ClientConfig{
+		ServerName:       "other.example.com",
+		VerifyServerName: true,
+	})
+	serverConn, done := serveTestConn(context.Background(), service)
+	defer serverConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+	defer cancel()
+	_, err := client.DialContextConn(ctx, serverConn)
+	if !errors.Is(err, ErrServerNameMismatch) {
+		t.Fatal("expected server name mismatch, got ", err)
+	}
+	serverConn.Close()
+	waitDone(t, done)
+}
+
+// TestClientTLS13Only runs a handshake offering only TLS 1.3 end to end.
+func TestClientTLS13Only(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	client := newTestClient(t, ClientConfig{
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+	})
+	serverConn, _ := serveTestConn(context.Background(), service)
+	recorder := &recordingConn{Conn: serverConn.(*memconn.Conn)}
+	ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+	defer cancel()
+	conn, err := client.DialContextConn(ctx, recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn, []byte("ping"), false)
+	recorder.access.Lock()
+	clientHello := recorder.written.Bytes()
+	recorder.access.Unlock()
+	supportedVersions := findClientHelloExtension(clientHello, extensionSupportedVersions)
+	var versions []uint16
+	for i := 1; i+1 < len(supportedVersions); i += 2 {
+		version := binary.BigEndian.Uint16(supportedVersions[i:])
+		if version&0x0f0f != 0x0a0a {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) != 1 || versions[0] != tls.VersionTLS13 {
+		t.Fatalf("supported versions %x, expected only TLS 1.3", supportedVersions)
+	}
+}
+
+func TestClientPinnedServerCertificate(t *testing.T) {
+	certificate, err := handshakeserver.GenerateCertificate(testServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certHash := sha256.Sum256(certificate.Certificate[0])
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: startHandshakeServerWithConfig(t, handshakeserver.Config{Certificates: []tls.Certificate{certificate}, Response: testHandshakeResponse}),
+		},
+	})
+
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{
+		PinnedServerCertSHA256: certHash[:],
+		TLSHandshake: DefaultTLSHandshakeFunc(testPassword, &tls.Config{
+			ServerName:         testServerName,
+			InsecureSkipVerify: true,
+		}),
+		HandshakeOptionsAware: true,
+	}))
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = conn.Read(response)
+	if err != nil || string(response) != "ping" {
+		t.Fatal("echo failed: ", err)
+	}
+
+	certHash[0] ^= 0xFF
+	client := newTestClient(t, ClientConfig{PinnedServerCertSHA256: certHash[:]})
+	serverConn, done := serveTestConn(context.Background(), service)
+	defer serverConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+	defer cancel()
+	_, err = client.DialContextConn(ctx, serverConn)
+	if !errors.Is(err, ErrServerCertificateMismatch) {
+		t.Fatal("expected certificate mismatch, got ", err)
+	}
+	serverConn.Close()
+	waitDone(t, done)
+}
+
+// TestRejectAlreadyWrapped passes connections returned by this package back for another handshake.
+func TestRejectAlreadyWrapped(t *testing.T) {
+	for _, testCase := range []struct {
+		version     int
+		compression bool
+	}{
+		{2, false},
+		{3, false},
+		{3, true},
+	} {
+		service := newTestService(t, ServiceConfig{Version: testCase.version, Compression: testCase.compression})
+		client := newTestClient(t, ClientConfig{Version: testCase.version, Compression: testCase.compression})
+		conn, _ := dialTestConn(t, service, client)
+		_, err := client.DialContextConn(context.Background(), conn)
+		if !errors.Is(err, ErrAlreadyWrapped) {
+			t.Fatal("client accepted a wrapped connection of version ", testCase.version, ": ", err)
+		}
+		err = service.NewConnection(context.Background(), conn, M.Metadata{})
+		if !errors.Is(err, ErrAlreadyWrapped) {
+			t.Fatal("service accepted a wrapped connection of version ", testCase.version, ": ", err)
+		}
+	}
+}
+
+// writeLogConn records every write as a separate entry.
+type writeLogConn struct {
+	net.Conn
+	access sync.Mutex
+	writes [][]byte
+}
+
+func (c *writeLogConn) Write(p []byte) (int, error) {
+	c.access.Lock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	c.access.Unlock()
+	return c.Conn.Write(p)
+}
+
+// TestClientPayloadWithFinished sends the payload in the same write as the client Finished.
+// This saves a packet, not a round trip: without payload the client also writes data right after its Finished.
+func TestClientPayloadWithFinished(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	client := newTestClient(t, ClientConfig{})
+	payload := []byte("first request")
+	dial := func(withPayload bool) [][]byte {
+		serverConn, _ := serveTestConn(context.Background(), service)
+		logConn := &writeLogConn{Conn: serverConn}
+		ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+		defer cancel()
+		var (
+			conn net.Conn
+			err  error
+		)
+		if withPayload {
+			conn, err = client.DialContextConnWithPayload(ctx, logConn, payload)
+		} else {
+			conn, err = client.DialContextConn(ctx, logConn)
+			if err == nil {
+				_, err = conn.Write(payload)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		response := make([]byte, len(payload))
+		conn.SetReadDeadline(time.Now().Add(testDialTimeout))
+		_, err = io.ReadFull(conn, response)
+		if err != nil || !bytes.Equal(response, payload) {
+			t.Fatalf("echo %q: %v", response, err)
+		}
+		logConn.access.Lock()
+		defer logConn.access.Unlock()
+		return logConn.writes
+	}
+	separate := dial(false)
+	combined := dial(true)
+	if len(combined) != len(separate)-1 {
+		t.Fatalf("%d writes with payload, %d without", len(combined), len(separate))
+	}
+	if records := splitRecords(combined[len(combined)-1]); len(records) < 2 {
+		t.Fatal("payload not written together with the client Finished")
+	}
+}
@@ -0,0 +1,113 @@
+package shadowtls
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+)
+
+// compressionRole is appended to the role of both data chains of a compressed connection.
+const compressionRole = "Z"
+
+// compressedConn compresses the data phase stream with DEFLATE, flushing after every write.
+// The compressor output of a write is collected first, so that it leaves in one write below.
+type compressedConn struct {
+	net.Conn
+	reader      io.ReadCloser
+	writer      *flate.Writer
+	pending     bytes.Buffer
+	writeAccess sync.Mutex
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	c := &compressedConn{
+		Conn:   conn,
+		reader: flate.NewReader(conn),
+	}
+	c.writer = common.Must1(flate.NewWriter(&c.pending, flate.BestSpeed))
+	return c
+}
+
+func (c *compressedConn) writePending() error {
+	_, err := c.Conn.Write(c.pending.Bytes())
+	c.pending.Reset()
+	return err
+}
+
+func (c *compressedConn) Read(p []byte) (n int, err error) {
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (n int, err error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	n, err = c.writer.Write(p)
+	if err != nil {
+		return
+	}
+	err = c.writer.Flush()
+	if err != nil {
+		return
+	}
+	err = c.writePending()
+	return
+}
+
+// CloseWrite ends the compressed stream, so the peer reads io.EOF, and half-closes the connection below.
+func (c *compressedConn) CloseWrite() error {
+	c.writeAccess.Lock()
+	err := c.writer.Close()
+	if err == nil {
+		err = c.writePending()
+	}
+	c.writeAccess.Unlock()
+	if err != nil {
+		return err
+	}
+	if closer, isCloser := c.Conn.(interface{ CloseWrite() error }); isCloser {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+func (c *compressedConn) Close() error {
+	// ends the stream unless CloseWrite did, so that the peer reads io.EOF instead of io.ErrUnexpectedEOF,
+	// a write in progress is abandoned like in verifiedConn.Close
+	if c.writeAccess.TryLock() {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeRecordTimeout))
+		if c.writer.Close() == nil {
+			c.writePending()
+		}
+		c.writeAccess.Unlock()
+	}
+	c.reader.Close()
+	return c.Conn.Close()
+}
+
+func (c *compressedConn) Upstream() any {
+	return c.Conn
+}
+
+// compressedFirstFrameConn forwards FirstFrameConn through the decompression.
+type compressedFirstFrameConn struct {
+	*compressedConn
+	upstream        FirstFrameConn
+	firstFrameOnce  sync.Once
+	firstFrameValue []byte
+}
+
+// PeekFirstFrame returns the decompressed start of the first client data record, at most one record payload.
+func (c *compressedFirstFrameConn) PeekFirstFrame() []byte {
+	c.firstFrameOnce.Do(func() {
+		reader := flate.NewReader(bytes.NewReader(c.upstream.PeekFirstFrame()))
+		defer reader.Close()
+		// the record ends inside the stream, the error of the truncated input is expected
+		c.firstFrameValue, _ = io.ReadAll(io.LimitReader(reader, maxRecordPayloadSize))
+	})
+	return c.firstFrameValue
+}
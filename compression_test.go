@@ -0,0 +1,70 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	firstFrame := make(chan []byte, 1)
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+			firstFrameConn, isFirstFrameConn := conn.(FirstFrameConn)
+			if !isFirstFrameConn {
+				t.Error("compressed connection does not forward FirstFrameConn")
+			} else {
+				firstFrame <- firstFrameConn.PeekFirstFrame()
+			}
+			return echoHandler(ctx, conn, metadata)
+		}),
+	}, WithCompression(true))
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{Compression: true}))
+	random := make([]byte, 100*1024)
+	rand.Read(random)
+	for _, payload := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		[]byte(strings.Repeat("compressible text ", 10000)),
+		random,
+	} {
+		testEcho(t, conn, payload, false)
+	}
+	select {
+	case peeked := <-firstFrame:
+		if string(peeked) != "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n" {
+			t.Fatalf("peeked %q", peeked)
+		}
+	case <-time.After(testDialTimeout):
+		t.Fatal("handler not called")
+	}
+}
+
+// TestCompressionMismatch checks that a client disagreeing on compression fails instead of reading garbage.
+func TestCompressionMismatch(t *testing.T) {
+	for _, serverCompression := range []bool{false, true} {
+		service := newTestService(t, ServiceConfig{
+			Version: 3,
+			Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+				t.Error("connection with mismatched compression authenticated")
+				return conn.Close()
+			}),
+		}, WithCompression(serverCompression))
+		conn, done := dialTestConn(t, service, newTestClient(t, ClientConfig{Compression: !serverCompression}))
+		conn.Write([]byte("request"))
+		conn.SetReadDeadline(time.Now().Add(testDialTimeout))
+		response, err := io.ReadAll(conn)
+		if err == nil && len(response) > 0 || bytes.Contains(response, []byte("request")) {
+			t.Fatalf("read %q after mismatched compression", response)
+		}
+		conn.Close()
+		waitDone(t, done)
+	}
+}
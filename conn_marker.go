@@ -0,0 +1,38 @@
+package shadowtls
+
+import (
+	"net"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// ErrAlreadyWrapped is returned when a connection returned by this package is passed back for another handshake.
+var ErrAlreadyWrapped = E.New("connection is already a ShadowTLS connection")
+
+type shadowTLSConn interface {
+	isShadowTLSConn()
+}
+
+func (c *verifiedConn) isShadowTLSConn() {}
+
+func (c *shadowConn) isShadowTLSConn() {}
+
+// isWrapped follows Upstream through wrappers like the compression layer.
+func isWrapped(conn net.Conn) bool {
+	var current any = conn
+	for current != nil {
+		if _, isShadowTLS := current.(shadowTLSConn); isShadowTLS {
+			return true
+		}
+		withUpstream, hasUpstream := current.(interface{ Upstream() any })
+		if !hasUpstream {
+			return false
+		}
+		upstream := withUpstream.Upstream()
+		if upstream == current {
+			return false
+		}
+		current = upstream
+	}
+	return false
+}
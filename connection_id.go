@@ -0,0 +1,26 @@
+package shadowtls
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type connectionIDKey struct{}
+
+// ContextWithConnectionID is applied by Service.NewConnection to the context passed to the logger and the Handler,
+// a ContextLogger may read the ID with ConnectionIDFromContext to correlate log lines.
+func ContextWithConnectionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connectionIDKey{}, id)
+}
+
+func ConnectionIDFromContext(ctx context.Context) (string, bool) {
+	id, loaded := ctx.Value(connectionIDKey{}).(string)
+	return id, loaded
+}
+
+func newConnectionID() string {
+	var id [4]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,59 @@
+package shadowtls
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+func serveDecoy(ctx context.Context, conn net.Conn, clientHelloFrame *buf.Buffer, config *tls.Config) error {
+	tlsConn := tls.Server(bufio.NewCachedConn(conn, clientHelloFrame), config)
+	err := tlsConn.HandshakeContext(ctx)
+	tlsConn.Close()
+	if err != nil {
+		return E.Cause(err, "decoy handshake")
+	}
+	return nil
+}
+
+// ProbeAlert answers clients that fail v3 authentication with a TLS alert and a close
+// instead of relaying them to the handshake server, like a server rejecting the ClientHello.
+type ProbeAlert struct {
+	Level         uint8   // fatal if 0
+	Description   uint8   // handshake_failure if 0
+	RecordVersion [2]byte // TLS 1.2 if zero
+	Delay         time.Duration
+}
+
+func (a *ProbeAlert) respond(ctx context.Context, clock Clock, conn net.Conn) error {
+	defer conn.Close()
+	record := [tlsHeaderSize + 2]byte{alert, 3, 3, 0, 2, 2, 40}
+	if a.RecordVersion != ([2]byte{}) {
+		record[1], record[2] = a.RecordVersion[0], a.RecordVersion[1]
+	}
+	if a.Level != 0 {
+		record[tlsHeaderSize] = a.Level
+	}
+	if a.Description != 0 {
+		record[tlsHeaderSize+1] = a.Description
+	}
+	if a.Delay > 0 {
+		timer := clock.NewTimer(a.Delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	_, err := conn.Write(record[:])
+	if err != nil {
+		return E.Cause(err, "write probe alert")
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/logger"
+)
+
+// Features holds the protocol version 3 options shared by Service and Client.
+type Features struct {
+	StrictMode bool
+	// LegacyTLS12 expects a TLS 1.2 handshake server, the client offers TLS 1.2 only and
+	// strict mode no longer requires supported_versions in the ServerHello.
+	// TLS 1.2 servers send no application data during the handshake, so the client can not
+	// tell a hijacked handshake until the first data record fails verification.
+	LegacyTLS12    bool
+	Pacing         Pacing
+	RecordVersion  [2]byte        // must match the peer
+	FrameTransport FrameTransport // must match the peer
+	IdleTimeout    time.Duration
+	// MaxRecordSize is the largest accepted data record length including the HMAC, 0 for no limit.
+	// Records relayed from the handshake server may reach 16384 + 256 bytes before the data phase starts.
+	MaxRecordSize int
+	// KeepAliveInterval writes a record without payload after the interval passes without writes,
+	// the peer must skip empty records.
+	KeepAliveInterval time.Duration
+	// Compression deflates the data stream before framing. Both data chains append a role like Padding,
+	// so a peer disagreeing on compression fails the first record instead of reading garbage.
+	// Record lengths then depend on the content, which leaks secrets mixed with attacker
+	// controlled data like CRIME, and each connection holds a compressor of several hundred KiB.
+	Compression bool
+	// WriteChunkSize is the largest payload of a written data record, 16384 if unset or larger.
+	// Smaller records lower the latency of interleaved writes at the cost of throughput.
+	WriteChunkSize int
+	// ReuseReadBuffer reads records into a buffer kept by the connection instead of allocating one per record,
+	// holding about 16 KiB per connection while it is open.
+	ReuseReadBuffer bool
+	// ManualReadDeadline stops asking sing's copy helpers to set their own read deadlines, for callers
+	// that manage deadlines themselves. Leave it unset otherwise, the helpers rely on those deadlines
+	// to stop copying when the other direction finished.
+	ManualReadDeadline bool
+	// SampleInterval logs the read and write throughput of each connection at debug level, 0 disables.
+	SampleInterval time.Duration
+	// RequireTLS13 closes connections whose handshake server answers without TLS 1.3 with ErrTLS13Downgrade,
+	// e.g. after a middlebox stripped supported_versions, instead of continuing without the TLS 1.3 checks or,
+	// in strict mode on the server, relaying the client to the handshake server. Ignored with LegacyTLS12.
+	// NewService and NewClient enable it unless the config sets it to false.
+	RequireTLS13 bool
+	// MaxRecordRate closes the connection with an alert when the peer sends more records than this
+	// within one second, limiting the per record HMAC work a peer can cause. 0 disables.
+	MaxRecordRate int
+	// Padding pads short records to hide the write sizes, it must be enabled on both peers, see Padding.
+	Padding Padding
+	// RekeyBytes writes a rekey record after this many payload bytes, 0 disables.
+	// The peer must accept rekey records, see v3_rekey.go for the wire format.
+	RekeyBytes int64
+	// CloseRecord ends the written data with an authenticated close record on CloseWrite and Close, and only
+	// accepts that as the end of the peer data, so a close_notify alert or EOF injected on the path fails the read.
+	// It must be enabled on both peers, see v3_conn.go for the wire format. Without it the data ends with
+	// the EOF of the underlying connection like in other implementations, or a close_notify alert.
+	CloseRecord bool
+	Clock       Clock       // SystemClock if nil
+	FrameDumper FrameDumper // receives a copy of every record, see FrameDumper
+}
+
+type Option func(features *Features)
+
+func WithStrictMode(strictMode bool) Option {
+	return func(features *Features) {
+		features.StrictMode = strictMode
+	}
+}
+
+func WithLegacyTLS12(legacyTLS12 bool) Option {
+	return func(features *Features) {
+		features.LegacyTLS12 = legacyTLS12
+	}
+}
+
+func WithPacing(pacing Pacing) Option {
+	return func(features *Features) {
+		features.Pacing = pacing
+	}
+}
+
+func WithRecordVersion(recordVersion [2]byte) Option {
+	return func(features *Features) {
+		features.RecordVersion = recordVersion
+	}
+}
+
+func WithFrameTransport(transport FrameTransport) Option {
+	return func(features *Features) {
+		features.FrameTransport = transport
+	}
+}
+
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(features *Features) {
+		features.IdleTimeout = timeout
+	}
+}
+
+func WithMaxRecordSize(size int) Option {
+	return func(features *Features) {
+		features.MaxRecordSize = size
+	}
+}
+
+func WithKeepAliveInterval(interval time.Duration) Option {
+	return func(features *Features) {
+		features.KeepAliveInterval = interval
+	}
+}
+
+func WithCompression(compression bool) Option {
+	return func(features *Features) {
+		features.Compression = compression
+	}
+}
+
+func WithWriteChunkSize(size int) Option {
+	return func(features *Features) {
+		features.WriteChunkSize = size
+	}
+}
+
+func WithReuseReadBuffer(reuseReadBuffer bool) Option {
+	return func(features *Features) {
+		features.ReuseReadBuffer = reuseReadBuffer
+	}
+}
+
+func WithManualReadDeadline(manualReadDeadline bool) Option {
+	return func(features *Features) {
+		features.ManualReadDeadline = manualReadDeadline
+	}
+}
+
+func WithSampleInterval(interval time.Duration) Option {
+	return func(features *Features) {
+		features.SampleInterval = interval
+	}
+}
+
+func WithRequireTLS13(requireTLS13 bool) Option {
+	return func(features *Features) {
+		features.RequireTLS13 = requireTLS13
+	}
+}
+
+func WithMaxRecordRate(rate int) Option {
+	return func(features *Features) {
+		features.MaxRecordRate = rate
+	}
+}
+
+func WithRekeyBytes(rekeyBytes int64) Option {
+	return func(features *Features) {
+		features.RekeyBytes = rekeyBytes
+	}
+}
+
+func WithCloseRecord(closeRecord bool) Option {
+	return func(features *Features) {
+		features.CloseRecord = closeRecord
+	}
+}
+
+func WithPadding(padding Padding) Option {
+	return func(features *Features) {
+		features.Padding = padding
+	}
+}
+
+func WithClock(clock Clock) Option {
+	return func(features *Features) {
+		features.Clock = clock
+	}
+}
+
+func WithFrameDumper(dumper FrameDumper) Option {
+	return func(features *Features) {
+		features.FrameDumper = dumper
+	}
+}
+
+// requireTLS13 returns the RequireTLS13 feature for a config field, which is enabled if unset.
+func requireTLS13(requireTLS13 *bool) bool {
+	return requireTLS13 == nil || *requireTLS13
+}
+
+func newFeatures(features Features, options []Option) Features {
+	for _, option := range options {
+		option(&features)
+	}
+	if features.RecordVersion == ([2]byte{}) {
+		features.RecordVersion = defaultRecordVersion
+	}
+	if features.Clock == nil {
+		features.Clock = SystemClock
+	}
+	return features
+}
+
+func (f *Features) setupConn(verifiedConn *verifiedConn, conn net.Conn) {
+	verifiedConn.pacer = newPacer(f.Clock, f.Pacing)
+	verifiedConn.recordVersion = f.RecordVersion
+	verifiedConn.transport = f.FrameTransport
+	verifiedConn.maxRecordSize = f.MaxRecordSize
+	verifiedConn.frameDumper = f.FrameDumper
+	verifiedConn.rekeyBytes = f.RekeyBytes
+	verifiedConn.closeRecord = f.CloseRecord
+	verifiedConn.reuseReadBuffer = f.ReuseReadBuffer
+	verifiedConn.manualDeadline = f.ManualReadDeadline
+	verifiedConn.recordLimiter = newRecordLimiter(f.Clock, f.MaxRecordRate)
+	if f.WriteChunkSize > 0 && f.WriteChunkSize < maxRecordPayloadSize {
+		verifiedConn.writeChunkSize = f.WriteChunkSize
+	}
+	verifiedConn.padder = newPadder(f.Padding)
+	if verifiedConn.padder != nil && verifiedConn.writeChunkSize > maxRecordPayloadSize-paddingHeaderSize {
+		verifiedConn.writeChunkSize = maxRecordPayloadSize - paddingHeaderSize
+	}
+	verifiedConn.keepAlive = newKeepAlive(f.Clock, f.KeepAliveInterval, verifiedConn.writeKeepAlive)
+	verifiedConn.idleTimer = newIdleTimer(f.Clock, f.IdleTimeout, func() {
+		conn.Close()
+	})
+}
+
+func (f *Features) startSampler(ctx context.Context, logger logger.ContextLogger, verifiedConn *verifiedConn) {
+	verifiedConn.sampler = newThroughputSampler(f.Clock, f.SampleInterval, func(readRate uint64, writeRate uint64) {
+		logger.DebugContext(ctx, "throughput: read ", readRate, " B/s, write ", writeRate, " B/s")
+	})
+}
+
+func (f *Features) wrapConn(conn net.Conn) net.Conn {
+	if f.Compression {
+		compressedConn := newCompressedConn(conn)
+		if firstFrameConn, isFirstFrameConn := conn.(FirstFrameConn); isFirstFrameConn {
+			return &compressedFirstFrameConn{compressedConn: compressedConn, upstream: firstFrameConn}
+		}
+		return compressedConn
+	}
+	return conn
+}
@@ -0,0 +1,39 @@
+package shadowtls
+
+import (
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+)
+
+// FirstFrameConn is implemented by v3 connections passed to the Handler.
+// PeekFirstFrame returns the payload of the first client data record, it is still returned by Read.
+// With compression it returns the decompressed start of the record.
+type FirstFrameConn interface {
+	PeekFirstFrame() []byte
+}
+
+type firstFrameConn struct {
+	*bufio.CachedConn
+	conn       *verifiedConn
+	firstFrame []byte
+}
+
+func newFirstFrameConn(conn *verifiedConn, firstFrame *buf.Buffer) *firstFrameConn {
+	return &firstFrameConn{
+		CachedConn: bufio.NewCachedConn(conn, firstFrame),
+		conn:       conn,
+		firstFrame: append([]byte(nil), firstFrame.Bytes()...),
+	}
+}
+
+func (c *firstFrameConn) PeekFirstFrame() []byte {
+	return c.firstFrame
+}
+
+func (c *firstFrameConn) CloseWrite() error {
+	return c.conn.CloseWrite()
+}
+
+func (c *firstFrameConn) Upstream() any {
+	return c.CachedConn
+}
@@ -0,0 +1,26 @@
+package shadowtls
+
+// Directions passed to a FrameDumper. During the v3 handshake relay, records are dumped by the side
+// that sent them, server records after modification. In the data phase, records are dumped as read or written.
+const (
+	FrameDirectionClient = "client"
+	FrameDirectionServer = "server"
+	FrameDirectionRead   = "read"
+	FrameDirectionWrite  = "write"
+)
+
+// FrameDumper receives a copy of every complete TLS record, e.g. to reconstruct a capture offline.
+// It is called synchronously from the relay and read or write paths and must not block.
+type FrameDumper func(direction string, frame []byte)
+
+func (d FrameDumper) dump(direction string, parts ...[]byte) {
+	var length int
+	for _, part := range parts {
+		length += len(part)
+	}
+	frame := make([]byte, 0, length)
+	for _, part := range parts {
+		frame = append(frame, part...)
+	}
+	d(direction, frame)
+}
@@ -0,0 +1,33 @@
+package shadowtls
+
+import (
+	"io"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// FrameTransport carries TLS records of the protocol version 3 data phase.
+// ReadFrame returns a complete record including its header, a record with more than maxLength
+// bytes of payload must be rejected before it is allocated, 0 for no limit.
+// WriteFrame receives the header and the payload of one record as separate slices.
+// The handshake is always relayed as plain TLS records.
+type FrameTransport interface {
+	ReadFrame(reader io.Reader, maxLength int) (*buf.Buffer, error)
+	WriteFrame(writer N.VectorisedWriter, frame [][]byte) error
+}
+
+var _ FrameTransport = TLSRecordTransport{}
+
+// TLSRecordTransport is the default FrameTransport that writes records as is.
+type TLSRecordTransport struct{}
+
+func (t TLSRecordTransport) ReadFrame(reader io.Reader, maxLength int) (*buf.Buffer, error) {
+	return extractFrameLimited(reader, maxLength)
+}
+
+func (t TLSRecordTransport) WriteFrame(writer N.VectorisedWriter, frame [][]byte) error {
+	_, err := bufio.WriteVectorised(writer, frame)
+	return err
+}
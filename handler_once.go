@@ -0,0 +1,31 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/debug"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var errHandlerInvokedTwice = E.New("handler invoked twice for one connection")
+
+// onceHandler passes a connection to the Handler at most once. Every path of newConnection ends in
+// either the Handler or a relay to the handshake server, a second call is a bug and panics in debug builds.
+type onceHandler struct {
+	Handler
+	dispatched bool
+}
+
+func (h *onceHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if h.dispatched {
+		if debug.Enabled {
+			panic(errHandlerInvokedTwice)
+		}
+		conn.Close()
+		return errHandlerInvokedTwice
+	}
+	h.dispatched = true
+	return h.Handler.NewConnection(ctx, conn, metadata)
+}
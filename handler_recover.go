@@ -0,0 +1,28 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// recoverHandler turns a panic in the Handler into an error, so that one connection can not crash the service.
+type recoverHandler struct {
+	Handler
+	logger logger.ContextLogger
+}
+
+func (h recoverHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			conn.Close()
+			err = E.New("handler panic: ", recovered)
+			h.logger.ErrorContext(ctx, err, "\n", string(debug.Stack()))
+		}
+	}()
+	return h.Handler.NewConnection(ctx, conn, metadata)
+}
@@ -0,0 +1,46 @@
+package shadowtls
+
+import (
+	"net"
+
+	"github.com/sagernet/sing/common/control"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// bindHandshakeDialers sets a dialer bound to the named interface for every handshake server without a dialer,
+// including handshakes set with ContextWithHandshake.
+// The interface index is resolved once, a recreated interface requires a new Service.
+func (s *Service) bindHandshakeDialers(interfaceName string) error {
+	netInterface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return E.Cause(err, "find handshake bind interface")
+	}
+	dialer := &N.DefaultDialer{
+		Dialer: net.Dialer{
+			Control: control.BindToInterface(nil, netInterface.Name, netInterface.Index),
+		},
+	}
+	s.handshakeBindDialer = dialer
+	if s.handshake.Dialer == nil {
+		s.handshake.Dialer = dialer
+	}
+	handshakeForServerName := make(map[string]HandshakeConfig, len(s.handshakeForServerName))
+	for serverName, handshake := range s.handshakeForServerName {
+		if handshake.Dialer == nil {
+			handshake.Dialer = dialer
+		}
+		handshakeForServerName[serverName] = handshake
+	}
+	// the map belongs to the caller
+	s.handshakeForServerName = handshakeForServerName
+	if s.handshakeTargets != nil {
+		// the targets are already copied
+		for i := range s.handshakeTargets.targets {
+			if s.handshakeTargets.targets[i].Dialer == nil {
+				s.handshakeTargets.targets[i].Dialer = dialer
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package shadowtls
+
+import (
+	"context"
+	"crypto/tls"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// CheckHandshakeServer completes a TLS handshake with every configured handshake server like an
+// ordinary client, so that a misconfigured front fails at startup instead of every client falling back.
+// Unless the service only serves protocol version 1 or 2 or LegacyTLS12 is set, the servers must negotiate TLS 1.3.
+// Certificates are not verified.
+func (s *Service) CheckHandshakeServer(ctx context.Context) error {
+	if s.handshakeTargets != nil {
+		for _, target := range s.handshakeTargets.targets {
+			err := s.probeHandshakeServer(ctx, target.HandshakeConfig, "")
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		err := s.probeHandshakeServer(ctx, s.handshake, "")
+		if err != nil {
+			return err
+		}
+	}
+	for serverName, handshakeConfig := range s.handshakeForServerName {
+		err := s.probeHandshakeServer(ctx, handshakeConfig, serverName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) probeHandshakeServer(ctx context.Context, handshakeConfig HandshakeConfig, serverName string) error {
+	conn, err := s.dialHandshakeServer(ctx, handshakeConfig)
+	if err != nil {
+		return E.Cause(err, "dial handshake server ", handshakeConfig.Server)
+	}
+	defer conn.Close()
+	if s.handshakeProxyProtocol != 0 {
+		err = writeProxyProtocolHeader(conn, s.handshakeProxyProtocol, M.SocksaddrFromNet(conn.LocalAddr()), M.SocksaddrFromNet(conn.RemoteAddr()))
+		if err != nil {
+			return E.Cause(err, "write PROXY protocol header to handshake server ", handshakeConfig.Server)
+		}
+	}
+	if serverName == "" && handshakeConfig.Server.IsFqdn() {
+		serverName = handshakeConfig.Server.Fqdn
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return E.Cause(err, "TLS handshake with handshake server ", handshakeConfig.Server)
+	}
+	if s.version != 1 && s.version != 2 && !s.features.LegacyTLS12 && tlsConn.ConnectionState().Version != tls.VersionTLS13 {
+		return E.New("handshake server ", handshakeConfig.Server, " does not support TLS 1.3")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package shadowtls
+
+import (
+	"net"
+	"sync/atomic"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+type handshakeLimitConn struct {
+	net.Conn
+	remaining int64
+	disabled  atomic.Bool
+}
+
+func newHandshakeLimitConn(conn net.Conn, limit int, consumed int) net.Conn {
+	if limit <= 0 {
+		return conn
+	}
+	return &handshakeLimitConn{
+		Conn:      conn,
+		remaining: int64(limit - consumed),
+	}
+}
+
+func (c *handshakeLimitConn) Read(p []byte) (n int, err error) {
+	if c.disabled.Load() {
+		return c.Conn.Read(p)
+	}
+	if c.remaining <= 0 {
+		return 0, E.New("handshake size limit exceeded")
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err = c.Conn.Read(p)
+	c.remaining -= int64(n)
+	return
+}
+
+func (c *handshakeLimitConn) Upstream() any {
+	return c.Conn
+}
+
+func disableHandshakeLimit(conn net.Conn) {
+	if limitConn, isLimitConn := conn.(*handshakeLimitConn); isLimitConn {
+		limitConn.disabled.Store(true)
+	}
+}
@@ -0,0 +1,118 @@
+package shadowtls
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"net/netip"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var (
+	ErrServerCertificateMismatch = E.New("server certificate does not match the pinned hash")
+	ErrServerNameMismatch        = E.New("server certificate does not cover the server name")
+)
+
+// HandshakeOptions carries client options that a TLSHandshakeFunc is expected to honor,
+// DefaultTLSHandshakeFunc reads them from the context passed to it.
+type HandshakeOptions struct {
+	PinnedServerCertSHA256 []byte
+	LegacyTLS12            bool
+	MinVersion             uint16 // overrides tls.Config.MinVersion if set
+	MaxVersion             uint16 // overrides tls.Config.MaxVersion if set, LegacyTLS12 takes precedence
+	ServerName             string // overrides tls.Config.ServerName if set
+	// VerifyServerName checks that the leaf certificate covers the server name even if
+	// InsecureSkipVerify is set, see ClientConfig.VerifyServerName.
+	VerifyServerName bool
+	// DisableGREASE stops DefaultTLSHandshakeFunc from advertising RFC 8701 values like browsers do,
+	// a ClientHello without them is easier to tell from a browser.
+	DisableGREASE bool
+}
+
+// HandshakeState receives what DefaultTLSHandshakeFunc negotiated with the handshake server when it is
+// passed in the context of a dial. The client runs a real TLS handshake with that server, so it can read
+// the ALPN from the encrypted extensions, the ShadowTLS server that relays them can not.
+// It stays empty for ClientHelloTemplate and for TLSHandshakeFuncs that do not fill it.
+type HandshakeState struct {
+	NegotiatedProtocol string
+}
+
+type (
+	handshakeOptionsKey struct{}
+	handshakeStateKey   struct{}
+)
+
+func ContextWithHandshakeOptions(ctx context.Context, options *HandshakeOptions) context.Context {
+	return context.WithValue(ctx, handshakeOptionsKey{}, options)
+}
+
+func HandshakeOptionsFromContext(ctx context.Context) *HandshakeOptions {
+	options, _ := ctx.Value(handshakeOptionsKey{}).(*HandshakeOptions)
+	return options
+}
+
+func ContextWithHandshakeState(ctx context.Context, state *HandshakeState) context.Context {
+	return context.WithValue(ctx, handshakeStateKey{}, state)
+}
+
+func HandshakeStateFromContext(ctx context.Context) *HandshakeState {
+	state, _ := ctx.Value(handshakeStateKey{}).(*HandshakeState)
+	return state
+}
+
+// checkServerName accepts DNS host names, SNI can not carry IP addresses.
+func checkServerName(serverName string) error {
+	if len(serverName) > 253 {
+		return E.New("invalid server name: ", serverName)
+	}
+	if _, err := netip.ParseAddr(serverName); err == nil {
+		return E.New("invalid server name: ", serverName)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(serverName, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return E.New("invalid server name: ", serverName)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return E.New("invalid server name: ", serverName)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *HandshakeOptions) verifyPeerCertificate(serverName string, next func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(o.PinnedServerCertSHA256) == 0 && !o.VerifyServerName {
+		return next
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(o.PinnedServerCertSHA256) > 0 {
+			if len(rawCerts) == 0 {
+				return ErrServerCertificateMismatch
+			}
+			certHash := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(certHash[:], o.PinnedServerCertSHA256) != 1 {
+				return ErrServerCertificateMismatch
+			}
+		}
+		if o.VerifyServerName {
+			if len(rawCerts) == 0 {
+				return ErrServerNameMismatch
+			}
+			certificate, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return E.Cause(err, "parse server certificate")
+			}
+			if certificate.VerifyHostname(serverName) != nil {
+				return E.Extend(ErrServerNameMismatch, serverName)
+			}
+		}
+		if next != nil {
+			return next(rawCerts, verifiedChains)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,45 @@
+package shadowtls
+
+import (
+	"context"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+type handshakeOverrideKey struct{}
+
+// ContextWithHandshake makes NewConnection and Accept use handshake for the connection instead of the configured
+// handshake servers, e.g. when a router in front of the service already picked the front for the client.
+// A nil Dialer uses the HandshakeBindInterface dialer, or else the dialer of ServiceConfig.Handshake.
+// A handshake failing the checks of NewService is logged and the configured handshake servers are used.
+func ContextWithHandshake(ctx context.Context, handshake HandshakeConfig) context.Context {
+	return context.WithValue(ctx, handshakeOverrideKey{}, handshake)
+}
+
+func HandshakeFromContext(ctx context.Context) (HandshakeConfig, bool) {
+	handshake, loaded := ctx.Value(handshakeOverrideKey{}).(HandshakeConfig)
+	return handshake, loaded
+}
+
+func (s *Service) handshakeOverride(ctx context.Context) (HandshakeConfig, bool) {
+	handshake, loaded := HandshakeFromContext(ctx)
+	if !loaded {
+		return HandshakeConfig{}, false
+	}
+	if handshake.Dialer == nil {
+		if s.handshakeBindDialer != nil {
+			handshake.Dialer = s.handshakeBindDialer
+		} else {
+			handshake.Dialer = s.handshake.Dialer
+		}
+	}
+	err := s.checkHandshake(handshake)
+	if err == nil && !handshake.Server.IsValid() {
+		err = E.New("missing handshake server")
+	}
+	if err != nil {
+		s.logger.WarnContext(ctx, "ignore handshake override: ", err)
+		return HandshakeConfig{}, false
+	}
+	return handshake, true
+}
@@ -0,0 +1,240 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const defaultPoolMaxIdleTime = 30 * time.Second
+
+type HandshakePoolConfig struct {
+	Dialer             N.Dialer
+	IdleConnections    int           // idle connections kept per handshake server
+	MaxIdleConnections int           // idle connections kept across all handshake servers, 0 for no limit
+	MaxIdleTime        time.Duration // idle connections older than this are closed
+	// LIFO hands out the most recently dialed idle connection first, so a small working set stays warm
+	// and older connections idle out, instead of the oldest first.
+	LIFO  bool
+	Clock Clock // SystemClock if nil
+}
+
+// HandshakePool keeps connections to handshake servers dialed in advance.
+// One pool may be shared by several Services, every connection is used for a single handshake.
+type HandshakePool struct {
+	dialer             N.Dialer
+	idleConnections    int
+	maxIdleConnections int
+	maxIdleTime        time.Duration
+	lifo               bool
+	clock              Clock
+	access             sync.Mutex
+	idle               map[M.Socksaddr][]idleConn
+	filling            map[M.Socksaddr]bool
+	evictTimer         Timer
+	inUse              atomic.Int64
+	hits               atomic.Uint64
+	misses             atomic.Uint64
+	closed             bool
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+func NewHandshakePool(config HandshakePoolConfig) *HandshakePool {
+	pool := &HandshakePool{
+		dialer:             config.Dialer,
+		idleConnections:    config.IdleConnections,
+		maxIdleConnections: config.MaxIdleConnections,
+		maxIdleTime:        config.MaxIdleTime,
+		lifo:               config.LIFO,
+		clock:              config.Clock,
+		idle:               make(map[M.Socksaddr][]idleConn),
+		filling:            make(map[M.Socksaddr]bool),
+	}
+	if pool.dialer == nil {
+		pool.dialer = N.SystemDialer
+	}
+	if pool.clock == nil {
+		pool.clock = SystemClock
+	}
+	if pool.maxIdleTime <= 0 {
+		pool.maxIdleTime = defaultPoolMaxIdleTime
+	}
+	return pool
+}
+
+func (p *HandshakePool) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if network != N.NetworkTCP {
+		return p.dialer.DialContext(ctx, network, destination)
+	}
+	conn := p.take(destination)
+	if p.idleConnections > 0 {
+		go p.fill(destination)
+	}
+	if conn == nil {
+		var err error
+		conn, err = p.dialer.DialContext(ctx, network, destination)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.inUse.Add(1)
+	return &pooledConn{Conn: conn, pool: p}, nil
+}
+
+func (p *HandshakePool) take(destination M.Socksaddr) net.Conn {
+	p.access.Lock()
+	defer p.access.Unlock()
+	// conns are ordered from the oldest to the most recently dialed
+	conns := p.idle[destination]
+	for len(conns) > 0 {
+		var conn idleConn
+		if p.lifo {
+			conn = conns[len(conns)-1]
+			conns = conns[:len(conns)-1]
+		} else {
+			conn = conns[0]
+			conns = conns[1:]
+		}
+		if p.clock.Now().Sub(conn.since) < p.maxIdleTime {
+			p.idle[destination] = conns
+			p.hits.Add(1)
+			return conn.Conn
+		}
+		conn.Close()
+	}
+	delete(p.idle, destination)
+	p.misses.Add(1)
+	return nil
+}
+
+// evict closes idle connections older than MaxIdleTime, it runs every half MaxIdleTime while connections are idle.
+func (p *HandshakePool) evict() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.closed {
+		return
+	}
+	now := p.clock.Now()
+	for destination, conns := range p.idle {
+		var expired int
+		for expired < len(conns) && now.Sub(conns[expired].since) >= p.maxIdleTime {
+			conns[expired].Close()
+			expired++
+		}
+		if expired == len(conns) {
+			delete(p.idle, destination)
+		} else {
+			p.idle[destination] = conns[expired:]
+		}
+	}
+	if len(p.idle) > 0 {
+		p.evictTimer.Reset(p.maxIdleTime / 2)
+	} else {
+		p.evictTimer = nil
+	}
+}
+
+func (p *HandshakePool) idleCount() int {
+	var count int
+	for _, conns := range p.idle {
+		count += len(conns)
+	}
+	return count
+}
+
+func (p *HandshakePool) fill(destination M.Socksaddr) {
+	p.access.Lock()
+	if p.closed || p.filling[destination] {
+		p.access.Unlock()
+		return
+	}
+	p.filling[destination] = true
+	p.access.Unlock()
+	defer func() {
+		p.access.Lock()
+		delete(p.filling, destination)
+		p.access.Unlock()
+	}()
+	for {
+		p.access.Lock()
+		full := p.closed || len(p.idle[destination]) >= p.idleConnections ||
+			p.maxIdleConnections > 0 && p.idleCount() >= p.maxIdleConnections
+		p.access.Unlock()
+		if full {
+			return
+		}
+		conn, err := p.dialer.DialContext(context.Background(), N.NetworkTCP, destination)
+		if err != nil {
+			return
+		}
+		p.access.Lock()
+		if p.closed {
+			p.access.Unlock()
+			conn.Close()
+			return
+		}
+		p.idle[destination] = append(p.idle[destination], idleConn{Conn: conn, since: p.clock.Now()})
+		if p.evictTimer == nil {
+			p.evictTimer = p.clock.AfterFunc(p.maxIdleTime/2, p.evict)
+		}
+		p.access.Unlock()
+	}
+}
+
+// Stats returns the number of idle connections across all handshake servers
+// and the number of pooled connections handed out and not closed yet.
+func (p *HandshakePool) Stats() (idle int, inUse int) {
+	p.access.Lock()
+	idle = p.idleCount()
+	p.access.Unlock()
+	return idle, int(p.inUse.Load())
+}
+
+// ReuseStats returns how many TCP dials were served by an idle connection and how many had to dial.
+func (p *HandshakePool) ReuseStats() (hits uint64, misses uint64) {
+	return p.hits.Load(), p.misses.Load()
+}
+
+// Close closes idle connections, connections in use are not affected.
+func (p *HandshakePool) Close() error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.closed = true
+	if p.evictTimer != nil {
+		p.evictTimer.Stop()
+		p.evictTimer = nil
+	}
+	for _, conns := range p.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	p.idle = make(map[M.Socksaddr][]idleConn)
+	return nil
+}
+
+type pooledConn struct {
+	net.Conn
+	pool      *HandshakePool
+	closeOnce sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.pool.inUse.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+func (c *pooledConn) Upstream() any {
+	return c.Conn
+}
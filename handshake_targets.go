@@ -0,0 +1,80 @@
+package shadowtls
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const handshakeTargetFailureCooldown = 30 * time.Second
+
+// HandshakeTarget is a handshake server picked at random in proportion to its weight.
+type HandshakeTarget struct {
+	HandshakeConfig
+	Weight int // 1 if not positive
+}
+
+// handshakeTargets skips targets that failed to dial within the cooldown,
+// unless all of them did.
+type handshakeTargets struct {
+	clock    Clock
+	targets  []HandshakeTarget
+	failedAt []atomic.Int64
+}
+
+func newHandshakeTargets(clock Clock, targets []HandshakeTarget) *handshakeTargets {
+	if len(targets) == 0 {
+		return nil
+	}
+	targets = append([]HandshakeTarget(nil), targets...)
+	for i := range targets {
+		if targets[i].Weight <= 0 {
+			targets[i].Weight = 1
+		}
+	}
+	return &handshakeTargets{
+		clock:    clock,
+		targets:  targets,
+		failedAt: make([]atomic.Int64, len(targets)),
+	}
+}
+
+func (t *handshakeTargets) pick() HandshakeConfig {
+	now := t.clock.Now().UnixNano()
+	var totalWeight int
+	healthy := make([]bool, len(t.targets))
+	for i, target := range t.targets {
+		failedAt := t.failedAt[i].Load()
+		if failedAt == 0 || time.Duration(now-failedAt) >= handshakeTargetFailureCooldown {
+			healthy[i] = true
+			totalWeight += target.Weight
+		}
+	}
+	if totalWeight == 0 {
+		for i, target := range t.targets {
+			healthy[i] = true
+			totalWeight += target.Weight
+		}
+	}
+	selected := rand.Intn(totalWeight)
+	for i, target := range t.targets {
+		if !healthy[i] {
+			continue
+		}
+		if selected < target.Weight {
+			return target.HandshakeConfig
+		}
+		selected -= target.Weight
+	}
+	return t.targets[len(t.targets)-1].HandshakeConfig
+}
+
+func (t *handshakeTargets) markFailed(server M.Socksaddr) {
+	for i, target := range t.targets {
+		if target.Server == server {
+			t.failedAt[i].Store(t.clock.Now().UnixNano())
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package shadowtls
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestHandshakeTargetsWeights(t *testing.T) {
+	clock := newFakeClock()
+	listener := startHandshakeServer(t)
+	servers := []M.Socksaddr{
+		M.ParseSocksaddr("192.0.2.1:443"),
+		M.ParseSocksaddr("192.0.2.2:443"),
+		M.ParseSocksaddr("192.0.2.3:443"),
+	}
+	targets := newHandshakeTargets(clock, []HandshakeTarget{
+		{HandshakeConfig: HandshakeConfig{Server: servers[0], Dialer: listener}, Weight: 1},
+		{HandshakeConfig: HandshakeConfig{Server: servers[1], Dialer: listener}, Weight: 3},
+		{HandshakeConfig: HandshakeConfig{Server: servers[2], Dialer: listener}, Weight: 6},
+	})
+	const picks = 100000
+	count := func() map[M.Socksaddr]int {
+		counts := make(map[M.Socksaddr]int)
+		for i := 0; i < picks; i++ {
+			counts[targets.pick().Server]++
+		}
+		return counts
+	}
+	checkShares := func(counts map[M.Socksaddr]int, shares []float64) {
+		t.Helper()
+		for i, share := range shares {
+			if actual := float64(counts[servers[i]]) / picks; math.Abs(actual-share) > 0.01 {
+				t.Errorf("%s picked %.3f of the time, expected %.3f", servers[i], actual, share)
+			}
+		}
+	}
+	checkShares(count(), []float64{0.1, 0.3, 0.6})
+
+	targets.markFailed(servers[2])
+	checkShares(count(), []float64{0.25, 0.75, 0})
+
+	targets.markFailed(servers[0])
+	targets.markFailed(servers[1])
+	checkShares(count(), []float64{0.1, 0.3, 0.6})
+
+	clock.Advance(handshakeTargetFailureCooldown)
+	checkShares(count(), []float64{0.1, 0.3, 0.6})
+}
+
+func TestHandshakeTargetsDialer(t *testing.T) {
+	config := ServiceConfig{
+		Version: 3,
+		Users:   []User{{Password: testPassword}},
+		HandshakeTargets: []HandshakeTarget{
+			{HandshakeConfig: HandshakeConfig{Server: testHandshakeServer}},
+		},
+		Handler: handlerFunc(echoHandler),
+		Logger:  logger.NOP(),
+	}
+	_, err := NewService(config)
+	if err == nil {
+		t.Fatal("handshake target without dialer accepted")
+	}
+
+	loopback, err := loopbackInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+	config.HandshakeBindInterface = loopback
+	service, err := NewService(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.handshakeTargets.targets[0].Dialer == nil {
+		t.Fatal("handshake target not bound to the interface")
+	}
+	if config.HandshakeTargets[0].Dialer != nil {
+		t.Fatal("handshake target of the caller modified")
+	}
+}
+
+func loopbackInterface() (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, netInterface := range interfaces {
+		if netInterface.Flags&net.FlagLoopback != 0 {
+			return netInterface.Name, nil
+		}
+	}
+	return "", E.New("no loopback interface")
+}
@@ -0,0 +1,75 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+)
+
+type handshakeDeadlineKey struct{}
+
+// startHandshakeTimeout limits the handshake phase of conn to HandshakeTimeout. Reads and writes on conn fail
+// afterwards, and the returned context carries the deadline for the handshake dial and relay.
+func (s *Service) startHandshakeTimeout(ctx context.Context, conn net.Conn) context.Context {
+	if s.handshakeTimeout <= 0 {
+		return ctx
+	}
+	deadline := time.Now().Add(s.handshakeTimeout)
+	conn.SetDeadline(deadline)
+	return context.WithValue(ctx, handshakeDeadlineKey{}, deadline)
+}
+
+func handshakeDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, loaded := ctx.Value(handshakeDeadlineKey{}).(time.Time)
+	return deadline, loaded
+}
+
+// handshakeContext returns a context expiring with the handshake phase, the relay groups close
+// the handshake connection when it does.
+func handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, loaded := handshakeDeadline(ctx)
+	if !loaded {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// stopHandshakeTimeout is called before conn is passed to the Handler or relayed as a fallback,
+// both may last much longer than a handshake.
+func (s *Service) stopHandshakeTimeout(conns ...net.Conn) {
+	if s.handshakeTimeout > 0 {
+		for _, conn := range conns {
+			conn.SetDeadline(time.Time{})
+		}
+	}
+}
+
+// startFirstFrameTimeout expires the reads on conn once FirstFrameTimeout passes, unless the handshake
+// deadline comes first. The returned function stops the timeout and reports false if it expired,
+// in which case the handshake deadline is restored.
+func (s *Service) startFirstFrameTimeout(ctx context.Context, conn net.Conn) func() bool {
+	if s.firstFrameTimeout <= 0 {
+		return func() bool { return true }
+	}
+	deadline, loaded := handshakeDeadline(ctx)
+	if loaded && time.Until(deadline) <= s.firstFrameTimeout {
+		return func() bool { return true }
+	}
+	timer := s.features.Clock.AfterFunc(s.firstFrameTimeout, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	return func() bool {
+		if timer.Stop() {
+			return true
+		}
+		conn.SetReadDeadline(deadline)
+		return false
+	}
+}
+
+func (s *Service) relayFallback(ctx context.Context, conn net.Conn, handshakeConn net.Conn) error {
+	s.stopHandshakeTimeout(conn, handshakeConn)
+	return bufio.CopyConn(ctx, conn, handshakeConn)
+}
@@ -0,0 +1,150 @@
+// Package handshakeserver implements a minimal TLS 1.3 server to be used as a local handshake server or decoy.
+package handshakeserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+type Config struct {
+	// Certificates are presented to clients, a self-signed certificate for ServerName is generated if empty.
+	Certificates []tls.Certificate
+	ServerName   string
+	// Response is written after the handshake and the first client read, before the connection is closed.
+	Response         []byte
+	HandshakeTimeout time.Duration
+}
+
+type Server struct {
+	tlsConfig        *tls.Config
+	response         []byte
+	handshakeTimeout time.Duration
+	access           sync.Mutex
+	listeners        []net.Listener
+	closed           bool
+}
+
+func New(config Config) (*Server, error) {
+	certificates := config.Certificates
+	if len(certificates) == 0 {
+		if config.ServerName == "" {
+			return nil, E.New("missing certificates or server name")
+		}
+		certificate, err := GenerateCertificate(config.ServerName)
+		if err != nil {
+			return nil, E.Cause(err, "generate certificate")
+		}
+		certificates = []tls.Certificate{certificate}
+	}
+	server := &Server{
+		tlsConfig: &tls.Config{
+			Certificates: certificates,
+			MinVersion:   tls.VersionTLS13,
+		},
+		response:         config.Response,
+		handshakeTimeout: config.HandshakeTimeout,
+	}
+	if server.handshakeTimeout <= 0 {
+		server.handshakeTimeout = defaultHandshakeTimeout
+	}
+	return server, nil
+}
+
+// GenerateCertificate creates a self-signed ECDSA certificate for serverName valid for one year.
+func GenerateCertificate(serverName string) (tls.Certificate, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: serverName},
+		DNSNames:              []string{serverName},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{certificate},
+		PrivateKey:  privateKey,
+	}, nil
+}
+
+// Serve accepts connections on listener until it fails or the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.access.Lock()
+	if s.closed {
+		s.access.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	s.access.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.NewConnection(context.Background(), conn)
+	}
+}
+
+// NewConnection completes the handshake on conn, answers the first request and closes it.
+func (s *Server) NewConnection(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	handshakeCtx, cancel := context.WithTimeout(ctx, s.handshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	err := tlsConn.HandshakeContext(handshakeCtx)
+	if err != nil {
+		return E.Cause(err, "handshake")
+	}
+	if len(s.response) > 0 {
+		var request [1024]byte
+		tlsConn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+		_, err = tlsConn.Read(request[:])
+		if err != nil {
+			return E.Cause(err, "read request")
+		}
+		_, err = tlsConn.Write(s.response)
+		if err != nil {
+			return E.Cause(err, "write response")
+		}
+	}
+	return tlsConn.Close()
+}
+
+func (s *Server) Close() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.closed = true
+	var errs []error
+	for _, listener := range s.listeners {
+		errs = append(errs, listener.Close())
+	}
+	s.listeners = nil
+	return E.Errors(errs...)
+}
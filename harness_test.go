@@ -0,0 +1,390 @@
+package shadowtls
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowtls/handshakeserver"
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	testPassword    = "hV3q-Tz8n_Lw2Rk5"
+	testServerName  = "example.com"
+	testDialTimeout = 5 * time.Second
+)
+
+var testHandshakeServer = M.ParseSocksaddrHostPort(testServerName, 443)
+
+// testHandshakeResponse makes the handshake server wait for a request like a web server,
+// instead of closing right after the handshake while the client is still about to send data.
+var testHandshakeResponse = []byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+
+// startHandshakeServer serves a TLS 1.3 handshake server for testServerName on an in-memory listener,
+// which is also the dialer reaching it.
+func startHandshakeServer(t testing.TB) *memconn.Listener {
+	return startHandshakeServerWithConfig(t, handshakeserver.Config{ServerName: testServerName, Response: testHandshakeResponse})
+}
+
+func startHandshakeServerWithConfig(t testing.TB, config handshakeserver.Config) *memconn.Listener {
+	t.Helper()
+	server, err := handshakeserver.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := memconn.NewListener()
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return listener
+}
+
+// startTLS12HandshakeServer serves TLS 1.2 only handshakes for testServerName, for protocol version 1
+// and downgrade tests.
+func startTLS12HandshakeServer(t testing.TB) *memconn.Listener {
+	certificate, err := handshakeserver.GenerateCertificate(testServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := memconn.NewListener()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn := tls.Server(conn, &tls.Config{
+					Certificates: []tls.Certificate{certificate},
+					MaxVersion:   tls.VersionTLS12,
+				})
+				defer tlsConn.Close()
+				io.Copy(io.Discard, tlsConn)
+			}()
+		}
+	}()
+	return listener
+}
+
+type handlerFunc func(ctx context.Context, conn net.Conn, metadata M.Metadata) error
+
+func (f handlerFunc) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return f(ctx, conn, metadata)
+}
+
+func (f handlerFunc) NewError(ctx context.Context, err error) {
+}
+
+// echoHandler writes back everything it reads, then closes the connection.
+func echoHandler(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	defer conn.Close()
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+// newTestService fills the handshake server, users, handler and logger left empty in config.
+func newTestService(t testing.TB, config ServiceConfig, options ...Option) *Service {
+	t.Helper()
+	if !config.Handshake.Server.IsValid() && len(config.HandshakeTargets) == 0 {
+		config.Handshake = HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: startHandshakeServer(t),
+		}
+	}
+	if config.Version != 1 && config.Password == "" && len(config.Users) == 0 && config.PasswordProvider == nil {
+		if config.Version == 2 {
+			config.Password = testPassword
+		} else {
+			config.Users = []User{{Name: "test", Password: testPassword}}
+		}
+	}
+	if config.Handler == nil {
+		config.Handler = handlerFunc(echoHandler)
+	}
+	if config.Logger == nil {
+		config.Logger = logger.NOP()
+	}
+	service, err := NewServiceWithOptions(config, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// serveTestConn runs service on one end of an in-memory connection and returns the other end,
+// and the result of NewConnection once it returned and the connection was closed.
+func serveTestConn(ctx context.Context, service *Service) (net.Conn, <-chan error) {
+	return serveTestConnTo(ctx, service, M.ParseSocksaddr("198.51.100.1:443"))
+}
+
+// serveTestConnTo is serveTestConn with the destination passed to the handler.
+func serveTestConnTo(ctx context.Context, service *Service, destination M.Socksaddr) (net.Conn, <-chan error) {
+	clientConn, serverConn := memconn.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := service.NewConnection(ctx, serverConn, M.Metadata{
+			Source:      M.ParseSocksaddr("192.0.2.1:40000"),
+			Destination: destination,
+		})
+		serverConn.Close()
+		done <- err
+	}()
+	return clientConn, done
+}
+
+// newTestClient fills the version, password, TLS handshake and logger left empty in config.
+func newTestClient(t testing.TB, config ClientConfig, options ...Option) *Client {
+	t.Helper()
+	if config.Version == 0 {
+		config.Version = 3
+	}
+	if config.Password == "" {
+		config.Password = testPassword
+	}
+	if config.TLSHandshake == nil && len(config.ClientHelloTemplate) == 0 && config.ClientHelloSpec == nil {
+		config.TLSHandshake = DefaultTLSHandshakeFunc(config.Password, &tls.Config{
+			ServerName:         testServerName,
+			InsecureSkipVerify: true,
+		})
+		config.HandshakeOptionsAware = true
+	}
+	if config.Logger == nil {
+		config.Logger = logger.NOP()
+	}
+	client, err := NewClientWithOptions(config, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// dialTestConn runs the client handshake against a connection served by service.
+func dialTestConn(t testing.TB, service *Service, client *Client) (net.Conn, <-chan error) {
+	t.Helper()
+	conn, done := serveTestConn(context.Background(), service)
+	ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+	defer cancel()
+	dataConn, err := client.DialContextConn(ctx, conn)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dataConn.Close()
+	})
+	return dataConn, done
+}
+
+// captureClientHello returns the first record written by handshake, which is aborted afterwards.
+func captureClientHello(t testing.TB, handshake TLSHandshakeFunc, sessionIDGenerator TLSSessionIDGeneratorFunc) []byte {
+	t.Helper()
+	clientConn, serverConn := memconn.Pipe()
+	defer serverConn.Close()
+	go func() {
+		handshake(context.Background(), clientConn, sessionIDGenerator)
+		clientConn.Close()
+	}()
+	frame, err := extractFrame(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer frame.Release()
+	return append([]byte(nil), frame.Bytes()...)
+}
+
+// testClientHello returns a ClientHello record authenticated for testPassword.
+func testClientHello(t testing.TB) []byte {
+	return captureClientHello(t, DefaultTLSHandshakeFunc(testPassword, &tls.Config{
+		ServerName:         testServerName,
+		InsecureSkipVerify: true,
+	}), generateSessionID(testPassword))
+}
+
+// waitDone returns the result of NewConnection or fails the test if it does not return in time.
+func waitDone(t testing.TB, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testDialTimeout):
+		t.Fatal("service did not return")
+		return nil
+	}
+}
+
+// trackingAllocator is installed as buf.DefaultAllocator before the tests run and passes the buffers to the
+// leakAllocator of the current test, so that goroutines left by earlier tests never race with trackBuffers.
+type trackingAllocator struct {
+	upstream buf.Allocator
+	tracker  atomic.Pointer[leakAllocator]
+}
+
+var bufferTracking = &trackingAllocator{upstream: buf.DefaultAllocator}
+
+func init() {
+	buf.DefaultAllocator = bufferTracking
+}
+
+func (a *trackingAllocator) Get(size int) []byte {
+	data := a.upstream.Get(size)
+	if tracker := a.tracker.Load(); tracker != nil && cap(data) > 0 {
+		tracker.access.Lock()
+		tracker.outstanding[&data[:1][0]] = size
+		tracker.access.Unlock()
+	}
+	return data
+}
+
+func (a *trackingAllocator) Put(data []byte) error {
+	if tracker := a.tracker.Load(); tracker != nil && cap(data) > 0 {
+		tracker.access.Lock()
+		delete(tracker.outstanding, &data[:1][0])
+		tracker.access.Unlock()
+	}
+	return a.upstream.Put(data)
+}
+
+// leakAllocator tracks the pooled buffers taken while it is installed.
+type leakAllocator struct {
+	access      sync.Mutex
+	outstanding map[*byte]int
+}
+
+// trackBuffers installs a leakAllocator until the test ends, tests using it must not run in parallel.
+func trackBuffers(t testing.TB) *leakAllocator {
+	allocator := &leakAllocator{
+		outstanding: make(map[*byte]int),
+	}
+	bufferTracking.tracker.Store(allocator)
+	t.Cleanup(func() {
+		bufferTracking.tracker.CompareAndSwap(allocator, nil)
+	})
+	return allocator
+}
+
+// check fails the test if a buffer taken since the last check was not released.
+func (a *leakAllocator) check(t testing.TB, name string) {
+	t.Helper()
+	a.access.Lock()
+	defer a.access.Unlock()
+	for _, size := range a.outstanding {
+		t.Errorf("%s: buffer of %d bytes not released", name, size)
+	}
+	a.outstanding = make(map[*byte]int)
+}
+
+// fakeClock only moves forward with Advance, its AfterFunc functions run in their own goroutine like time.AfterFunc.
+type fakeClock struct {
+	access sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	channel  chan time.Time
+	f        func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, &fakeTimer{clock: c, channel: make(chan time.Time, 1)})
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(d, &fakeTimer{clock: c, f: f})
+}
+
+func (c *fakeClock) add(d time.Duration, timer *fakeTimer) *fakeTimer {
+	c.access.Lock()
+	defer c.access.Unlock()
+	timer.deadline = c.now.Add(d)
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock and fires the timers that expired.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.access.Lock()
+	c.now = c.now.Add(d)
+	var expired []*fakeTimer
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			expired = append(expired, timer)
+		}
+	}
+	c.timers = pending
+	now := c.now
+	c.access.Unlock()
+	for _, timer := range expired {
+		if timer.f != nil {
+			go timer.f()
+		} else {
+			timer.channel <- now
+		}
+	}
+}
+
+// waitTimers waits until n timers are pending, so that Advance does not run ahead of the code under test.
+func (c *fakeClock) waitTimers(t testing.TB, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testDialTimeout)
+	for time.Now().Before(deadline) {
+		c.access.Lock()
+		pending := len(c.timers)
+		c.access.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timer not started")
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.channel
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.access.Lock()
+	defer t.clock.access.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	t.clock.add(d, t)
+	return active
+}
@@ -0,0 +1,123 @@
+// Package faultdialer provides an N.Dialer that injects latency, failures and resets for testing.
+package faultdialer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var (
+	ErrInjectedDial  = E.New("injected dial failure")
+	ErrInjectedReset = E.New("injected connection reset")
+)
+
+type Dialer struct {
+	Upstream N.Dialer      // N.SystemDialer if nil
+	Latency  time.Duration // added before every dial
+	// FailDials fails this many dials before the next one succeeds.
+	FailDials atomic.Int64
+	// ResetAfterBytes resets connections after this many bytes were read and written in total, 0 disables.
+	ResetAfterBytes int64
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if d.Latency > 0 {
+		timer := time.NewTimer(d.Latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if d.FailDials.Add(-1) >= 0 {
+		return nil, ErrInjectedDial
+	}
+	d.FailDials.Store(0)
+	upstream := d.Upstream
+	if upstream == nil {
+		upstream = N.SystemDialer
+	}
+	conn, err := upstream.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	if d.ResetAfterBytes <= 0 {
+		return conn, nil
+	}
+	return &faultConn{Conn: conn, remaining: d.ResetAfterBytes}, nil
+}
+
+func (d *Dialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	upstream := d.Upstream
+	if upstream == nil {
+		upstream = N.SystemDialer
+	}
+	return upstream.ListenPacket(ctx, destination)
+}
+
+type faultConn struct {
+	net.Conn
+	remaining int64
+	reset     atomic.Bool
+}
+
+func (c *faultConn) Read(p []byte) (n int, err error) {
+	p, err = c.limit(p)
+	if err != nil {
+		return
+	}
+	n, err = c.Conn.Read(p)
+	c.consume(n)
+	return
+}
+
+func (c *faultConn) Write(p []byte) (n int, err error) {
+	limited, err := c.limit(p)
+	if err != nil {
+		return
+	}
+	n, err = c.Conn.Write(limited)
+	c.consume(n)
+	if err == nil && n < len(p) {
+		err = c.resetConn()
+	}
+	return
+}
+
+func (c *faultConn) limit(p []byte) ([]byte, error) {
+	remaining := atomic.LoadInt64(&c.remaining)
+	if remaining <= 0 {
+		return nil, c.resetConn()
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	return p, nil
+}
+
+func (c *faultConn) consume(n int) {
+	if atomic.AddInt64(&c.remaining, -int64(n)) <= 0 {
+		c.resetConn()
+	}
+}
+
+func (c *faultConn) resetConn() error {
+	if c.reset.CompareAndSwap(false, true) {
+		if tcpConn, isTCP := c.Conn.(*net.TCPConn); isTCP {
+			tcpConn.SetLinger(0)
+		}
+		c.Conn.Close()
+	}
+	return ErrInjectedReset
+}
+
+func (c *faultConn) Upstream() any {
+	return c.Conn
+}
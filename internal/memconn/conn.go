@@ -0,0 +1,233 @@
+// Package memconn provides buffered in-memory connections with deadlines and half-close for testing.
+package memconn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "memconn"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// Pipe returns the two ends of a connection. Unlike net.Pipe, writes are buffered
+// and complete without a matching read, and CloseWrite half-closes the connection.
+func Pipe() (net.Conn, net.Conn) {
+	return pipe(pipeAddr("client"), pipeAddr("server"))
+}
+
+func pipe(clientAddr net.Addr, serverAddr net.Addr) (*Conn, *Conn) {
+	clientToServer := newBuffer()
+	serverToClient := newBuffer()
+	client := &Conn{
+		read:          serverToClient,
+		write:         clientToServer,
+		localAddr:     clientAddr,
+		remoteAddr:    serverAddr,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	server := &Conn{
+		read:          clientToServer,
+		write:         serverToClient,
+		localAddr:     serverAddr,
+		remoteAddr:    clientAddr,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	return client, server
+}
+
+type buffer struct {
+	access     sync.Mutex
+	data       []byte
+	writeEOF   bool // the writer closed, reads return io.EOF once data is drained
+	readClosed bool // the reader closed, writes fail
+	notify     chan struct{}
+}
+
+func newBuffer() *buffer {
+	return &buffer{notify: make(chan struct{}, 1)}
+}
+
+func (b *buffer) signal() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+type Conn struct {
+	read          *buffer
+	write         *buffer
+	localAddr     net.Addr
+	remoteAddr    net.Addr
+	readDeadline  *deadline
+	writeDeadline *deadline
+	closed        atomic.Bool
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	for {
+		if c.closed.Load() {
+			return 0, net.ErrClosed
+		}
+		if c.readDeadline.exceeded() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.read.access.Lock()
+		if len(c.read.data) > 0 {
+			n = copy(p, c.read.data)
+			c.read.data = c.read.data[n:]
+			c.read.access.Unlock()
+			return
+		}
+		writeEOF := c.read.writeEOF
+		c.read.access.Unlock()
+		if writeEOF {
+			return 0, io.EOF
+		}
+		select {
+		case <-c.read.notify:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if c.writeDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.write.access.Lock()
+	defer c.write.access.Unlock()
+	if c.write.writeEOF || c.write.readClosed {
+		return 0, io.ErrClosedPipe
+	}
+	c.write.data = append(c.write.data, p...)
+	c.write.signal()
+	return len(p), nil
+}
+
+// CloseWrite makes the peer read io.EOF once it drained the data written so far.
+func (c *Conn) CloseWrite() error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	c.write.access.Lock()
+	c.write.writeEOF = true
+	c.write.signal()
+	c.write.access.Unlock()
+	return nil
+}
+
+func (c *Conn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	c.write.access.Lock()
+	c.write.writeEOF = true
+	c.write.signal()
+	c.write.access.Unlock()
+	c.read.access.Lock()
+	c.read.readClosed = true
+	c.read.data = nil
+	c.read.signal()
+	c.read.access.Unlock()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline works like the one of net.Pipe, cancel is closed once the deadline passed.
+type deadline struct {
+	access sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.access.Lock()
+	defer d.access.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if duration := time.Until(t); duration > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(duration, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.access.Lock()
+	defer d.access.Unlock()
+	return d.cancel
+}
+
+func (d *deadline) exceeded() bool {
+	return isClosed(d.wait())
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+package memconn
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// Listener is a net.Listener whose connections are created by its DialContext,
+// so it also serves as the N.Dialer of the other side.
+type Listener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr("server")
+}
+
+// DialContext blocks until the connection is accepted, destination is only used as the remote address.
+func (l *Listener) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	client, server := pipe(pipeAddr("client"), pipeAddr(destination.String()))
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Listener) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, os.ErrInvalid
+}
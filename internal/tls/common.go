@@ -786,6 +786,10 @@ type Config struct {
 
 	SessionIDGenerator func(clientHello []byte, sessionID []byte) error
 
+	// GREASE makes clients advertise reserved values of RFC 8701 in the
+	// cipher suites, extensions, supported groups, key shares and supported versions.
+	GREASE bool
+
 	// EncryptedClientHelloConfigList is a serialized ECHConfigList. If
 	// provided, clients will attempt to connect to servers using Encrypted
 	// Client Hello (ECH) using one of the provided ECHConfigs. Servers
@@ -908,6 +912,7 @@ func (c *Config) Clone() *Config {
 		DynamicRecordSizingDisabled:         c.DynamicRecordSizingDisabled,
 		Renegotiation:                       c.Renegotiation,
 		KeyLogWriter:                        c.KeyLogWriter,
+		GREASE:                              c.GREASE,
 		EncryptedClientHelloConfigList:      c.EncryptedClientHelloConfigList,
 		EncryptedClientHelloRejectionVerify: c.EncryptedClientHelloRejectionVerify,
 		sessionTicketKeys:                   c.sessionTicketKeys,
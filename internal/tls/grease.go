@@ -0,0 +1,40 @@
+package tls
+
+import (
+	"errors"
+	"io"
+)
+
+// greaseValues are the reserved values of RFC 8701 a client hello advertises
+// like Chrome, one for each place, the two extensions always differ.
+type greaseValues struct {
+	cipherSuite    uint16
+	firstExtension uint16
+	lastExtension  uint16
+	group          uint16
+	version        uint16
+}
+
+func newGREASEValues(rand io.Reader) (*greaseValues, error) {
+	var seed [5]byte
+	_, err := io.ReadFull(rand, seed[:])
+	if err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	values := &greaseValues{
+		cipherSuite:    greaseValue(seed[0]),
+		firstExtension: greaseValue(seed[1]),
+		lastExtension:  greaseValue(seed[2]),
+		group:          greaseValue(seed[3]),
+		version:        greaseValue(seed[4]),
+	}
+	if values.lastExtension == values.firstExtension {
+		values.lastExtension ^= 0x1010
+	}
+	return values, nil
+}
+
+func greaseValue(seed byte) uint16 {
+	value := uint16(seed&0xf0) | 0x0a
+	return value<<8 | value
+}
@@ -115,6 +115,13 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, *keySharePrivateKeys, *echCon
 		return nil, nil, nil, errors.New("tls: short read from Rand: " + err.Error())
 	}
 
+	if config.GREASE {
+		hello.grease, err = newGREASEValues(config.rand())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
 	if maxVersion >= VersionTLS12 {
 		hello.supportedSignatureAlgorithms = supportedSignatureAlgorithms()
 	}
@@ -97,10 +97,15 @@ type clientHelloMsg struct {
 	pskBinders                       [][]byte
 	quicTransportParameters          []byte
 	encryptedClientHello             []byte
+	grease                           *greaseValues
 }
 
 func (m *clientHelloMsg) marshalMsg(echInner bool) ([]byte, error) {
 	var exts cryptobyte.Builder
+	if m.grease != nil && !echInner {
+		exts.AddUint16(m.grease.firstExtension)
+		exts.AddUint16(0) // empty extension_data
+	}
 	if len(m.serverName) > 0 {
 		// RFC 6066, Section 3
 		exts.AddUint16(extensionServerName)
@@ -192,6 +197,9 @@ func (m *clientHelloMsg) marshalMsg(echInner bool) ([]byte, error) {
 			exts.AddUint16(extensionSupportedCurves)
 			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
 				exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+					if m.grease != nil {
+						exts.AddUint16(m.grease.group)
+					}
 					for _, curve := range m.supportedCurves {
 						exts.AddUint16(uint16(curve))
 					}
@@ -254,6 +262,9 @@ func (m *clientHelloMsg) marshalMsg(echInner bool) ([]byte, error) {
 			exts.AddUint16(extensionSupportedVersions)
 			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
 				exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+					if m.grease != nil {
+						exts.AddUint16(m.grease.version)
+					}
 					for _, vers := range m.supportedVersions {
 						exts.AddUint16(vers)
 					}
@@ -282,6 +293,12 @@ func (m *clientHelloMsg) marshalMsg(echInner bool) ([]byte, error) {
 			exts.AddUint16(extensionKeyShare)
 			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
 				exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+					if m.grease != nil {
+						exts.AddUint16(m.grease.group)
+						exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+							exts.AddUint8(0)
+						})
+					}
 					for _, ks := range m.keyShares {
 						exts.AddUint16(uint16(ks.group))
 						exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
@@ -315,6 +332,12 @@ func (m *clientHelloMsg) marshalMsg(echInner bool) ([]byte, error) {
 			})
 		})
 	}
+	if m.grease != nil && !echInner {
+		exts.AddUint16(m.grease.lastExtension)
+		exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+			exts.AddUint8(0)
+		})
+	}
 	if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
 		// RFC 8446, Section 4.2.11
 		exts.AddUint16(extensionPreSharedKey)
@@ -352,6 +375,9 @@ func (m *clientHelloMsg) marshalMsg(echInner bool) ([]byte, error) {
 			}
 		})
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if m.grease != nil {
+				b.AddUint16(m.grease.cipherSuite)
+			}
 			for _, suite := range m.cipherSuites {
 				b.AddUint16(suite)
 			}
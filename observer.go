@@ -0,0 +1,145 @@
+package shadowtls
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+type FallbackReason uint8
+
+const (
+	FallbackReasonHMACMismatch FallbackReason = iota + 1
+	FallbackReasonUnexpectedRecordType
+	FallbackReasonShortFrame
+	FallbackReasonNotTLS13
+	FallbackReasonServerRandomMissing
+	FallbackReasonHandshakeServerError
+	FallbackReasonSourceNotAllowed
+	FallbackReasonReplay
+)
+
+func (r FallbackReason) String() string {
+	switch r {
+	case FallbackReasonHMACMismatch:
+		return "hmac mismatch"
+	case FallbackReasonUnexpectedRecordType:
+		return "unexpected record type"
+	case FallbackReasonShortFrame:
+		return "short frame"
+	case FallbackReasonNotTLS13:
+		return "TLS 1.3 not supported"
+	case FallbackReasonServerRandomMissing:
+		return "server random missing"
+	case FallbackReasonHandshakeServerError:
+		return "handshake server error"
+	case FallbackReasonSourceNotAllowed:
+		return "source not allowed"
+	case FallbackReasonReplay:
+		return "client hello replayed"
+	default:
+		return "unknown(" + strconv.Itoa(int(r)) + ")"
+	}
+}
+
+type Observer interface {
+	ProbeFallback(ctx context.Context, reason FallbackReason)
+}
+
+// ClientHelloObserver may be implemented by an Observer to inspect every v2 and v3 ClientHello,
+// the fingerprint is only computed for observers that implement it.
+type ClientHelloObserver interface {
+	InspectClientHello(ctx context.Context, fingerprint *ClientHelloFingerprint)
+}
+
+func fallbackReasonFromError(err error) FallbackReason {
+	switch err {
+	case io.ErrUnexpectedEOF:
+		return FallbackReasonShortFrame
+	case errHMACMismatch:
+		return FallbackReasonHMACMismatch
+	case errClientHelloReplayed:
+		return FallbackReasonReplay
+	default:
+		return FallbackReasonUnexpectedRecordType
+	}
+}
+
+// DataObserver may be implemented by an Observer to learn about v3 data records failing verification,
+// which closes the connection and points to corruption, tampering or a broken middlebox.
+type DataObserver interface {
+	DataVerificationFailed(ctx context.Context, connectionID string)
+}
+
+// HandshakeObserver may be implemented by an Observer to learn about every successful handshake.
+// The byte counts are the records relayed from the client and the handshake server before the data phase,
+// an unusually large count may come from a probe trying to exhaust resources.
+// cipherSuite is the one the handshake server selected in its ServerHello, only read for protocol version 3, 0 otherwise.
+type HandshakeObserver interface {
+	HandshakeSucceeded(ctx context.Context, version int, clientBytes int64, serverBytes int64, cipherSuite uint16)
+}
+
+func (s *Service) handshakeSucceeded(ctx context.Context, version int, clientBytes int64, serverBytes int64, cipherSuite uint16) {
+	s.stats.handshakes[version].Add(1)
+	if handshakeObserver, isHandshakeObserver := s.observer.(HandshakeObserver); isHandshakeObserver {
+		handshakeObserver.HandshakeSucceeded(ctx, version, clientBytes, serverBytes, cipherSuite)
+	}
+}
+
+// DowngradeObserver may be implemented by an Observer to learn about connections closed by RequireTLS13.
+type DowngradeObserver interface {
+	TLS13Downgraded(ctx context.Context)
+}
+
+var ErrTLS13Downgrade = E.New("handshake server did not negotiate TLS 1.3, possibly a downgrade")
+
+func (s *Service) tls13Downgrade(ctx context.Context) {
+	if downgradeObserver, isDowngradeObserver := s.observer.(DowngradeObserver); isDowngradeObserver {
+		downgradeObserver.TLS13Downgraded(ctx)
+	}
+}
+
+func (s *Service) dataVerificationFailed(ctx context.Context) {
+	s.stats.dataVerificationFailures.Add(1)
+	if dataObserver, isDataObserver := s.observer.(DataObserver); isDataObserver {
+		connectionID, _ := ConnectionIDFromContext(ctx)
+		dataObserver.DataVerificationFailed(ctx, connectionID)
+	}
+}
+
+func (s *Service) inspectClientHello(ctx context.Context, frame []byte) {
+	helloObserver, isHelloObserver := s.observer.(ClientHelloObserver)
+	if !isHelloObserver {
+		return
+	}
+	fingerprint, err := newClientHelloFingerprint(frame)
+	if err != nil {
+		s.logger.DebugContext(ctx, E.Cause(err, "fingerprint client hello"))
+		return
+	}
+	helloObserver.InspectClientHello(ctx, fingerprint)
+}
+
+const notTLS13WarningInterval = time.Minute
+
+// warnNotTLS13 reports a handshake server without TLS 1.3 at most once per minute,
+// since every strict mode connection to it falls back and ShadowTLS no longer protects anything.
+func (s *Service) warnNotTLS13(ctx context.Context) {
+	now := s.features.Clock.Now().UnixNano()
+	last := s.lastNotTLS13Warning.Load()
+	if last != 0 && time.Duration(now-last) < notTLS13WarningInterval || !s.lastNotTLS13Warning.CompareAndSwap(last, now) {
+		s.logger.DebugContext(ctx, "TLS 1.3 is not supported, will copy bidirectional")
+		return
+	}
+	s.logger.WarnContext(ctx, "handshake server does not support TLS 1.3; ShadowTLS v3 is disabled for these connections, which are relayed to the handshake server. Fix the handshake server or disable strict mode")
+}
+
+func (s *Service) probeFallback(ctx context.Context, reason FallbackReason) {
+	s.stats.fallbacks.Add(1)
+	if s.observer != nil {
+		s.observer.ProbeFallback(ctx, reason)
+	}
+}
@@ -0,0 +1,80 @@
+package shadowtls
+
+import (
+	"math"
+	"unicode"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// DefaultMinPasswordEntropy is the estimated entropy in bits required by ValidatePasswordStrength.
+const DefaultMinPasswordEntropy = 64
+
+var ErrWeakPassword = E.New("weak password")
+
+// ValidatePasswordStrength rejects passwords below DefaultMinPasswordEntropy.
+// The password keys the v3 HMAC, so a weak one allows offline guessing from a captured handshake.
+func ValidatePasswordStrength(password string) error {
+	return validatePasswordEntropy(password, DefaultMinPasswordEntropy)
+}
+
+func validatePasswordEntropy(password string, minEntropy int) error {
+	entropy := passwordEntropy(password)
+	if entropy < float64(minEntropy) {
+		return E.Cause(ErrWeakPassword, "estimated ", int(entropy), " bits, ", minEntropy, " required")
+	}
+	return nil
+}
+
+// passwordEntropy estimates the entropy in bits from the character classes used, it is an upper bound
+// for passwords that are not random. A character repeating the previous one or continuing a sequence
+// like "abc" or "321" adds nothing, and the estimate is capped by the number of distinct characters,
+// so that patterns like "aaaa" or "abab" do not pass by their length.
+func passwordEntropy(password string) float64 {
+	var hasLower, hasUpper, hasDigit, hasOther bool
+	distinct := make(map[rune]bool)
+	for _, r := range password {
+		distinct[r] = true
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+	var charset int
+	if hasLower {
+		charset += 26
+	}
+	if hasUpper {
+		charset += 26
+	}
+	if hasDigit {
+		charset += 10
+	}
+	if hasOther {
+		charset += 33
+	}
+	if charset == 0 {
+		return 0
+	}
+	charBits := math.Log2(float64(charset))
+	var entropy float64
+	var previous, previousStep rune
+	for i, r := range []rune(password) {
+		step := r - previous
+		predictable := i > 0 && (step == 0 || (step == 1 || step == -1) && step == previousStep)
+		if !predictable {
+			entropy += charBits
+		}
+		previous, previousStep = r, step
+	}
+	if limit := float64(len(distinct)) * charBits; entropy > limit {
+		entropy = limit
+	}
+	return entropy
+}
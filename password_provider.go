@@ -0,0 +1,84 @@
+package shadowtls
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+)
+
+const DefaultPasswordTTL = 5 * time.Minute
+
+// PasswordProvider supplies the users of protocol version 3, e.g. from a secret store,
+// so that passwords can be rotated without restarting the service.
+type PasswordProvider interface {
+	Passwords(ctx context.Context) ([]User, error)
+}
+
+// userCache serves the last users returned by the provider and refreshes them in the background
+// once they are older than ttl. A failed refresh keeps the users, which are retried after ttl.
+type userCache struct {
+	provider   PasswordProvider
+	ttl        time.Duration
+	minEntropy int
+	clock      Clock
+	logger     logger.ContextLogger
+	users      atomic.Pointer[[]User]
+	expiresAt  atomic.Int64
+	refreshing atomic.Bool
+}
+
+func newUserCache(provider PasswordProvider, ttl time.Duration, minEntropy int, clock Clock, logger logger.ContextLogger, initial []User) *userCache {
+	if ttl <= 0 {
+		ttl = DefaultPasswordTTL
+	}
+	cache := &userCache{
+		provider:   provider,
+		ttl:        ttl,
+		minEntropy: minEntropy,
+		clock:      clock,
+		logger:     logger,
+	}
+	cache.users.Store(&initial)
+	return cache
+}
+
+// load returns the cached users without waiting for a refresh.
+func (c *userCache) load() []User {
+	if c.clock.Now().UnixNano() >= c.expiresAt.Load() && c.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer c.refreshing.Store(false)
+			err := c.refresh(context.Background())
+			if err != nil {
+				c.logger.Error(E.Cause(err, "refresh passwords"))
+			}
+		}()
+	}
+	return *c.users.Load()
+}
+
+func (c *userCache) refresh(ctx context.Context) error {
+	c.expiresAt.Store(c.clock.Now().Add(c.ttl).UnixNano())
+	users, err := c.provider.Passwords(ctx)
+	if err != nil {
+		return err
+	}
+	if c.minEntropy > 0 {
+		accepted := make([]User, 0, len(users))
+		for _, user := range users {
+			if validatePasswordEntropy(user.Password, c.minEntropy) != nil {
+				c.logger.Warn("ignore weak password for user ", user.Name)
+				continue
+			}
+			accepted = append(accepted, user)
+		}
+		users = accepted
+	}
+	if len(users) == 0 {
+		return E.New("provider returned no users")
+	}
+	c.users.Store(&users)
+	return nil
+}
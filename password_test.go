@@ -0,0 +1,36 @@
+package shadowtls
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidatePasswordStrength(t *testing.T) {
+	for _, password := range []string{
+		"",
+		"password",
+		strings.Repeat("a", 64),
+		strings.Repeat("ab", 32),
+		strings.Repeat("Aa1!", 16),
+		"abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz",
+		"12345678901234567890123456789012345678901234567890",
+		"zyxwvutsrqponmlkjihgfedcbazyxwvutsrqponmlkjihgfedcba",
+	} {
+		err := ValidatePasswordStrength(password)
+		if !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("%q accepted with %.0f bits", password, passwordEntropy(password))
+		}
+	}
+	for _, password := range []string{
+		testPassword,
+		"Xk9#mQ2$vL7@pR4!",
+		"correct-horse-battery-staple-Mz7",
+		"q3Jv8Lr0Zt5Wn2Hx",
+	} {
+		err := ValidatePasswordStrength(password)
+		if err != nil {
+			t.Errorf("%q rejected: %v", password, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package shadowtls
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"strconv"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var proxyProtocolV2Signature = [12]byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// writeProxyProtocolHeader writes a PROXY protocol header of the given version,
+// addresses that are not both IP are sent as UNKNOWN in version 1 and LOCAL in version 2.
+func writeProxyProtocolHeader(writer io.Writer, version int, source M.Socksaddr, destination M.Socksaddr) error {
+	source, destination = source.Unwrap(), destination.Unwrap()
+	isIP := source.IsIP() && destination.IsIP()
+	sourceAddr, destinationAddr := source.Addr, destination.Addr
+	if isIP && sourceAddr.Is4() != destinationAddr.Is4() {
+		sourceAddr, destinationAddr = netip.AddrFrom16(sourceAddr.As16()), netip.AddrFrom16(destinationAddr.As16())
+	}
+	var header []byte
+	switch version {
+	case 1:
+		if !isIP {
+			header = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		family := "TCP4"
+		if !sourceAddr.Is4() {
+			family = "TCP6"
+		}
+		header = []byte("PROXY " + family + " " + sourceAddr.String() + " " + destinationAddr.String() + " " +
+			strconv.Itoa(int(source.Port)) + " " + strconv.Itoa(int(destination.Port)) + "\r\n")
+	case 2:
+		header = append(header, proxyProtocolV2Signature[:]...)
+		if !isIP {
+			header = append(header, 0x20, 0x00, 0, 0)
+			break
+		}
+		if sourceAddr.Is4() {
+			header = append(header, 0x21, 0x11, 0, 12)
+		} else {
+			header = append(header, 0x21, 0x21, 0, 36)
+		}
+		header = append(header, sourceAddr.AsSlice()...)
+		header = append(header, destinationAddr.AsSlice()...)
+		header = binary.BigEndian.AppendUint16(header, source.Port)
+		header = binary.BigEndian.AppendUint16(header, destination.Port)
+	default:
+		return E.New("unknown PROXY protocol version: ", version)
+	}
+	_, err := writer.Write(header)
+	return err
+}
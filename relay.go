@@ -0,0 +1,32 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// RelayHandler returns a Handler that dials metadata.Destination with dialer
+// and copies data in both directions until either side is closed.
+func RelayHandler(dialer N.Dialer) Handler {
+	return &relayHandler{dialer: dialer}
+}
+
+type relayHandler struct {
+	dialer N.Dialer
+}
+
+func (h *relayHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	destination, err := h.dialer.DialContext(ctx, N.NetworkTCP, metadata.Destination)
+	if err != nil {
+		return E.Cause(err, "dial upstream")
+	}
+	return bufio.CopyConn(ctx, conn, destination)
+}
+
+func (h *relayHandler) NewError(ctx context.Context, err error) {
+}
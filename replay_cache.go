@@ -0,0 +1,68 @@
+package shadowtls
+
+import (
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const DefaultReplayWindow = 2 * time.Minute
+
+var errClientHelloReplayed = E.New("client hello replayed")
+
+// replayCache remembers the session ids of authenticated ClientHellos. The session id carries the HMAC and
+// 28 random bytes, so unlike the HMAC alone, two genuine clients practically never collide.
+// The ring bounds the memory, once it is full the oldest entry is forgotten before its window ends.
+type replayCache struct {
+	clock  Clock
+	window time.Duration
+	access sync.Mutex
+	seen   map[[tlsSessionIDSize]byte]time.Time
+	ring   [][tlsSessionIDSize]byte
+	next   int
+}
+
+func newReplayCache(clock Clock, size int, window time.Duration) *replayCache {
+	if size <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	return &replayCache{
+		clock:  clock,
+		window: window,
+		seen:   make(map[[tlsSessionIDSize]byte]time.Time, size),
+		ring:   make([][tlsSessionIDSize]byte, 0, size),
+	}
+}
+
+// add records the session id of an authenticated ClientHello and reports whether it was not seen within the window.
+func (c *replayCache) add(clientHello []byte) bool {
+	sessionIDStart := sessionIDLengthIndex + 1
+	if len(clientHello) < sessionIDStart+tlsSessionIDSize {
+		return true
+	}
+	var key [tlsSessionIDSize]byte
+	copy(key[:], clientHello[sessionIDStart:])
+	now := c.clock.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+	if seenAt, loaded := c.seen[key]; loaded && now.Sub(seenAt) < c.window {
+		return false
+	} else if loaded {
+		// expired, the ring still holds the key and removes it from seen when overwritten
+		c.seen[key] = now
+		return true
+	}
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, key)
+	} else {
+		delete(c.seen, c.ring[c.next])
+		c.ring[c.next] = key
+		c.next = (c.next + 1) % len(c.ring)
+	}
+	c.seen[key] = now
+	return true
+}
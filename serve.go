@@ -0,0 +1,113 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// Serve accepts connections on listener and serves each in its own goroutine until ctx is done
+// or the service is closed, both return nil. Temporary accept errors are retried with a backoff
+// like net/http does. Errors of a connection are reported to the Handler.
+func (s *Service) Serve(ctx context.Context, listener net.Listener) error {
+	if s.handler == nil {
+		return os.ErrInvalid
+	}
+	s.access.Lock()
+	if s.closed {
+		s.access.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	s.access.Unlock()
+	defer s.removeListener(listener)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-done:
+		}
+	}()
+	var tempDelay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || s.isClosed() {
+				return nil
+			}
+			if temporaryErr, isTemporary := err.(interface{ Temporary() bool }); isTemporary && temporaryErr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = minAcceptDelay
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				s.logger.WarnContext(ctx, E.Cause(err, "accept, retrying in ", tempDelay))
+				timer := s.features.Clock.NewTimer(tempDelay)
+				select {
+				case <-timer.C():
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				}
+				continue
+			}
+			return E.Cause(err, "accept")
+		}
+		tempDelay = 0
+		go s.serveConnection(ctx, conn)
+	}
+}
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+func (s *Service) removeListener(listener net.Listener) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	for i, current := range s.listeners {
+		if current == listener {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Service) serveConnection(ctx context.Context, conn net.Conn) {
+	err := s.NewConnection(ctx, conn, M.Metadata{
+		Source: M.SocksaddrFromNet(conn.RemoteAddr()),
+	})
+	conn.Close()
+	if err != nil {
+		s.handler.NewError(ctx, err)
+	}
+}
+
+func (s *Service) isClosed() bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.closed
+}
+
+// Close closes the listeners passed to Serve, connections already accepted are not interrupted.
+func (s *Service) Close() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.closed = true
+	var errs []error
+	for _, listener := range s.listeners {
+		errs = append(errs, listener.Close())
+	}
+	s.listeners = nil
+	return E.Errors(errs...)
+}
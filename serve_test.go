@@ -0,0 +1,75 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary accept error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails the first accepts with a temporary error.
+type flakyListener struct {
+	*memconn.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServe(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	listener := &flakyListener{Listener: memconn.NewListener()}
+	listener.failures.Store(3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- service.Serve(ctx, listener)
+	}()
+
+	conn, err := listener.DialContext(ctx, "tcp", testHandshakeServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialCtx, dialCancel := context.WithTimeout(ctx, testDialTimeout)
+	defer dialCancel()
+	dataConn, err := newTestClient(t, ClientConfig{}).DialContextConn(dialCtx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, dataConn, []byte("ping"), false)
+	dataConn.Close()
+
+	cancel()
+	select {
+	case err = <-serveErr:
+		if err != nil {
+			t.Fatal("Serve returned ", err)
+		}
+	case <-time.After(testDialTimeout):
+		t.Fatal("Serve did not return on cancellation")
+	}
+	_, err = listener.Listener.Accept()
+	if err == nil {
+		t.Fatal("listener not closed")
+	}
+	service.access.Lock()
+	listeners := len(service.listeners)
+	service.access.Unlock()
+	if listeners != 0 {
+		t.Fatal("listener kept after Serve returned")
+	}
+}
@@ -4,9 +4,15 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/hex"
+	"io"
 	"net"
+	"net/netip"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/auth"
@@ -21,23 +27,82 @@ import (
 )
 
 type ServiceConfig struct {
-	Version                int
-	Password               string // for protocol version 2
-	Users                  []User // for protocol version 3
+	Version                int    // 0 for auto detection between version 2 and 3
+	Password               string // for protocol version 2, a user without name tried before Users
+	Users                  []User // for protocol version 2/3, v2 hashes the server flight once per user
+	MinPasswordEntropy     int    // rejects passwords with a lower estimated entropy in bits, 0 disables the check
 	Handshake              HandshakeConfig
-	HandshakeForServerName map[string]HandshakeConfig // for protocol version 2/3
+	HandshakeForServerName map[string]HandshakeConfig // for protocol version 2/3, the empty name matches clients without SNI
+	HandshakeBindInterface string                     // binds the handshake dialers left nil to this interface
+	HandshakeTargets       []HandshakeTarget          // replaces Handshake if set, failed targets are skipped for a while
 	StrictMode             bool                       // for protocol version 3
-	Handler                Handler
+	LegacyTLS12            bool                       // for protocol version 3, see Features
+	Pacing                 Pacing                     // for protocol version 3
+	RecordVersion          [2]byte                    // for protocol version 3, must match the client
+	FrameTransport         FrameTransport             // for protocol version 3, must match the client
+	IdleTimeout            time.Duration              // for protocol version 3
+	MaxRecordSize          int                        // for protocol version 3, see Features
+	KeepAliveInterval      time.Duration              // for protocol version 3, see Features
+	Compression            bool                       // for protocol version 3, see Features
+	WriteChunkSize         int                        // for protocol version 3, see Features
+	SampleInterval         time.Duration              // for protocol version 3, see Features
+	MaxRecordRate          int                        // for protocol version 3, see Features
+	RequireTLS13           *bool                      // for protocol version 3, true if nil, see Features
+	RekeyBytes             int64                      // for protocol version 3, see Features
+	ReuseReadBuffer        bool                       // for protocol version 3, see Features
+	ManualReadDeadline     bool                       // for protocol version 3, see Features
+	Padding                Padding                    // for protocol version 3, must match the client, see Padding
+	FirstFrameTimeout      time.Duration              // for protocol version 3, drops clients that send no authenticated record in time
+	PasswordProvider       PasswordProvider           // for protocol version 2/3, replaces Users and is consulted again every PasswordTTL
+	PasswordTTL            time.Duration              // DefaultPasswordTTL if not positive
+	// HandshakeServerMapper picks the handshake server for the SNI of a client not found in HandshakeForServerName,
+	// for protocol version 2/3. Clients without SNI and results with an invalid address use the default, results
+	// with a nil dialer too unless HandshakePool is set, which replaces the dialer returned by the mapper.
+	HandshakeServerMapper  func(ctx context.Context, serverName string) (M.Socksaddr, N.Dialer)
+	PermitConnection       func(ctx context.Context, user *User, serverName string) error
+	PermitBeforeRelay      bool        // for protocol version 3, see ErrPermitFallback
+	DecoyServer            *tls.Config // for protocol version 3
+	ProbeAlert             *ProbeAlert // for protocol version 3, takes precedence over DecoyServer
+	MaxHandshakeBytes      int
+	MaxClientHelloSize     int            // for protocol version 2/3, DefaultMaxClientHelloSize if not positive
+	HandshakeReadSize      int            // for protocol version 3, reads ahead up to this size during the handshake relay
+	HandshakePool          *HandshakePool // replaces the handshake dialers if set, may be shared between services
+	HandshakeProxyProtocol int            // PROXY protocol header version sent to handshake servers, 1 or 2, 0 disables
+	HandshakeLinger        time.Duration  // for protocol version 3, half-closes the handshake connection and closes it after this delay
+	HandshakeTimeout       time.Duration  // closes clients that do not finish the handshake in time, 0 for no limit
+	ReplayCacheSize        int            // for protocol version 3, remembered ClientHellos, a replay is relayed like a probe, 0 disables
+	ReplayWindow           time.Duration  // for protocol version 3, DefaultReplayWindow if not positive
+	LogCipherSuite         bool           // for protocol version 3, logs the cipher suite selected by the handshake server at info level
+	AllowedSources         []netip.Prefix // clients from other addresses are relayed to the handshake server without authentication, empty allows all
+	Observer               Observer
+	Handler                Handler // required unless only Accept is used
 	Logger                 logger.ContextLogger
 }
 
 type User struct {
 	Name     string
 	Password string
+	Tag      string // passed to the Handler in the context of authenticated v3 connections, see UserTagFromContext
+}
+
+type userTagKey struct{}
+
+func ContextWithUserTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, userTagKey{}, tag)
+}
+
+func UserTagFromContext(ctx context.Context) (string, bool) {
+	tag, loaded := ctx.Value(userTagKey{}).(string)
+	return tag, loaded
 }
 
 type HandshakeConfig struct {
 	Server M.Socksaddr
+	// Dialer is provided by the caller. On multi-homed servers it should egress from the listener's address,
+	// since a handshake from another address than the data is a fingerprint, see HandshakeBindInterface.
+	// Dialer may return a connection that is itself wrapped in an outer TLS session, e.g. to reach
+	// the handshake server through a CDN. Records are relayed over the plaintext of that session,
+	// so the client sees the handshake of the inner server and the outer layer is never exposed.
 	Dialer N.Dialer
 }
 
@@ -50,34 +115,176 @@ type Service struct {
 	version                int
 	password               string
 	users                  []User
+	userCache              *userCache
 	handshake              HandshakeConfig
 	handshakeForServerName map[string]HandshakeConfig
-	strictMode             bool
+	handshakeServerMapper  func(ctx context.Context, serverName string) (M.Socksaddr, N.Dialer)
+	handshakeTargets       *handshakeTargets
+	handshakeBindDialer    N.Dialer
+	features               Features
+	permitConnection       func(ctx context.Context, user *User, serverName string) error
+	permitBeforeRelay      bool
+	allowedSources         []netip.Prefix
+	decoyServer            *tls.Config
+	probeAlert             *ProbeAlert
+	firstFrameTimeout      time.Duration
+	maxHandshakeBytes      int
+	maxClientHelloSize     int
+	handshakeReadSize      int
+	handshakePool          *HandshakePool
+	handshakeProxyProtocol int
+	handshakeLinger        time.Duration
+	handshakeTimeout       time.Duration
+	replayCache            *replayCache
+	logCipherSuite         bool
+	observer               Observer
 	handler                Handler
 	logger                 logger.ContextLogger
+	stats                  serviceStats
+	lastNotTLS13Warning    atomic.Int64
+	access                 sync.Mutex
+	listeners              []net.Listener
+	closed                 bool
 }
 
 func NewService(config ServiceConfig) (*Service, error) {
+	return NewServiceWithOptions(config)
+}
+
+// NewServiceWithOptions creates a Service, options are applied on top of the features set in config.
+func NewServiceWithOptions(config ServiceConfig, options ...Option) (*Service, error) {
 	service := &Service{
 		version:                config.Version,
 		password:               config.Password,
 		users:                  config.Users,
 		handshake:              config.Handshake,
 		handshakeForServerName: config.HandshakeForServerName,
-		strictMode:             config.StrictMode,
+		handshakeServerMapper:  config.HandshakeServerMapper,
+		features: newFeatures(Features{
+			StrictMode:         config.StrictMode,
+			LegacyTLS12:        config.LegacyTLS12,
+			Pacing:             config.Pacing,
+			RecordVersion:      config.RecordVersion,
+			FrameTransport:     config.FrameTransport,
+			IdleTimeout:        config.IdleTimeout,
+			MaxRecordSize:      config.MaxRecordSize,
+			KeepAliveInterval:  config.KeepAliveInterval,
+			Compression:        config.Compression,
+			WriteChunkSize:     config.WriteChunkSize,
+			SampleInterval:     config.SampleInterval,
+			MaxRecordRate:      config.MaxRecordRate,
+			RequireTLS13:       requireTLS13(config.RequireTLS13),
+			RekeyBytes:         config.RekeyBytes,
+			ReuseReadBuffer:    config.ReuseReadBuffer,
+			ManualReadDeadline: config.ManualReadDeadline,
+			Padding:            config.Padding,
+		}, options),
+		permitConnection:       config.PermitConnection,
+		permitBeforeRelay:      config.PermitBeforeRelay,
+		allowedSources:         config.AllowedSources,
+		decoyServer:            config.DecoyServer,
+		probeAlert:             config.ProbeAlert,
+		firstFrameTimeout:      config.FirstFrameTimeout,
+		maxHandshakeBytes:      config.MaxHandshakeBytes,
+		maxClientHelloSize:     config.MaxClientHelloSize,
+		handshakeReadSize:      config.HandshakeReadSize,
+		handshakePool:          config.HandshakePool,
+		handshakeProxyProtocol: config.HandshakeProxyProtocol,
+		handshakeLinger:        config.HandshakeLinger,
+		handshakeTimeout:       config.HandshakeTimeout,
+		logCipherSuite:         config.LogCipherSuite,
+		observer:               config.Observer,
 		handler:                config.Handler,
 		logger:                 config.Logger,
 	}
+	service.handshakeTargets = newHandshakeTargets(service.features.Clock, config.HandshakeTargets)
+	if config.HandshakeBindInterface != "" {
+		err := service.bindHandshakeDialers(config.HandshakeBindInterface)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if !service.handshake.Server.IsValid() {
+	service.replayCache = newReplayCache(service.features.Clock, config.ReplayCacheSize, config.ReplayWindow)
+	if service.maxClientHelloSize <= 0 {
+		service.maxClientHelloSize = DefaultMaxClientHelloSize
+	}
+	if service.handshakeTargets != nil {
+		for _, target := range service.handshakeTargets.targets {
+			if !target.Server.IsValid() {
+				return nil, E.New("missing handshake target server")
+			}
+			err := service.checkHandshake(target.HandshakeConfig)
+			if err != nil {
+				return nil, E.Cause(err, "handshake target")
+			}
+		}
+	} else if !service.handshake.Server.IsValid() {
 		return nil, E.New("missing default handshake information")
 	}
+	var err error
+	if service.handshake.Server.IsValid() {
+		err = service.checkHandshake(service.handshake)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, prefix := range service.allowedSources {
+		if !prefix.IsValid() {
+			return nil, E.New("invalid allowed source: ", prefix)
+		}
+	}
+	switch service.handshakeProxyProtocol {
+	case 0, 1, 2:
+	default:
+		return nil, E.New("unknown PROXY protocol version: ", service.handshakeProxyProtocol)
+	}
+	for serverName, handshake := range service.handshakeForServerName {
+		err = service.checkHandshake(handshake)
+		if err != nil {
+			return nil, E.Cause(err, "handshake for server name ", serverName)
+		}
+	}
 
-	if service.handler == nil || service.logger == nil {
+	if service.logger == nil {
 		return nil, os.ErrInvalid
 	}
+	if config.MinPasswordEntropy > 0 {
+		if service.password != "" {
+			err = validatePasswordEntropy(service.password, config.MinPasswordEntropy)
+			if err != nil {
+				return nil, E.Cause(err, "password")
+			}
+		}
+		for _, user := range service.users {
+			err = validatePasswordEntropy(user.Password, config.MinPasswordEntropy)
+			if err != nil {
+				return nil, E.Cause(err, "password for user ", user.Name)
+			}
+		}
+	}
+	if config.PasswordProvider != nil {
+		service.userCache = newUserCache(config.PasswordProvider, config.PasswordTTL, config.MinPasswordEntropy, service.features.Clock, service.logger, service.users)
+		err = service.userCache.refresh(context.Background())
+		if err != nil {
+			if len(service.users) == 0 {
+				return nil, E.Cause(err, "load passwords")
+			}
+			service.logger.Error(E.Cause(err, "load passwords, using the configured users"))
+		}
+		service.users = service.userCache.load()
+	}
 	switch config.Version {
-	case 1, 2:
+	case 0:
+		if len(service.users) == 0 && service.password == "" {
+			return nil, E.New("missing users or password")
+		}
+	case 1:
+	case 2:
+		// a service without password authenticates nobody and relays every client to the handshake server
+		if service.password == "" && len(service.users) == 0 {
+			return nil, E.New("missing password or users")
+		}
 	case 3:
 		if len(service.users) == 0 {
 			return nil, E.New("missing users")
@@ -89,164 +296,592 @@ func NewService(config ServiceConfig) (*Service, error) {
 	return service, nil
 }
 
-func (s *Service) selectHandshake(clientHelloFrame *buf.Buffer) HandshakeConfig {
+func (s *Service) loadUsers() []User {
+	if s.userCache != nil {
+		return s.userCache.load()
+	}
+	return s.users
+}
+
+// DefaultMaxClientHelloSize is the largest accepted ClientHello record length,
+// which covers ClientHellos with post-quantum key shares.
+const DefaultMaxClientHelloSize = maxRecordPayloadSize
+
+// extractClientHello rejects an oversized ClientHello record from its header,
+// before a probe can make the service hold the buffer while it dribbles the body.
+func (s *Service) extractClientHello(conn net.Conn) (*buf.Buffer, error) {
+	return extractFrameLimited(conn, s.maxClientHelloSize)
+}
+
+// checkHandshakeServer rejects link-local IPv6 handshake servers without a zone,
+// which would be dialed through whatever interface the system picks.
+func checkHandshakeServer(server M.Socksaddr) error {
+	if server.IsIP() && server.Addr.Is6() && (server.Addr.IsLinkLocalUnicast() || server.Addr.IsLinkLocalMulticast()) && server.Addr.Zone() == "" {
+		return E.New("missing zone for link-local handshake server: ", server)
+	}
+	return nil
+}
+
+// checkHandshake rejects a handshake server that can not be dialed as configured.
+func (s *Service) checkHandshake(handshake HandshakeConfig) error {
+	err := checkHandshakeServer(handshake.Server)
+	if err != nil {
+		return err
+	}
+	if handshake.Dialer == nil && s.handshakePool == nil {
+		return E.New("missing dialer for handshake server ", handshake.Server)
+	}
+	return nil
+}
+
+func (s *Service) selectHandshake(ctx context.Context, clientHelloFrame *buf.Buffer) (HandshakeConfig, string) {
 	serverName, err := extractServerName(clientHelloFrame.Bytes())
+	if handshake, loaded := s.handshakeOverride(ctx); loaded {
+		return handshake, serverName
+	}
 	if err == nil {
 		if customHandshake, found := s.handshakeForServerName[serverName]; found {
-			return customHandshake
+			return customHandshake, serverName
+		}
+		if s.handshakeServerMapper != nil && serverName != "" {
+			server, dialer := s.handshakeServerMapper(ctx, serverName)
+			if server.IsValid() && (dialer != nil || s.handshakePool != nil) {
+				return HandshakeConfig{Server: server, Dialer: dialer}, serverName
+			}
 		}
 	}
+	return s.configuredHandshake(), serverName
+}
+
+func (s *Service) defaultHandshake(ctx context.Context) HandshakeConfig {
+	if handshake, loaded := s.handshakeOverride(ctx); loaded {
+		return handshake
+	}
+	return s.configuredHandshake()
+}
+
+func (s *Service) configuredHandshake() HandshakeConfig {
+	if s.handshakeTargets != nil {
+		return s.handshakeTargets.pick()
+	}
 	return s.handshake
 }
 
+// dialHandshakeServer dials through the HandshakePool if set, which replaces the dialer of handshakeConfig.
+func (s *Service) dialHandshakeServer(ctx context.Context, handshakeConfig HandshakeConfig) (net.Conn, error) {
+	if s.handshakePool != nil {
+		return s.handshakePool.DialContext(ctx, N.NetworkTCP, handshakeConfig.Server)
+	}
+	return handshakeConfig.Dialer.DialContext(ctx, N.NetworkTCP, handshakeConfig.Server)
+}
+
+func (s *Service) dialHandshake(ctx context.Context, handshakeConfig HandshakeConfig, conn net.Conn, metadata M.Metadata) (net.Conn, error) {
+	dialCtx, cancel := handshakeContext(ctx)
+	defer cancel()
+	handshakeConn, err := s.dialHandshakeServer(dialCtx, handshakeConfig)
+	if err != nil && s.handshakeTargets != nil {
+		s.handshakeTargets.markFailed(handshakeConfig.Server)
+	}
+	if err == nil {
+		if deadline, loaded := handshakeDeadline(ctx); loaded {
+			// covers the reads between the relays, e.g. of the ServerHello
+			handshakeConn.SetDeadline(deadline)
+		}
+	}
+	if err != nil || s.handshakeProxyProtocol == 0 {
+		return handshakeConn, err
+	}
+	err = writeProxyProtocolHeader(handshakeConn, s.handshakeProxyProtocol, metadata.Source, M.SocksaddrFromNet(conn.LocalAddr()))
+	if err != nil {
+		handshakeConn.Close()
+		return nil, E.Cause(err, "write PROXY protocol header")
+	}
+	return handshakeConn, nil
+}
+
+// lingerClose half-closes the handshake connection and drains it until HandshakeLinger passes,
+// instead of an immediate close that tears down the TCP session unlike a real TLS client.
+func (s *Service) lingerClose(handshakeConn net.Conn) {
+	if closer, isCloser := handshakeConn.(interface{ CloseWrite() error }); isCloser {
+		closer.CloseWrite()
+	}
+	handshakeConn.SetReadDeadline(time.Time{})
+	s.features.Clock.AfterFunc(s.handshakeLinger, func() {
+		handshakeConn.Close()
+	})
+	go io.Copy(io.Discard, handshakeConn)
+}
+
+// ErrPermitFallback may be returned by PermitConnection to relay an authenticated client to the handshake server
+// like an unauthenticated one instead of closing it, which looks less suspicious.
+//
+// This is only possible before the handshake relay starts, since the relay modifies the server records for the
+// client and closes the handshake connection. It requires protocol version 3 and PermitBeforeRelay, which calls
+// PermitConnection right after the ClientHello authenticated instead of after the relay. The ClientHello
+// may be replayed by a prober at that point. In every other case ErrPermitFallback closes the connection.
+var ErrPermitFallback = E.New("connection sent to fallback by permission check")
+
+func (s *Service) checkPermission(ctx context.Context, conn net.Conn, user *User, serverName string) error {
+	if s.permitConnection == nil {
+		return nil
+	}
+	err := s.permitConnection(ctx, user, serverName)
+	if err != nil {
+		conn.Close()
+		return E.Cause(err, "connection rejected")
+	}
+	return nil
+}
+
+// NewConnection serves conn in the calling goroutine. The handshake relay of every protocol version
+// runs its two directions in a task.Group, and both goroutines exit before the handler is called.
 func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if s.handler == nil {
+		return os.ErrInvalid
+	}
+	s.stats.activeConnections.Add(1)
+	defer s.stats.activeConnections.Add(-1)
+	return s.newConnection(ctx, conn, metadata, recoverHandler{s.handler, s.logger})
+}
+
+func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, handler Handler) error {
+	if isWrapped(conn) {
+		return ErrAlreadyWrapped
+	}
+	ctx = ContextWithConnectionID(ctx, newConnectionID())
+	if !s.sourceAllowed(metadata.Source) {
+		return s.relayDisallowedSource(ctx, conn, metadata)
+	}
+	ctx = s.startHandshakeTimeout(ctx, conn)
+	handler = &onceHandler{Handler: handler}
 	switch s.version {
-	default:
-		fallthrough
-	case 1:
-		handshakeConn, err := s.handshake.Dialer.DialContext(ctx, N.NetworkTCP, s.handshake.Server)
-		if err != nil {
-			return E.Cause(err, "server handshake")
-		}
-
-		var group task.Group
-		group.Append("client handshake", func(ctx context.Context) error {
-			return copyUntilHandshakeFinished(handshakeConn, conn)
-		})
-		group.Append("server handshake", func(ctx context.Context) error {
-			return copyUntilHandshakeFinished(conn, handshakeConn)
-		})
-		group.FastFail()
-		group.Cleanup(func() {
-			handshakeConn.Close()
-		})
-		err = group.Run(ctx)
-		if err != nil {
-			return err
-		}
-		s.logger.TraceContext(ctx, "handshake finished")
-		return s.handler.NewConnection(ctx, conn, metadata)
+	case 0:
+		return s.newConnectionAuto(ctx, conn, metadata, handler)
 	case 2:
-		clientHelloFrame, err := extractFrame(conn)
+		clientHelloFrame, err := s.extractClientHello(conn)
 		if err != nil {
 			return E.Cause(err, "read client handshake")
 		}
-
-		handshakeConfig := s.selectHandshake(clientHelloFrame)
-		handshakeConn, err := handshakeConfig.Dialer.DialContext(ctx, N.NetworkTCP, handshakeConfig.Server)
-		if err != nil {
-			return E.Cause(err, "server handshake")
-		}
-		hashConn := newHashWriteConn(conn, s.password)
-		go bufio.Copy(hashConn, handshakeConn)
-		var request *buf.Buffer
-		request, err = copyUntilHandshakeFinishedV2(ctx, s.logger, handshakeConn, bufio.NewCachedConn(conn, clientHelloFrame), hashConn, 2)
-		if err == nil {
-			s.logger.TraceContext(ctx, "handshake finished")
-			handshakeConn.Close()
-			return s.handler.NewConnection(ctx, bufio.NewCachedConn(newConn(conn), request), metadata)
-		} else if err == os.ErrPermission {
-			s.logger.WarnContext(ctx, "fallback connection")
-			hashConn.Fallback()
-			return common.Error(bufio.Copy(handshakeConn, conn))
-		} else {
-			return err
+		if _, v3Err := verifyClientHello(clientHelloFrame.Bytes(), s.v2Users()); v3Err == nil {
+			s.logger.WarnContext(ctx, "client appears to use protocol version 3 but server is version 2")
 		}
+		return s.newConnectionV2(ctx, conn, clientHelloFrame, metadata, handler)
 	case 3:
-		clientHelloFrame, err := extractFrame(conn)
+		clientHelloFrame, err := s.extractClientHello(conn)
 		if err != nil {
 			return E.Cause(err, "read client handshake")
 		}
+		return s.newConnectionV3(ctx, conn, clientHelloFrame, metadata, handler)
+	default:
+		return s.newConnectionV1(ctx, conn, metadata, handler)
+	}
+}
 
-		handshakeConfig := s.selectHandshake(clientHelloFrame)
-		handshakeConn, err := handshakeConfig.Dialer.DialContext(ctx, N.NetworkTCP, handshakeConfig.Server)
-		if err != nil {
-			return E.Cause(err, "server handshake")
+// newConnectionAuto picks the protocol version from the first client record.
+//
+// Only v3 authenticates the ClientHello, v1 and v2 clients send an ordinary one,
+// so the versions can not be told apart before the handshake has been relayed.
+// A ClientHello carrying a valid v3 HMAC is handled as v3, otherwise the connection
+// is handled as v2 if Password or Users give v2 something to authenticate, which falls
+// back to the handshake server if the client never authenticates. Without any it is
+// relayed as a failed v3 probe. v1 is never selected since it accepts every client.
+func (s *Service) newConnectionAuto(ctx context.Context, conn net.Conn, metadata M.Metadata, handler Handler) error {
+	clientHelloFrame, err := s.extractClientHello(conn)
+	if err != nil {
+		return E.Cause(err, "read client handshake")
+	}
+	if users := s.loadUsers(); len(users) > 0 {
+		_, err = verifyClientHello(clientHelloFrame.Bytes(), users)
+		if err == nil {
+			s.logger.TraceContext(ctx, "detected protocol version 3")
+			return s.newConnectionV3(ctx, conn, clientHelloFrame, metadata, handler)
 		}
+	}
+	if len(s.v2Users()) > 0 {
+		s.logger.TraceContext(ctx, "fallback to protocol version 2")
+		return s.newConnectionV2(ctx, conn, clientHelloFrame, metadata, handler)
+	}
+	return s.newConnectionV3(ctx, conn, clientHelloFrame, metadata, handler)
+}
 
-		_, err = handshakeConn.Write(clientHelloFrame.Bytes())
-		if err != nil {
-			clientHelloFrame.Release()
-			return E.Cause(err, "write client handshake")
-		}
-		user, err := verifyClientHello(clientHelloFrame.Bytes(), s.users)
-		if err != nil {
-			s.logger.WarnContext(ctx, E.Cause(err, "client hello verify failed"))
-			return bufio.CopyConn(ctx, conn, handshakeConn)
+func (s *Service) newConnectionV1(ctx context.Context, conn net.Conn, metadata M.Metadata, handler Handler) error {
+	handshakeConn, err := s.dialHandshake(ctx, s.defaultHandshake(ctx), conn, metadata)
+	if err != nil {
+		s.probeFallback(ctx, FallbackReasonHandshakeServerError)
+		return E.Cause(err, "server handshake")
+	}
+
+	var group task.Group
+	var clientBytes, serverBytes int64
+	group.Append("client handshake", func(ctx context.Context) error {
+		return copyUntilHandshakeFinished(handshakeConn, newHandshakeLimitConn(conn, s.maxHandshakeBytes, 0), &clientBytes)
+	})
+	group.Append("server handshake", func(ctx context.Context) error {
+		return copyUntilHandshakeFinished(conn, newHandshakeLimitConn(handshakeConn, s.maxHandshakeBytes, 0), &serverBytes)
+	})
+	group.FastFail()
+	group.Cleanup(func() {
+		handshakeConn.Close()
+	})
+	handshakeCtx, cancel := handshakeContext(ctx)
+	err = group.Run(handshakeCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	s.logger.TraceContext(ctx, "handshake finished")
+	err = s.checkPermission(ctx, conn, nil, "")
+	if err != nil {
+		return err
+	}
+	s.handshakeSucceeded(ctx, 1, clientBytes, serverBytes, 0)
+	if s.observer != nil {
+		// sing copy helpers count through the raw connection, other readers pay for the wrapper, so it is only done for observed services
+		conn = &countingConn{Conn: conn, counter: &s.stats.bytesRelayed}
+	}
+	s.stopHandshakeTimeout(conn)
+	return handler.NewConnection(ctx, conn, metadata)
+}
+
+func (s *Service) newConnectionV2(ctx context.Context, conn net.Conn, clientHelloFrame *buf.Buffer, metadata M.Metadata, handler Handler) error {
+	s.inspectClientHello(ctx, clientHelloFrame.Bytes())
+	handshakeConfig, serverName := s.selectHandshake(ctx, clientHelloFrame)
+	handshakeConn, err := s.dialHandshake(ctx, handshakeConfig, conn, metadata)
+	if err != nil {
+		clientHelloFrame.Release()
+		s.probeFallback(ctx, FallbackReasonHandshakeServerError)
+		return E.Cause(err, "server handshake")
+	}
+	users := s.v2Users()
+	passwords := make([]string, len(users))
+	for i, user := range users {
+		passwords[i] = user.Password
+	}
+	hashConn := newHashWriteConn(conn, passwords)
+	serverConn := newHandshakeLimitConn(handshakeConn, s.maxHandshakeBytes, 0)
+	clientConn := newHandshakeLimitConn(conn, s.maxHandshakeBytes, clientHelloFrame.Len())
+	var clientBytes, serverBytes int64
+	var request *buf.Buffer
+	var userIndex int
+	var fallback atomic.Bool
+	var fallbackErr error
+	var group task.Group
+	group.Append("client handshake", func(ctx context.Context) error {
+		var cErr error
+		request, userIndex, cErr = copyUntilHandshakeFinishedV2(ctx, s.logger, handshakeConn, bufio.NewCachedConn(clientConn, clientHelloFrame), hashConn, 2, &clientBytes)
+		if cErr == os.ErrPermission {
+			fallback.Store(true)
+			s.logger.WarnContext(ctx, "fallback connection")
+			s.probeFallback(ctx, FallbackReasonHMACMismatch)
+			hashConn.Fallback()
+			disableHandshakeLimit(serverConn)
+			s.stopHandshakeTimeout(conn, handshakeConn)
+			cErr = common.Error(bufio.Copy(handshakeConn, conn))
+			if cErr == nil {
+				// the client half-closed, the server side keeps relaying the response until the server closes
+				if closer, isCloser := handshakeConn.(interface{ CloseWrite() error }); isCloser && closer.CloseWrite() == nil {
+					return nil
+				}
+			}
+			fallbackErr = cErr
 		}
-		if user.Name != "" {
-			ctx = auth.ContextWithUser(ctx, user.Name)
+		// stops the server side
+		handshakeConn.Close()
+		return cErr
+	})
+	group.Append("server handshake", func(ctx context.Context) error {
+		// the server side ends when the client side closes handshakeConn,
+		// failures surface on the client side
+		serverBytes, _ = bufio.Copy(hashConn, serverConn)
+		return nil
+	})
+	group.Cleanup(func() {
+		// the fallback relay outlives the handshake timeout
+		if !fallback.Load() {
+			handshakeConn.Close()
 		}
-		s.logger.TraceContext(ctx, "client hello verify success")
+	})
+	handshakeCtx, cancel := handshakeContext(ctx)
+	err = group.Run(handshakeCtx)
+	cancel()
+	if fallback.Load() {
+		return fallbackErr
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.TraceContext(ctx, "handshake finished")
+	var user *User
+	if s.password == "" || userIndex > 0 {
+		user = &users[userIndex]
+		ctx = contextWithUser(ctx, user)
+	}
+	err = s.checkPermission(ctx, conn, user, serverName)
+	if err != nil {
+		request.Release()
+		return err
+	}
+	s.handshakeSucceeded(ctx, 2, clientBytes, serverBytes, 0)
+	shadowConn := newCachedConn(conn, request)
+	shadowConn.bytesCounter = &s.stats.bytesRelayed
+	s.stopHandshakeTimeout(conn)
+	return handler.NewConnection(ctx, shadowConn, metadata)
+}
+
+// v2Users returns the users a protocol version 2 client may authenticate as,
+// Password is a user without name that is tried first.
+func (s *Service) v2Users() []User {
+	users := s.loadUsers()
+	if s.password == "" {
+		return users
+	}
+	return append([]User{{Password: s.password}}, users...)
+}
+
+// contextWithUser passes the authenticated user to the Handler.
+func contextWithUser(ctx context.Context, user *User) context.Context {
+	if user.Name != "" {
+		ctx = auth.ContextWithUser(ctx, user.Name)
+	}
+	if user.Tag != "" {
+		ctx = ContextWithUserTag(ctx, user.Tag)
+	}
+	return context.WithValue(ctx, acceptedUserKey{}, user)
+}
+
+func (s *Service) newConnectionV3(ctx context.Context, conn net.Conn, clientHelloFrame *buf.Buffer, metadata M.Metadata, handler Handler) error {
+	s.inspectClientHello(ctx, clientHelloFrame.Bytes())
+	handshakeConfig, serverName := s.selectHandshake(ctx, clientHelloFrame)
+	user, verifyErr := verifyClientHello(clientHelloFrame.Bytes(), s.loadUsers())
+	if verifyErr == nil && s.replayCache != nil && !s.replayCache.add(clientHelloFrame.Bytes()) {
+		// takes the same path as a client that failed authentication
+		verifyErr = errClientHelloReplayed
+	}
+	if verifyErr != nil && s.probeAlert != nil {
 		clientHelloFrame.Release()
+		s.logger.WarnContext(ctx, E.Cause(verifyErr, "client hello verify failed, reject with alert"))
+		s.probeFallback(ctx, fallbackReasonFromError(verifyErr))
+		s.stopHandshakeTimeout(conn)
+		return s.probeAlert.respond(ctx, s.features.Clock, conn)
+	}
+	if verifyErr != nil && s.decoyServer != nil {
+		s.logger.WarnContext(ctx, E.Cause(verifyErr, "client hello verify failed, serve decoy"))
+		s.probeFallback(ctx, fallbackReasonFromError(verifyErr))
+		s.stopHandshakeTimeout(conn)
+		return serveDecoy(ctx, conn, clientHelloFrame, s.decoyServer)
+	}
 
-		var serverHelloFrame *buf.Buffer
-		serverHelloFrame, err = extractFrame(handshakeConn)
-		if err != nil {
-			return E.Cause(err, "read server handshake")
-		}
+	handshakeConn, err := s.dialHandshake(ctx, handshakeConfig, conn, metadata)
+	if err != nil {
+		clientHelloFrame.Release()
+		s.probeFallback(ctx, FallbackReasonHandshakeServerError)
+		return E.Cause(err, "server handshake")
+	}
 
-		_, err = conn.Write(serverHelloFrame.Bytes())
-		if err != nil {
-			serverHelloFrame.Release()
-			return E.Cause(err, "write server handshake")
+	_, err = handshakeConn.Write(clientHelloFrame.Bytes())
+	if err != nil {
+		clientHelloFrame.Release()
+		handshakeConn.Close()
+		return E.Cause(err, "write client handshake")
+	}
+	if verifyErr != nil {
+		clientHelloFrame.Release()
+		s.logger.WarnContext(ctx, E.Cause(verifyErr, "client hello verify failed"))
+		s.probeFallback(ctx, fallbackReasonFromError(verifyErr))
+		return s.relayFallback(ctx, conn, handshakeConn)
+	}
+	ctx = contextWithUser(ctx, user)
+	if s.features.StrictMode && !s.features.LegacyTLS12 {
+		if info, parseErr := parseClientHello(clientHelloFrame.Bytes()); parseErr == nil {
+			if compatErr := info.checkTLS13(); compatErr != nil {
+				s.logger.WarnContext(ctx, E.Cause(compatErr, "client hello is incompatible with strict mode, the handshake will fall back"))
+			}
 		}
+	}
+	s.logger.TraceContext(ctx, "client hello verify success")
+	if s.permitBeforeRelay && s.permitConnection != nil {
+		err = s.permitConnection(ctx, user, serverName)
+		if err == ErrPermitFallback {
+			clientHelloFrame.Release()
+			s.logger.DebugContext(ctx, err)
+			return s.relayFallback(ctx, conn, handshakeConn)
+		} else if err != nil {
+			clientHelloFrame.Release()
+			handshakeConn.Close()
+			conn.Close()
+			return E.Cause(err, "connection rejected")
+		}
+	}
+	clientConn := newHandshakeLimitConn(conn, s.maxHandshakeBytes, clientHelloFrame.Len())
+	serverConn := newHandshakeLimitConn(handshakeConn, s.maxHandshakeBytes, 0)
+	clientHelloSize := clientHelloFrame.Len()
+	clientHelloFrame.Release()
 
-		serverRandom := extractServerRandom(serverHelloFrame.Bytes())
+	var serverHelloFrame *buf.Buffer
+	serverHelloFrame, err = extractServerHelloFrame(serverConn)
+	if err != nil {
+		handshakeConn.Close()
+		s.probeFallback(ctx, FallbackReasonHandshakeServerError)
+		return E.Cause(err, "read server handshake")
+	}
+	serverHelloSize := serverHelloFrame.Len()
 
-		if serverRandom == nil {
-			s.logger.WarnContext(ctx, "server random extract failed, will copy bidirectional")
-			return bufio.CopyConn(ctx, conn, handshakeConn)
-		}
+	_, err = conn.Write(serverHelloFrame.Bytes())
+	if err != nil {
+		serverHelloFrame.Release()
+		handshakeConn.Close()
+		return E.Cause(err, "write server handshake")
+	}
 
-		if s.strictMode && !isServerHelloSupportTLS13(serverHelloFrame.Bytes()) {
-			s.logger.WarnContext(ctx, "TLS 1.3 is not supported, will copy bidirectional")
-			return bufio.CopyConn(ctx, conn, handshakeConn)
-		}
+	serverRandom := extractServerRandom(serverHelloFrame.Bytes())
 
+	if serverRandom == nil {
 		serverHelloFrame.Release()
-		if debug.Enabled {
-			s.logger.TraceContext(ctx, "client authenticated. server random extracted: ", hex.EncodeToString(serverRandom))
-		}
-		hmacWrite := hmac.New(sha1.New, []byte(user.Password))
-		hmacWrite.Write(serverRandom)
-		hmacAdd := hmac.New(sha1.New, []byte(user.Password))
-		hmacAdd.Write(serverRandom)
-		hmacAdd.Write([]byte("S"))
-		hmacVerify := hmac.New(sha1.New, []byte(user.Password))
-		hmacVerifyReset := func() {
-			hmacVerify.Reset()
-			hmacVerify.Write(serverRandom)
-			hmacVerify.Write([]byte("C"))
-		}
-
-		var clientFirstFrame *buf.Buffer
-		var group task.Group
-		var handshakeFinished bool
-		group.Append("client handshake relay", func(ctx context.Context) error {
-			clientFrame, cErr := copyByFrameUntilHMACMatches(conn, handshakeConn, hmacVerify, hmacVerifyReset)
-			if cErr == nil {
-				clientFirstFrame = clientFrame
-				handshakeFinished = true
+		s.logger.WarnContext(ctx, "server random extract failed, will copy bidirectional")
+		s.probeFallback(ctx, FallbackReasonServerRandomMissing)
+		return s.relayFallback(ctx, conn, handshakeConn)
+	}
+
+	if s.features.RequireTLS13 && !s.features.LegacyTLS12 && !isServerHelloSupportTLS13(serverHelloFrame.Bytes()) {
+		serverHelloFrame.Release()
+		handshakeConn.Close()
+		s.tls13Downgrade(ctx)
+		return ErrTLS13Downgrade
+	}
+	if s.features.StrictMode && !s.features.LegacyTLS12 && !isServerHelloSupportTLS13(serverHelloFrame.Bytes()) {
+		serverHelloFrame.Release()
+		s.warnNotTLS13(ctx)
+		s.probeFallback(ctx, FallbackReasonNotTLS13)
+		return s.relayFallback(ctx, conn, handshakeConn)
+	}
+
+	cipherSuite := serverHelloCipherSuite(serverHelloFrame.Bytes())
+	serverHelloFrame.Release()
+	if debug.Enabled {
+		s.logger.TraceContext(ctx, "client authenticated. server random extracted: ", hex.EncodeToString(serverRandom))
+	}
+	hmacWrite := hmac.New(sha1.New, []byte(user.Password))
+	hmacWrite.Write(serverRandom)
+	hmacAdd := hmac.New(sha1.New, []byte(user.Password))
+	hmacAdd.Write(serverRandom)
+	hmacAdd.Write(s.features.chainRole("S"))
+	hmacVerify := hmac.New(sha1.New, []byte(user.Password))
+	hmacVerifyReset := func() {
+		hmacVerify.Reset()
+		hmacVerify.Write(serverRandom)
+		hmacVerify.Write(s.features.chainRole("C"))
+	}
+
+	var clientReader, serverReader io.Reader = clientConn, serverConn
+	var clientBatchReader, serverBatchReader *batchReader
+	if s.handshakeReadSize > 0 {
+		clientBatchReader = newBatchReader(clientConn, s.handshakeReadSize)
+		clientReader = clientBatchReader
+		serverBatchReader = newBatchReader(serverConn, s.handshakeReadSize)
+		serverReader = serverBatchReader
+	}
+	clientBytes, serverBytes := int64(clientHelloSize), int64(serverHelloSize)
+
+	stopFirstFrameTimeout := s.startFirstFrameTimeout(ctx, conn)
+	var clientFirstFrame *buf.Buffer
+	var group task.Group
+	// the client relay only writes to handshakeConn and the server relay only reads from it,
+	// so the directions never share a buffer and only this flag crosses goroutines
+	var handshakeFinished atomic.Bool
+	group.Append("client handshake relay", func(ctx context.Context) error {
+		clientFrame, cErr := copyByFrameUntilHMACMatches(clientReader, handshakeConn, hmacVerify, hmacVerifyReset, s.features.FrameDumper, &clientBytes)
+		if cErr == nil {
+			clientFirstFrame = clientFrame
+			handshakeFinished.Store(true)
+			if s.handshakeLinger > 0 {
+				// stop the server relay, late records are drained by lingerClose
+				handshakeConn.SetReadDeadline(time.Now())
+			} else {
 				handshakeConn.Close()
 			}
-			return cErr
-		})
-		group.Append("server handshake relay", func(ctx context.Context) error {
-			cErr := copyByFrameWithModification(handshakeConn, conn, user.Password, serverRandom, hmacWrite)
-			if E.IsClosedOrCanceled(cErr) && handshakeFinished {
-				return nil
-			}
-			return cErr
-		})
-		group.Cleanup(func() {
+		}
+		return cErr
+	})
+	group.Append("server handshake relay", func(ctx context.Context) error {
+		cErr := copyByFrameWithModification(ctx, s.logger, serverReader, conn, user.Password, serverRandom, hmacWrite, s.features.FrameDumper, &serverBytes)
+		if (E.IsClosedOrCanceled(cErr) || E.IsTimeout(cErr)) && handshakeFinished.Load() {
+			return nil
+		}
+		return cErr
+	})
+	group.FastFail()
+	group.Cleanup(func() {
+		if !handshakeFinished.Load() {
+			// a relay failed, e.g. writing the server flight to a disconnected client,
+			// so unblock the client relay before the group waits for it
+			conn.SetReadDeadline(time.Now())
+		}
+		if s.handshakeLinger == 0 || !handshakeFinished.Load() {
+			handshakeConn.Close()
+		}
+	})
+	handshakeCtx, cancel := handshakeContext(ctx)
+	err = group.Run(handshakeCtx)
+	cancel()
+	if !stopFirstFrameTimeout() && err == nil {
+		// the read deadline expired the connection right after the first frame
+		err = os.ErrDeadlineExceeded
+	}
+	if serverBatchReader != nil {
+		serverBatchReader.release()
+	}
+	if s.handshakeLinger > 0 && handshakeFinished.Load() {
+		if err == nil {
+			s.lingerClose(handshakeConn)
+		} else {
 			handshakeConn.Close()
-		})
-		err = group.Run(ctx)
+		}
+	}
+	if err != nil {
+		if clientFirstFrame != nil {
+			clientFirstFrame.Release()
+		}
+		if clientBatchReader != nil {
+			clientBatchReader.release()
+		}
+		return E.Cause(err, "handshake relay")
+	}
+	s.logger.TraceContext(ctx, "handshake relay finished")
+	if s.logCipherSuite {
+		s.logger.InfoContext(ctx, "handshake server selected cipher suite ", tls.CipherSuiteName(cipherSuite))
+	}
+	if !s.permitBeforeRelay {
+		err = s.checkPermission(ctx, conn, user, serverName)
 		if err != nil {
-			return E.Cause(err, "handshake relay")
+			clientFirstFrame.Release()
+			if clientBatchReader != nil {
+				clientBatchReader.release()
+			}
+			return err
 		}
-		s.logger.TraceContext(ctx, "handshake relay finished")
-		return s.handler.NewConnection(ctx, bufio.NewCachedConn(newVerifiedConn(conn, hmacAdd, hmacVerify, nil), clientFirstFrame), metadata)
 	}
+	verifiedConn := newVerifiedConn(conn, hmacAdd, hmacVerify, nil)
+	if clientBatchReader != nil {
+		// keep records the client sent along with its first frame
+		clientBatchReader.upstream = conn
+		verifiedConn.reader = clientBatchReader
+	}
+	s.features.setupConn(verifiedConn, conn)
+	if verifiedConn.padder != nil && !unpad(clientFirstFrame) {
+		clientFirstFrame.Release()
+		verifiedConn.Close()
+		return E.New("invalid padding length in the first client record")
+	}
+	s.features.startSampler(ctx, s.logger, verifiedConn)
+	verifiedConn.bytesCounter = &s.stats.bytesRelayed
+	verifiedConn.onVerifyFailure = func() {
+		s.dataVerificationFailed(ctx)
+	}
+	verifiedConn.firstByte = s.newFirstByteTimer(ctx)
+	if verifiedConn.firstByte != nil && clientFirstFrame.Len() > 0 {
+		verifiedConn.firstByte.observe(FrameDirectionRead)
+	}
+	s.handshakeSucceeded(ctx, 3, clientBytes, serverBytes, cipherSuite)
+	s.stopHandshakeTimeout(conn)
+	return handler.NewConnection(ctx, s.features.wrapConn(newFirstFrameConn(verifiedConn, clientFirstFrame)), metadata)
 }
@@ -0,0 +1,1128 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowtls/handshakeserver"
+	"github.com/sagernet/sing-shadowtls/internal/faultdialer"
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// TestServiceWithoutServerName routes a ClientHello without server_name through the empty name entry.
+func TestServiceWithoutServerName(t *testing.T) {
+	unreachable := memconn.NewListener()
+	unreachable.Close()
+	var permittedServerName *string
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: unreachable,
+		},
+		HandshakeForServerName: map[string]HandshakeConfig{
+			"": {
+				Server: testHandshakeServer,
+				Dialer: startHandshakeServer(t),
+			},
+		},
+		PermitConnection: func(ctx context.Context, user *User, serverName string) error {
+			permittedServerName = &serverName
+			return nil
+		},
+	})
+	client := newTestClient(t, ClientConfig{
+		TLSHandshake: DefaultTLSHandshakeFunc(testPassword, &tls.Config{InsecureSkipVerify: true}),
+	})
+	conn, _ := dialTestConn(t, service, client)
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response [4]byte
+	_, err = io.ReadFull(conn, response[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permittedServerName == nil || *permittedServerName != "" {
+		t.Fatal("PermitConnection did not receive the empty server name")
+	}
+}
+
+func TestServiceServerNameFallsBackToDefault(t *testing.T) {
+	unreachable := memconn.NewListener()
+	unreachable.Close()
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		HandshakeForServerName: map[string]HandshakeConfig{
+			"": {
+				Server: testHandshakeServer,
+				Dialer: unreachable,
+			},
+		},
+	})
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{}))
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response [4]byte
+	_, err = io.ReadFull(conn, response[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingDialer passes dials to upstream and records their destinations.
+type recordingDialer struct {
+	N.Dialer
+	destinations chan M.Socksaddr
+}
+
+func newRecordingDialer(upstream N.Dialer) *recordingDialer {
+	return &recordingDialer{
+		Dialer:       upstream,
+		destinations: make(chan M.Socksaddr, 16),
+	}
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	d.destinations <- destination
+	return d.Dialer.DialContext(ctx, network, destination)
+}
+
+func TestServiceLinkLocalHandshakeServer(t *testing.T) {
+	_, err := NewService(ServiceConfig{
+		Version: 3,
+		Users:   []User{{Password: testPassword}},
+		Handshake: HandshakeConfig{
+			Server: M.ParseSocksaddr("[fe80::1]:443"),
+			Dialer: N.SystemDialer,
+		},
+		Handler: handlerFunc(echoHandler),
+		Logger:  logger.NOP(),
+	})
+	if err == nil {
+		t.Fatal("link-local handshake server without zone accepted")
+	}
+
+	server := M.ParseSocksaddr("[fe80::1%eth7]:443")
+	if server.Addr.Zone() != "eth7" {
+		t.Fatal("zone lost by parsing: ", server)
+	}
+	dialer := newRecordingDialer(startHandshakeServer(t))
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handshake: HandshakeConfig{
+			Server: server,
+			Dialer: dialer,
+		},
+	})
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{}))
+	conn.Close()
+	if destination := <-dialer.destinations; destination.Addr.Zone() != "eth7" || destination != server {
+		t.Fatal("handshake dialed ", destination, ", expected ", server)
+	}
+}
+
+// TestServiceHandshakeRelayInterleaving sends the first data record together with the client Finished,
+// while the handshake server is still writing its post-handshake records, to race both relay directions.
+func TestServiceHandshakeRelayInterleaving(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	client := newTestClient(t, ClientConfig{})
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for i := 0; i < 50; i++ {
+		conn, done := serveTestConn(context.Background(), service)
+		ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+		dataConn, err := client.DialContextConnWithPayload(ctx, conn, payload)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataConn.SetReadDeadline(time.Now().Add(testDialTimeout))
+		response := make([]byte, len(payload))
+		_, err = io.ReadFull(dataConn, response)
+		if err != nil {
+			t.Fatal("iteration ", i, ": ", err)
+		}
+		if !bytes.Equal(response, payload) {
+			t.Fatal("iteration ", i, ": echo corrupted")
+		}
+		dataConn.Close()
+		waitDone(t, done)
+	}
+}
+
+func TestServiceProbeAlertDelay(t *testing.T) {
+	clock := newFakeClock()
+	service := newTestService(t, ServiceConfig{
+		Version:    3,
+		ProbeAlert: &ProbeAlert{Delay: time.Minute},
+	}, WithClock(clock))
+	conn, done := serveTestConn(context.Background(), service)
+	defer conn.Close()
+	_, err := conn.Write(captureClientHello(t, DefaultTLSHandshakeFunc("wrong password", &tls.Config{
+		ServerName:         testServerName,
+		InsecureSkipVerify: true,
+	}), generateSessionID("wrong password")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.waitTimers(t, 1)
+	var record [tlsHeaderSize + 2]byte
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(record[:])
+	if !E.IsTimeout(err) {
+		t.Fatal("alert written before the delay: ", err)
+	}
+	clock.Advance(time.Minute)
+	conn.SetReadDeadline(time.Now().Add(testDialTimeout))
+	_, err = io.ReadFull(conn, record[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record != [tlsHeaderSize + 2]byte{alert, 3, 3, 0, 2, 2, 40} {
+		t.Fatalf("unexpected alert %x", record)
+	}
+	waitDone(t, done)
+}
+
+func TestServiceFirstFrameTimeout(t *testing.T) {
+	clock := newFakeClock()
+	service := newTestService(t, ServiceConfig{
+		Version:           3,
+		FirstFrameTimeout: time.Minute,
+	}, WithClock(clock))
+	_, done := dialTestConn(t, service, newTestClient(t, ClientConfig{}))
+	clock.waitTimers(t, 1)
+	select {
+	case err := <-done:
+		t.Fatal("service returned before the first frame timeout: ", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Minute)
+	err := waitDone(t, done)
+	if !E.IsTimeout(err) {
+		t.Fatal("expected a timeout, got ", err)
+	}
+}
+
+// closeRecordingDialer passes dials to upstream and reports when a dialed connection is closed.
+type closeRecordingDialer struct {
+	N.Dialer
+	closed chan struct{}
+}
+
+func newCloseRecordingDialer(upstream N.Dialer) *closeRecordingDialer {
+	return &closeRecordingDialer{
+		Dialer: upstream,
+		closed: make(chan struct{}, 16),
+	}
+}
+
+func (d *closeRecordingDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &closeRecordingConn{Conn: conn, closed: d.closed}, nil
+}
+
+type closeRecordingConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *closeRecordingConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closed <- struct{}{}
+	})
+	return c.Conn.Close()
+}
+
+func TestServiceHandshakeTimeout(t *testing.T) {
+	// a record header announcing 100 bytes followed by only 10 of them
+	halfRecord := append([]byte{applicationData, 3, 3, 0, 100}, make([]byte, 10)...)
+	for _, version := range []int{1, 2, 3} {
+		t.Run(fmt.Sprint("v", version), func(t *testing.T) {
+			var handshakeServer *memconn.Listener
+			if version == 1 {
+				handshakeServer = startTLS12HandshakeServer(t)
+			} else {
+				handshakeServer = startHandshakeServer(t)
+			}
+			dialer := newCloseRecordingDialer(handshakeServer)
+			service := newTestService(t, ServiceConfig{
+				Version:          version,
+				HandshakeTimeout: 200 * time.Millisecond,
+				Handshake: HandshakeConfig{
+					Server: testHandshakeServer,
+					Dialer: dialer,
+				},
+			})
+			conn, done := serveTestConn(context.Background(), service)
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+			_, err := conn.Write(append(testClientHello(t), halfRecord...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = waitDone(t, done)
+			if !E.IsTimeout(err) {
+				t.Fatal("expected a timeout, got ", err)
+			}
+			select {
+			case <-dialer.closed:
+			case <-time.After(testDialTimeout):
+				t.Fatal("handshake connection not closed")
+			}
+		})
+	}
+}
+
+func TestServiceHandshakeTimeoutPartialClientHello(t *testing.T) {
+	dialer := newCloseRecordingDialer(startHandshakeServer(t))
+	service := newTestService(t, ServiceConfig{
+		Version:          3,
+		HandshakeTimeout: 100 * time.Millisecond,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: dialer,
+		},
+	})
+	conn, done := serveTestConn(context.Background(), service)
+	defer conn.Close()
+	clientHello := testClientHello(t)
+	_, err := conn.Write(clientHello[:len(clientHello)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitDone(t, done)
+	if !E.IsTimeout(err) {
+		t.Fatal("expected a timeout, got ", err)
+	}
+}
+
+func TestServiceHandshakeTimeoutDial(t *testing.T) {
+	dialer := &faultdialer.Dialer{
+		Upstream: startHandshakeServer(t),
+		Latency:  time.Minute,
+	}
+	service := newTestService(t, ServiceConfig{
+		Version:          3,
+		HandshakeTimeout: 100 * time.Millisecond,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: dialer,
+		},
+	})
+	conn, done := serveTestConn(context.Background(), service)
+	defer conn.Close()
+	_, err := conn.Write(testClientHello(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitDone(t, done)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the dial to time out, got ", err)
+	}
+}
+
+func TestServiceHandshakeTimeoutProbeAlert(t *testing.T) {
+	clock := newFakeClock()
+	service := newTestService(t, ServiceConfig{
+		Version:          3,
+		HandshakeTimeout: 50 * time.Millisecond,
+		ProbeAlert:       &ProbeAlert{Delay: time.Minute},
+	}, WithClock(clock))
+	conn, done := serveTestConn(context.Background(), service)
+	defer conn.Close()
+	_, err := conn.Write(captureClientHello(t, DefaultTLSHandshakeFunc("wrong password", &tls.Config{
+		ServerName:         testServerName,
+		InsecureSkipVerify: true,
+	}), generateSessionID("wrong password")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.waitTimers(t, 1)
+	// the delayed alert is not a handshake, so the handshake timeout no longer applies
+	time.Sleep(100 * time.Millisecond)
+	clock.Advance(time.Minute)
+	var record [tlsHeaderSize + 2]byte
+	conn.SetReadDeadline(time.Now().Add(testDialTimeout))
+	_, err = io.ReadFull(conn, record[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitDone(t, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outerTLSDialer reaches the handshake server through a TLS terminating front, like a CDN.
+type outerTLSDialer struct {
+	N.Dialer
+}
+
+func (d *outerTLSDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "front.example.net", InsecureSkipVerify: true})
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// startTLSFront terminates TLS for front.example.net and relays the plaintext to upstream.
+func startTLSFront(t *testing.T, upstream N.Dialer) *memconn.Listener {
+	certificate, err := handshakeserver.GenerateCertificate("front.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := memconn.NewListener()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}})
+				defer tlsConn.Close()
+				upstreamConn, err := upstream.DialContext(context.Background(), N.NetworkTCP, testHandshakeServer)
+				if err != nil {
+					return
+				}
+				bufio.CopyConn(context.Background(), tlsConn, upstreamConn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// TestServiceHandshakeOverOuterTLS relays the handshake over the plaintext of an outer TLS session.
+func TestServiceHandshakeOverOuterTLS(t *testing.T) {
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: &outerTLSDialer{startTLSFront(t, startHandshakeServer(t))},
+		},
+	})
+	client := newTestClient(t, ClientConfig{
+		TLSHandshake: DefaultTLSHandshakeFunc(testPassword, &tls.Config{
+			ServerName: testServerName,
+			VerifyConnection: func(state tls.ConnectionState) error {
+				if state.PeerCertificates[0].Subject.CommonName != testServerName {
+					return E.New("handshake of the outer session: ", state.PeerCertificates[0].Subject.CommonName)
+				}
+				return nil
+			},
+			InsecureSkipVerify: true,
+		}),
+	})
+	conn, _ := dialTestConn(t, service, client)
+	testEcho(t, conn, []byte("through the front"), false)
+}
+
+// TestServiceZeroLengthClientHello falls back on a ClientHello record without payload.
+func TestServiceZeroLengthClientHello(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	conn, done := serveTestConn(context.Background(), service)
+	defer conn.Close()
+	_, err := conn.Write(testRecord(handshake, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(N.WriteCloser).CloseWrite()
+	io.Copy(io.Discard, conn)
+	waitDone(t, done)
+}
+
+// warningLogger sends every warning to warnings and drops the other messages.
+type warningLogger struct {
+	logger.ContextLogger
+	warnings chan string
+}
+
+func (l *warningLogger) WarnContext(ctx context.Context, args ...any) {
+	l.warnings <- fmt.Sprint(args...)
+}
+
+// TestServiceDiagnosesIncompatibleClientHello warns in strict mode about authenticated clients that can not reach TLS 1.3.
+func TestServiceDiagnosesIncompatibleClientHello(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		clientHello []byte
+		warning     string
+	}{
+		{"TLS 1.3", testClientHello(t), ""},
+		{"TLS 1.2 only", captureClientHello(t, DefaultTLSHandshakeFunc(testPassword, &tls.Config{
+			ServerName:         testServerName,
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+		}), generateSessionID(testPassword)), "client does not offer TLS 1.3"},
+		{"no TLS 1.3 cipher suite", captureTemplateClientHello(t, newTestClient(t, ClientConfig{
+			ClientHelloSpec: &ClientHelloSpec{
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				Extensions: []ClientHelloExtension{
+					{Type: extensionSupportedVersions, Data: []byte{2, 0x03, 0x04}},
+				},
+			},
+		})), "client offers no TLS 1.3 cipher suite"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			warnings := &warningLogger{ContextLogger: logger.NOP(), warnings: make(chan string, 4)}
+			service := newTestService(t, ServiceConfig{Version: 3, StrictMode: true, Logger: warnings})
+			conn, done := serveTestConn(context.Background(), service)
+			_, err := conn.Write(testCase.clientHello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.(N.WriteCloser).CloseWrite()
+			io.Copy(io.Discard, conn)
+			conn.Close()
+			waitDone(t, done)
+			var warning string
+			select {
+			case warning = <-warnings.warnings:
+			default:
+			}
+			if testCase.warning == "" && warning != "" {
+				t.Fatal("unexpected warning: ", warning)
+			} else if !strings.Contains(warning, testCase.warning) {
+				t.Fatalf("warning %q, expected %q", warning, testCase.warning)
+			}
+		})
+	}
+}
+
+// readRecordingDialer keeps a copy of everything read from the connections it dials.
+type readRecordingDialer struct {
+	N.Dialer
+	access sync.Mutex
+	read   bytes.Buffer
+}
+
+type readRecordingConn struct {
+	net.Conn
+	dialer *readRecordingDialer
+}
+
+func (d *readRecordingDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &readRecordingConn{Conn: conn, dialer: d}, nil
+}
+
+func (c *readRecordingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.dialer.access.Lock()
+	c.dialer.read.Write(p[:n])
+	c.dialer.access.Unlock()
+	return
+}
+
+// splitRecords splits complete TLS records, a trailing partial record is dropped.
+func splitRecords(data []byte) [][]byte {
+	var records [][]byte
+	for len(data) >= tlsHeaderSize {
+		length := tlsHeaderSize + int(binary.BigEndian.Uint16(data[3:tlsHeaderSize]))
+		if len(data) < length {
+			break
+		}
+		records = append(records, data[:length])
+		data = data[length:]
+	}
+	return records
+}
+
+// TestServiceModifiesServerFlight relays a complete TLS 1.3 server flight and checks every record the client
+// receives against the records of the handshake server: application data, which carries EncryptedExtensions,
+// Certificate, CertificateVerify and Finished, is masked and prefixed with the chained HMAC, the rest passes unmodified.
+func TestServiceModifiesServerFlight(t *testing.T) {
+	dialer := &readRecordingDialer{Dialer: startHandshakeServer(t)}
+	var (
+		access  sync.Mutex
+		relayed [][]byte
+	)
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: dialer,
+		},
+	}, WithFrameDumper(func(direction string, frame []byte) {
+		if direction == FrameDirectionServer {
+			access.Lock()
+			relayed = append(relayed, frame)
+			access.Unlock()
+		}
+	}))
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{}))
+	testEcho(t, conn, []byte("ping"), false)
+
+	dialer.access.Lock()
+	original := splitRecords(dialer.read.Bytes())
+	dialer.access.Unlock()
+	access.Lock()
+	defer access.Unlock()
+	if len(original) == 0 || original[0][0] != handshake {
+		t.Fatal("missing ServerHello")
+	}
+	serverRandom := original[0][serverRandomIndex : serverRandomIndex+tlsRandomSize]
+	key := kdf(testPassword, serverRandom)
+	hmacWrite := hmac.New(sha1.New, []byte(testPassword))
+	hmacWrite.Write(serverRandom)
+	// the ServerHello is read before the relay starts and is not dumped
+	original = original[1:]
+	if len(relayed) > len(original) {
+		t.Fatalf("%d records relayed, %d read", len(relayed), len(original))
+	}
+	var modified int
+	for i, record := range relayed {
+		if original[i][0] != applicationData {
+			if !bytes.Equal(record, original[i]) {
+				t.Fatalf("record %d of type %d modified", i, original[i][0])
+			}
+			continue
+		}
+		payload := append([]byte(nil), original[i][tlsHeaderSize:]...)
+		xorSlice(payload, key)
+		hmacWrite.Write(payload)
+		expected := testRecord(applicationData, append(hmacWrite.Sum(nil)[:hmacSize], payload...))
+		if !bytes.Equal(record, expected) {
+			t.Fatalf("application data record %d not modified as expected", i)
+		}
+		modified++
+	}
+	if modified < 4 {
+		t.Fatalf("%d application data records modified, expected the whole encrypted flight", modified)
+	}
+}
+
+// TestServiceHandlerPanic recovers a panicking handler, closes its connection and keeps serving.
+func TestServiceHandlerPanic(t *testing.T) {
+	var panicked atomic.Bool
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+			if panicked.CompareAndSwap(false, true) {
+				panic("handler bug")
+			}
+			return echoHandler(ctx, conn, metadata)
+		}),
+	})
+	client := newTestClient(t, ClientConfig{})
+	conn, done := dialTestConn(t, service, client)
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(testDialTimeout))
+	_, err := conn.Read(make([]byte, 4))
+	if err == nil || E.IsTimeout(err) {
+		t.Fatal("connection of the panicking handler not closed: ", err)
+	}
+	err = waitDone(t, done)
+	if err == nil || !strings.Contains(err.Error(), "handler panic") {
+		t.Fatal("expected the panic as error, got ", err)
+	}
+	conn, _ = dialTestConn(t, service, client)
+	testEcho(t, conn, []byte("ping"), false)
+}
+
+// TestServiceMaxClientHelloSize closes a connection whose first record header claims an oversized ClientHello,
+// without waiting for its body.
+func TestServiceMaxClientHelloSize(t *testing.T) {
+	for _, testCase := range []struct {
+		version            int
+		maxClientHelloSize int
+		length             uint16
+	}{
+		{0, 0, DefaultMaxClientHelloSize + 1},
+		{2, 0, 0xffff},
+		{3, 0, DefaultMaxClientHelloSize + 1},
+		{3, 1024, 1025},
+	} {
+		service := newTestService(t, ServiceConfig{Version: testCase.version, MaxClientHelloSize: testCase.maxClientHelloSize})
+		conn, done := serveTestConn(context.Background(), service)
+		header := []byte{handshake, 3, 1, 0, 0}
+		binary.BigEndian.PutUint16(header[3:], testCase.length)
+		_, err := conn.Write(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waitDone(t, done) == nil {
+			t.Errorf("version %d: ClientHello of %d bytes accepted", testCase.version, testCase.length)
+		}
+		conn.Close()
+	}
+}
+
+type downgradeObserver struct {
+	nopObserver
+	downgrades atomic.Int32
+}
+
+func (o *downgradeObserver) TLS13Downgraded(ctx context.Context) {
+	o.downgrades.Add(1)
+}
+
+// TestServiceRequireTLS13 closes connections to a TLS 1.2 handshake server unless RequireTLS13 is set to false.
+func TestServiceRequireTLS13(t *testing.T) {
+	disabled := false
+	for _, requireTLS13 := range []*bool{nil, &disabled} {
+		observer := &downgradeObserver{}
+		service := newTestService(t, ServiceConfig{
+			Version: 3,
+			Handshake: HandshakeConfig{
+				Server: testHandshakeServer,
+				Dialer: startTLS12HandshakeServer(t),
+			},
+			RequireTLS13: requireTLS13,
+			Observer:     observer,
+		})
+		conn, done := serveTestConn(context.Background(), service)
+		ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+		_, err := newTestClient(t, ClientConfig{}).DialContextConn(ctx, conn)
+		cancel()
+		if requireTLS13 == nil {
+			if err == nil {
+				t.Fatal("client connected through a TLS 1.2 handshake")
+			}
+			if err = waitDone(t, done); !errors.Is(err, ErrTLS13Downgrade) || observer.downgrades.Load() != 1 {
+				t.Fatalf("service returned %v after %d downgrades", err, observer.downgrades.Load())
+			}
+		} else {
+			if !errors.Is(err, ErrTLS13Downgrade) {
+				t.Fatalf("client returned %v", err)
+			}
+			conn.Close()
+			if err = waitDone(t, done); errors.Is(err, ErrTLS13Downgrade) || observer.downgrades.Load() != 0 {
+				t.Fatalf("service returned %v after %d downgrades", err, observer.downgrades.Load())
+			}
+		}
+	}
+}
+
+type handshakeBytesObserver struct {
+	nopObserver
+	clientBytes chan int64
+}
+
+func (o *handshakeBytesObserver) HandshakeSucceeded(ctx context.Context, version int, clientBytes int64, serverBytes int64, cipherSuite uint16) {
+	o.clientBytes <- clientBytes
+}
+
+// TestServiceHandshakeBytes counts the client records relayed to the handshake server, without the records
+// read ahead together with the client Finished.
+func TestServiceHandshakeBytes(t *testing.T) {
+	payload := make([]byte, 3*maxRecordPayloadSize)
+	for _, readSize := range []int{0, readBatchSize} {
+		observer := &handshakeBytesObserver{clientBytes: make(chan int64, 1)}
+		service := newTestService(t, ServiceConfig{
+			Version:           3,
+			HandshakeReadSize: readSize,
+			Observer:          observer,
+		})
+		serverConn, _ := serveTestConn(context.Background(), service)
+		logConn := &writeLogConn{Conn: serverConn}
+		ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+		conn, err := newTestClient(t, ClientConfig{}).DialContextConnWithPayload(ctx, logConn, payload)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var clientBytes int64
+		select {
+		case clientBytes = <-observer.clientBytes:
+		case <-time.After(testDialTimeout):
+			t.Fatal("handshake not observed")
+		}
+		conn.Close()
+		logConn.access.Lock()
+		var expected int64
+		for _, write := range logConn.writes {
+			records := splitRecords(write)
+			finished := len(records) > 1
+			if finished {
+				// the client Finished, followed by the first data record
+				records = records[:len(records)-1]
+			}
+			for _, record := range records {
+				expected += int64(len(record))
+			}
+			if finished {
+				break
+			}
+		}
+		logConn.access.Unlock()
+		if clientBytes != expected {
+			t.Fatalf("read size %d: counted %d client bytes, relayed %d", readSize, clientBytes, expected)
+		}
+	}
+}
+
+// brokenWriteConn fails writes after the first one like a connection reset by a client that left,
+// while reads keep waiting for data.
+type brokenWriteConn struct {
+	net.Conn
+	written atomic.Bool
+}
+
+func (c *brokenWriteConn) Write(p []byte) (int, error) {
+	if c.written.Swap(true) {
+		return 0, syscall.ECONNRESET
+	}
+	return c.Conn.Write(p)
+}
+
+// TestServiceClientLeavesDuringServerFlight fails writing the server flight to the client while reading
+// from the client still blocks. The relay must close the handshake connection, release its buffers and
+// stop its goroutines.
+func TestServiceClientLeavesDuringServerFlight(t *testing.T) {
+	clientHello := testClientHello(t)
+	goroutines := runtime.NumGoroutine()
+	allocator := trackBuffers(t)
+	listener := memconn.NewListener()
+	defer listener.Close()
+	handshakeClosed := make(chan struct{})
+	go func() {
+		defer close(handshakeClosed)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		frame, err := extractFrame(conn)
+		if err != nil {
+			return
+		}
+		frame.Release()
+		_, err = conn.Write(testServerHello(testServerRandom, testExtension(extensionSupportedVersions, []byte{3, 4})))
+		record := testRecord(applicationData, make([]byte, 1024))
+		for err == nil {
+			_, err = conn.Write(record)
+		}
+	}()
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handshake: HandshakeConfig{
+			Server: testHandshakeServer,
+			Dialer: listener,
+		},
+	})
+	conn, serverConn := memconn.Pipe()
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.NewConnection(context.Background(), &brokenWriteConn{Conn: serverConn}, M.Metadata{
+			Source:      M.ParseSocksaddr("192.0.2.1:40000"),
+			Destination: M.ParseSocksaddr("198.51.100.1:443"),
+		})
+	}()
+	_, err := conn.Write(clientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waitDone(t, done) == nil {
+		t.Fatal("handshake relay succeeded without a client")
+	}
+	select {
+	case <-handshakeClosed:
+	case <-time.After(testDialTimeout):
+		t.Fatal("handshake connection not closed")
+	}
+	allocator.check(t, "server flight")
+	conn.Close()
+	deadline := time.Now().Add(testDialTimeout)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left, %d before", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// destinationDialer keeps the destinations of the connections it dials.
+type destinationDialer struct {
+	N.Dialer
+	destinations chan M.Socksaddr
+}
+
+func (d *destinationDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	d.destinations <- destination
+	return d.Dialer.DialContext(ctx, network, destination)
+}
+
+// TestServiceHandshakeOverride runs v3 handshakes with a handshake set by ContextWithHandshake. An override
+// without dialer uses the configured one, an override failing the configuration checks is ignored.
+func TestServiceHandshakeOverride(t *testing.T) {
+	destinations := make(chan M.Socksaddr, 1)
+	handshakeDialer := &destinationDialer{Dialer: startHandshakeServer(t), destinations: destinations}
+	failingDialer := &faultdialer.Dialer{Upstream: handshakeDialer}
+	failingDialer.FailDials.Store(math.MaxInt32)
+	overrideServer := M.ParseSocksaddrHostPort("front.example.org", 443)
+	for _, testCase := range []struct {
+		name          string
+		defaultDialer N.Dialer
+		override      HandshakeConfig
+		destination   M.Socksaddr
+		warning       bool
+	}{
+		{"override", failingDialer, HandshakeConfig{Server: overrideServer, Dialer: handshakeDialer}, overrideServer, false},
+		{"default dialer", handshakeDialer, HandshakeConfig{Server: overrideServer}, overrideServer, false},
+		{"link-local without zone", handshakeDialer, HandshakeConfig{Server: M.ParseSocksaddr("[fe80::1]:443"), Dialer: failingDialer}, testHandshakeServer, true},
+		{"missing server", handshakeDialer, HandshakeConfig{Dialer: failingDialer}, testHandshakeServer, true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			warnings := make(chan string, 1)
+			service := newTestService(t, ServiceConfig{
+				Version: 3,
+				Handshake: HandshakeConfig{
+					Server: testHandshakeServer,
+					Dialer: testCase.defaultDialer,
+				},
+				Logger: &warningLogger{ContextLogger: logger.NOP(), warnings: warnings},
+			})
+			conn, done := serveTestConn(ContextWithHandshake(context.Background(), testCase.override), service)
+			ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+			dataConn, err := newTestClient(t, ClientConfig{}).DialContextConn(ctx, conn)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testEcho(t, dataConn, []byte("override"), false)
+			dataConn.Close()
+			waitDone(t, done)
+			if destination := <-destinations; destination != testCase.destination {
+				t.Fatalf("dialed %s, expected %s", destination, testCase.destination)
+			}
+			select {
+			case warning := <-warnings:
+				if !testCase.warning {
+					t.Fatalf("unexpected warning: %s", warning)
+				}
+			default:
+				if testCase.warning {
+					t.Fatal("invalid override not logged")
+				}
+			}
+		})
+	}
+}
+
+// TestServiceAutoDetectsV2Users handles clients failing the v3 check as v2 when only Users are configured,
+// so that v2 clients of those users authenticate.
+func TestServiceAutoDetectsV2Users(t *testing.T) {
+	users := make(chan string, 1)
+	service := newTestService(t, ServiceConfig{
+		Users: []User{
+			{Name: "alice", Password: testPassword},
+			{Name: "bob", Password: "Qm7x_Vd2-Lp9Wc4t"},
+		},
+		Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+			user, _ := auth.UserFromContext[string](ctx)
+			users <- user
+			return echoHandler(ctx, conn, metadata)
+		}),
+	})
+	// DefaultTLSHandshakeFunc authenticates the ClientHello like v3, v2 clients run a plain handshake
+	v2Handshake := func(ctx context.Context, conn net.Conn, sessionIDGenerator TLSSessionIDGeneratorFunc) error {
+		return tls.Client(conn, &tls.Config{ServerName: testServerName, InsecureSkipVerify: true}).HandshakeContext(ctx)
+	}
+	for _, testCase := range []struct {
+		version   int
+		password  string
+		handshake TLSHandshakeFunc
+		user      string
+	}{
+		{2, "Qm7x_Vd2-Lp9Wc4t", v2Handshake, "bob"},
+		{3, testPassword, nil, "alice"},
+	} {
+		conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{
+			Version:      testCase.version,
+			Password:     testCase.password,
+			TLSHandshake: testCase.handshake,
+		}))
+		testEcho(t, conn, []byte("auto"), false)
+		if user := <-users; user != testCase.user {
+			t.Fatalf("v%d client authenticated as %q, expected %q", testCase.version, user, testCase.user)
+		}
+	}
+}
+
+// TestServiceCloseWrite sends a request body and half-closes like an upload, the handler only answers
+// after reading io.EOF, so the response arrives only if the half-close reached it.
+func TestServiceCloseWrite(t *testing.T) {
+	handler := handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+		defer conn.Close()
+		body, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write([]byte(fmt.Sprint("received ", len(body))))
+		return err
+	})
+	v2Handshake := func(ctx context.Context, conn net.Conn, sessionIDGenerator TLSSessionIDGeneratorFunc) error {
+		return tls.Client(conn, &tls.Config{ServerName: testServerName, InsecureSkipVerify: true}).HandshakeContext(ctx)
+	}
+	for _, testCase := range []struct {
+		name      string
+		version   int
+		handshake TLSHandshakeFunc
+		options   []Option
+	}{
+		{"v2", 2, v2Handshake, nil},
+		{"v3", 3, nil, nil},
+		{"v3 compression", 3, nil, []Option{WithCompression(true)}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			service := newTestService(t, ServiceConfig{
+				Version: testCase.version,
+				Handler: handler,
+			}, testCase.options...)
+			conn, done := dialTestConn(t, service, newTestClient(t, ClientConfig{
+				Version:      testCase.version,
+				TLSHandshake: testCase.handshake,
+			}, testCase.options...))
+			body := bytes.Repeat([]byte("body"), 10000)
+			_, err := conn.Write(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closer, isCloser := conn.(interface{ CloseWrite() error })
+			if !isCloser {
+				t.Fatalf("%T does not support CloseWrite", conn)
+			}
+			err = closer.CloseWrite()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(testDialTimeout))
+			response, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := fmt.Sprint("received ", len(body)); string(response) != expected {
+				t.Fatalf("received %q, expected %q", response, expected)
+			}
+			err = waitDone(t, done)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestServiceCheckHandshakeServerPool checks a handshake server without a dialer of its own,
+// which is valid when the HandshakePool dials it.
+func TestServiceCheckHandshakeServerPool(t *testing.T) {
+	pool := NewHandshakePool(HandshakePoolConfig{Dialer: startHandshakeServer(t)})
+	defer pool.Close()
+	service := newTestService(t, ServiceConfig{
+		Version:       3,
+		Handshake:     HandshakeConfig{Server: testHandshakeServer},
+		HandshakePool: pool,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+	defer cancel()
+	err := service.CheckHandshakeServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServiceHandshakeServerMapper checks that the mapper picks the handshake server for clients outside
+// AllowedSources too, and that a mapper without dialer is used when the HandshakePool dials.
+func TestServiceHandshakeServerMapper(t *testing.T) {
+	destinations := make(chan M.Socksaddr, 1)
+	handshakeDialer := &destinationDialer{Dialer: startHandshakeServer(t), destinations: destinations}
+	failingDialer := &faultdialer.Dialer{Upstream: handshakeDialer}
+	failingDialer.FailDials.Store(math.MaxInt32)
+	mappedServer := M.ParseSocksaddrHostPort("front.example.org", 443)
+	for _, testCase := range []struct {
+		name           string
+		allowedSources []netip.Prefix
+		pool           bool
+		mapperDialer   N.Dialer
+	}{
+		{"allowed source", nil, false, handshakeDialer},
+		{"disallowed source", []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}, false, handshakeDialer},
+		{"pool without dialer", nil, true, nil},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := ServiceConfig{
+				Version: 3,
+				Handshake: HandshakeConfig{
+					Server: testHandshakeServer,
+					Dialer: failingDialer,
+				},
+				HandshakeServerMapper: func(ctx context.Context, serverName string) (M.Socksaddr, N.Dialer) {
+					if serverName != testServerName {
+						return M.Socksaddr{}, nil
+					}
+					return mappedServer, testCase.mapperDialer
+				},
+				AllowedSources: testCase.allowedSources,
+			}
+			if testCase.pool {
+				pool := NewHandshakePool(HandshakePoolConfig{Dialer: handshakeDialer})
+				defer pool.Close()
+				config.HandshakePool = pool
+			}
+			service := newTestService(t, config)
+			conn, done := serveTestConn(context.Background(), service)
+			_, err := conn.Write(testClientHello(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case destination := <-destinations:
+				if destination != mappedServer {
+					t.Fatalf("dialed %s, expected %s", destination, mappedServer)
+				}
+			case <-time.After(testDialTimeout):
+				t.Fatal("mapped handshake server not dialed")
+			}
+			conn.Close()
+			waitDone(t, done)
+		})
+	}
+}
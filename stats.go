@@ -0,0 +1,34 @@
+package shadowtls
+
+import "sync/atomic"
+
+type Stats struct {
+	ActiveConnections        int64
+	HandshakesV1             uint64
+	HandshakesV2             uint64
+	HandshakesV3             uint64
+	Fallbacks                uint64
+	BytesRelayed             uint64 // data phase payload, of protocol version 1 only if an Observer is set
+	DataVerificationFailures uint64 // v3 data records that failed HMAC verification after the handshake
+}
+
+type serviceStats struct {
+	activeConnections        atomic.Int64
+	handshakes               [4]atomic.Uint64
+	fallbacks                atomic.Uint64
+	bytesRelayed             atomic.Uint64
+	dataVerificationFailures atomic.Uint64
+}
+
+// Stats returns a snapshot of the service counters, each counter is read separately.
+func (s *Service) Stats() Stats {
+	return Stats{
+		ActiveConnections:        s.stats.activeConnections.Load(),
+		HandshakesV1:             s.stats.handshakes[1].Load(),
+		HandshakesV2:             s.stats.handshakes[2].Load(),
+		HandshakesV3:             s.stats.handshakes[3].Load(),
+		Fallbacks:                s.stats.fallbacks.Load(),
+		BytesRelayed:             s.stats.bytesRelayed.Load(),
+		DataVerificationFailures: s.stats.dataVerificationFailures.Load(),
+	}
+}
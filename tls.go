@@ -10,6 +10,7 @@ type (
 	sTLSConn                 = sTLS.Conn
 	sTLSCurveID              = sTLS.CurveID
 	sTLSRenegotiationSupport = sTLS.RenegotiationSupport
+	sTLSAlertError           = sTLS.AlertError
 )
 
 var (
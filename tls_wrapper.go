@@ -18,27 +18,57 @@ type (
 	) error
 )
 
+// DefaultTLSHandshakeFunc applies the HandshakeOptions in its context, see ClientConfig.HandshakeOptionsAware.
 func DefaultTLSHandshakeFunc(password string, config *tls.Config) TLSHandshakeFunc {
 	return func(ctx context.Context, conn net.Conn, sessionIDGenerator TLSSessionIDGeneratorFunc) error {
+		verifyPeerCertificate := config.VerifyPeerCertificate
+		serverName := config.ServerName
+		minVersion := config.MinVersion
+		maxVersion := config.MaxVersion
+		grease := true
+		if options := HandshakeOptionsFromContext(ctx); options != nil {
+			if options.ServerName != "" {
+				serverName = options.ServerName
+			}
+			verifyPeerCertificate = options.verifyPeerCertificate(serverName, verifyPeerCertificate)
+			if options.MinVersion != 0 {
+				minVersion = options.MinVersion
+			}
+			if options.MaxVersion != 0 {
+				maxVersion = options.MaxVersion
+			}
+			if options.LegacyTLS12 {
+				maxVersion = tls.VersionTLS12
+			}
+			grease = !options.DisableGREASE
+		}
 		tlsConfig := &sTLSConfig{
 			Rand:                  config.Rand,
 			Time:                  config.Time,
-			VerifyPeerCertificate: config.VerifyPeerCertificate,
+			VerifyPeerCertificate: verifyPeerCertificate,
 			RootCAs:               config.RootCAs,
 			NextProtos:            config.NextProtos,
-			ServerName:            config.ServerName,
+			ServerName:            serverName,
 			InsecureSkipVerify:    config.InsecureSkipVerify,
 			CipherSuites:          config.CipherSuites,
-			MinVersion:            config.MinVersion,
-			MaxVersion:            config.MaxVersion,
+			MinVersion:            minVersion,
+			MaxVersion:            maxVersion,
 			CurvePreferences: common.Map(config.CurvePreferences, func(it tls.CurveID) sTLSCurveID {
 				return sTLSCurveID(it)
 			}),
 			SessionTicketsDisabled: config.SessionTicketsDisabled,
 			Renegotiation:          sTLSRenegotiationSupport(config.Renegotiation),
 			SessionIDGenerator:     generateSessionID(password),
+			GREASE:                 grease,
 		}
 		tlsConn := sTLSClient(conn, tlsConfig)
-		return tlsConn.HandshakeContext(ctx)
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return err
+		}
+		if state := HandshakeStateFromContext(ctx); state != nil {
+			state.NegotiatedProtocol = tlsConn.ConnectionState().NegotiatedProtocol
+		}
+		return nil
 	}
 }
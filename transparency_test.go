@@ -0,0 +1,74 @@
+package shadowtls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// transparencyPayloads returns payloads of every content kind at sizes around the record boundaries.
+func transparencyPayloads() [][]byte {
+	var payloads [][]byte
+	for _, size := range []int{1, 16383, 16384, 16385, 32768, 1024 * 1024} {
+		random := make([]byte, size)
+		rand.Read(random)
+		payloads = append(payloads, make([]byte, size), bytes.Repeat([]byte{0xFF}, size), random)
+	}
+	return payloads
+}
+
+// TestDataTransparency round-trips binary payloads through the echo handler,
+// so that every payload crosses the data channel in both directions.
+func TestDataTransparency(t *testing.T) {
+	payloads := transparencyPayloads()
+	for _, testCase := range []struct {
+		name    string
+		version int
+		options []Option
+	}{
+		{"v2", 2, nil},
+		{"v3", 3, nil},
+		{"v3 padding", 3, []Option{WithPadding(Padding{Threshold: 1024, MinSize: 512, MaxSize: 2048})}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			service := newTestService(t, ServiceConfig{Version: testCase.version}, testCase.options...)
+			conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{Version: testCase.version}, testCase.options...))
+			for i, payload := range payloads {
+				testEcho(t, conn, payload, i%2 == 1)
+			}
+		})
+	}
+}
+
+// testEcho writes payload, split into two buffers if vectorised, and reads it back.
+func testEcho(t *testing.T, conn net.Conn, payload []byte, vectorised bool) {
+	t.Helper()
+	writeErr := make(chan error, 1)
+	go func() {
+		writer, isVectorised := conn.(N.VectorisedWriter)
+		if !vectorised || !isVectorised {
+			_, err := conn.Write(payload)
+			writeErr <- err
+			return
+		}
+		half := len(payload) / 2
+		writeErr <- writer.WriteVectorised([]*buf.Buffer{buf.As(payload[:half]), buf.As(payload[half:])})
+	}()
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-writeErr
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("payload of %d bytes corrupted", len(payload))
+	}
+}
@@ -0,0 +1,38 @@
+package shadowtls
+
+import (
+	"context"
+	"net"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/uot"
+)
+
+// UoTHandler returns a Handler that serves UDP-over-TCP version 2 streams with udpHandler
+// and passes every other connection to handler.
+// The established connection is 8-bit clean, the UoT framing is carried as opaque payload.
+func UoTHandler(handler Handler, udpHandler N.UDPConnectionHandler) Handler {
+	return &uotHandler{
+		Handler:    handler,
+		udpHandler: udpHandler,
+	}
+}
+
+type uotHandler struct {
+	Handler
+	udpHandler N.UDPConnectionHandler
+}
+
+func (h *uotHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if metadata.Destination.Fqdn != uot.MagicAddress {
+		return h.Handler.NewConnection(ctx, conn, metadata)
+	}
+	request, err := uot.ReadRequest(conn)
+	if err != nil {
+		return E.Cause(err, "read UoT request")
+	}
+	metadata.Destination = request.Destination
+	return h.udpHandler.NewPacketConnection(ctx, uot.NewConn(conn, *request), metadata)
+}
@@ -0,0 +1,91 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/uot"
+)
+
+type udpEchoHandler struct{}
+
+func (udpEchoHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	defer conn.Close()
+	for {
+		buffer := buf.NewSize(65535)
+		destination, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return err
+		}
+		err = conn.WritePacket(buffer, destination)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (udpEchoHandler) NewError(ctx context.Context, err error) {
+}
+
+// TestUoTHandler sends packets looking like TLS records and their length prefixes through the record layer.
+func TestUoTHandler(t *testing.T) {
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handler: UoTHandler(handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+			t.Error("UoT stream passed to the TCP handler")
+			return conn.Close()
+		}), udpEchoHandler{}),
+	})
+	conn, done := serveTestConnTo(context.Background(), service, uot.RequestDestination(uot.Version))
+	ctx, cancel := context.WithTimeout(context.Background(), testDialTimeout)
+	defer cancel()
+	dataConn, err := newTestClient(t, ClientConfig{}).DialContextConn(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := M.ParseSocksaddr("203.0.113.1:53")
+	packetConn, err := (&uot.Client{}).DialConn(dataConn, false, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allBytes := make([]byte, 256)
+	for i := range allBytes {
+		allBytes[i] = byte(i)
+	}
+	large := make([]byte, 40000)
+	rand.Read(large)
+	for _, packet := range [][]byte{
+		{},
+		{applicationData, 0x03, 0x03, 0x00, 0x20},
+		{handshake, 0x03, 0x01, 0xFF, 0xFF},
+		allBytes,
+		bytes.Repeat([]byte{0xFF}, maxRecordPayloadSize+1),
+		large,
+	} {
+		err = packetConn.WritePacket(buf.As(append([]byte(nil), packet...)), destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := buf.NewSize(65535)
+		source, err := packetConn.ReadPacket(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != destination {
+			t.Fatal("unexpected source ", source)
+		}
+		if !bytes.Equal(buffer.Bytes(), packet) {
+			t.Fatalf("packet of %d bytes corrupted", len(packet))
+		}
+		buffer.Release()
+	}
+	dataConn.Close()
+	waitDone(t, done)
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"net"
+	"sync/atomic"
 
 	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
 )
 
-func copyUntilHandshakeFinished(dst io.Writer, src io.Reader) error {
+// copyUntilHandshakeFinished relays records until the second change_cipher_spec and the record after it,
+// adding the size of every relayed record to relayed.
+func copyUntilHandshakeFinished(dst io.Writer, src io.Reader, relayed *int64) error {
 	var hasSeenChangeCipherSpec bool
 	var tlsHdr [tlsHeaderSize]byte
 	for {
@@ -21,6 +26,7 @@ func copyUntilHandshakeFinished(dst io.Writer, src io.Reader) error {
 		if err != nil {
 			return err
 		}
+		*relayed += int64(tlsHeaderSize) + int64(length)
 		if tlsHdr[0] != handshake {
 			if tlsHdr[0] != changeCipherSpec {
 				return E.New("unexpected tls frame type: ", tlsHdr[0])
@@ -35,3 +41,39 @@ func copyUntilHandshakeFinished(dst io.Writer, src io.Reader) error {
 		}
 	}
 }
+
+// countingConn adds the bytes read and written after the v1 handshake to counter.
+// sing copy helpers unwrap it to the raw connection and count through its CountFuncs,
+// so splice and sendfile stay available.
+type countingConn struct {
+	net.Conn
+	counter *atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.counter.Add(uint64(n))
+	return
+}
+
+func (c *countingConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.counter.Add(uint64(n))
+	return
+}
+
+func (c *countingConn) count(n int64) {
+	c.counter.Add(uint64(n))
+}
+
+func (c *countingConn) UnwrapReader() (io.Reader, []N.CountFunc) {
+	return c.Conn, []N.CountFunc{c.count}
+}
+
+func (c *countingConn) UnwrapWriter() (io.Writer, []N.CountFunc) {
+	return c.Conn, []N.CountFunc{c.count}
+}
+
+func (c *countingConn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,143 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func tcpPipe(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("tcp listener unavailable: ", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestCountingConnUnwrap(t *testing.T) {
+	_, server := tcpPipe(t)
+	var counter atomic.Uint64
+	conn := &countingConn{Conn: server, counter: &counter}
+	reader, readCounters := N.UnwrapCountReader(conn, nil)
+	if _, isTCP := reader.(*net.TCPConn); !isTCP || len(readCounters) != 1 {
+		t.Fatalf("reader unwrapped to %T with %d counters", reader, len(readCounters))
+	}
+	writer, writeCounters := N.UnwrapCountWriter(conn, nil)
+	if _, isTCP := writer.(*net.TCPConn); !isTCP || len(writeCounters) != 1 {
+		t.Fatalf("writer unwrapped to %T with %d counters", writer, len(writeCounters))
+	}
+}
+
+func TestCountingConnCopyConn(t *testing.T) {
+	client, server := tcpPipe(t)
+	upstreamClient, upstreamServer := tcpPipe(t)
+	var counter atomic.Uint64
+	conn := &countingConn{Conn: server, counter: &counter}
+	copyDone := make(chan error, 1)
+	go func() {
+		copyDone <- bufio.CopyConn(context.Background(), conn, upstreamClient)
+	}()
+
+	request := make([]byte, 1<<20)
+	rand.Read(request)
+	response := make([]byte, 1<<19)
+	rand.Read(response)
+	go func() {
+		client.Write(request)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	received, err := io.ReadAll(upstreamServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, request) {
+		t.Fatal("request corrupted")
+	}
+	upstreamServer.Write(response)
+	upstreamServer.Close()
+	received, err = io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, response) {
+		t.Fatal("response corrupted")
+	}
+	<-copyDone
+	if total := counter.Load(); total != uint64(len(request)+len(response)) {
+		t.Fatalf("counted %d bytes, relayed %d", total, len(request)+len(response))
+	}
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ProbeFallback(ctx context.Context, reason FallbackReason) {}
+
+// TestServiceV1Stats counts the payload of protocol version 1 only for observed services,
+// other services hand the raw connection to the handler.
+func TestServiceV1Stats(t *testing.T) {
+	for _, observer := range []Observer{nil, nopObserver{}} {
+		var handlerConn net.Conn
+		service := newTestService(t, ServiceConfig{
+			Version: 1,
+			Handshake: HandshakeConfig{
+				Server: testHandshakeServer,
+				Dialer: startTLS12HandshakeServer(t),
+			},
+			Observer: observer,
+			Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+				handlerConn = conn
+				return echoHandler(ctx, conn, metadata)
+			}),
+		})
+		conn, done := dialTestConn(t, service, newTestClient(t, ClientConfig{
+			Version: 1,
+			TLSHandshake: DefaultTLSHandshakeFunc(testPassword, &tls.Config{
+				ServerName:         testServerName,
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+			}),
+		}))
+		payload := make([]byte, 100000)
+		rand.Read(payload)
+		testEcho(t, conn, payload, false)
+		conn.Close()
+		waitDone(t, done)
+		relayed := service.Stats().BytesRelayed
+		if observer == nil {
+			if _, isRaw := handlerConn.(*memconn.Conn); !isRaw || relayed != 0 {
+				t.Fatalf("unobserved service passed %T and counted %d bytes", handlerConn, relayed)
+			}
+		} else if relayed != uint64(2*len(payload)) {
+			t.Fatalf("counted %d bytes, relayed %d", relayed, 2*len(payload))
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
@@ -15,7 +16,9 @@ import (
 type shadowConn struct {
 	net.Conn
 	writer        N.VectorisedWriter
+	cache         *buf.Buffer
 	readRemaining int
+	bytesCounter  *atomic.Uint64
 }
 
 func newConn(conn net.Conn) *shadowConn {
@@ -25,23 +28,43 @@ func newConn(conn net.Conn) *shadowConn {
 	}
 }
 
+// newCachedConn returns data in cache before reading records from conn.
+// Deadlines are passed through to conn, so they never apply to cached data.
+func newCachedConn(conn net.Conn, cache *buf.Buffer) *shadowConn {
+	shadowConn := newConn(conn)
+	shadowConn.cache = cache
+	return shadowConn
+}
+
 func (c *shadowConn) Read(p []byte) (n int, err error) {
+	if c.cache != nil {
+		if !c.cache.IsEmpty() {
+			return c.cache.Read(p)
+		}
+		c.cache.Release()
+		c.cache = nil
+	}
 	if c.readRemaining > 0 {
 		if len(p) > c.readRemaining {
 			p = p[:c.readRemaining]
 		}
 		n, err = c.Conn.Read(p)
 		c.readRemaining -= n
+		c.countBytes(n)
 		return
 	}
 	var tlsHeader [5]byte
-	_, err = io.ReadFull(c.Conn, tlsHeader[:])
-	if err != nil {
-		return
-	}
-	length := int(binary.BigEndian.Uint16(tlsHeader[3:5]))
-	if tlsHeader[0] != 23 {
-		return 0, E.New("unexpected TLS record type: ", tlsHeader[0])
+	var length int
+	// skip empty records instead of returning 0, nil
+	for length == 0 {
+		_, err = io.ReadFull(c.Conn, tlsHeader[:])
+		if err != nil {
+			return
+		}
+		length = int(binary.BigEndian.Uint16(tlsHeader[3:5]))
+		if tlsHeader[0] != 23 {
+			return 0, E.New("unexpected TLS record type: ", tlsHeader[0])
+		}
 	}
 	readLen := len(p)
 	if readLen > length {
@@ -52,6 +75,7 @@ func (c *shadowConn) Read(p []byte) (n int, err error) {
 		return
 	}
 	c.readRemaining = length - n
+	c.countBytes(n)
 	return
 }
 
@@ -74,16 +98,46 @@ func (c *shadowConn) Write(p []byte) (n int, err error) {
 	if err == nil {
 		n += len(p)
 	}
+	c.countBytes(n)
 	return
 }
 
 func (c *shadowConn) WriteVectorised(buffers []*buf.Buffer) error {
+	dataLen := buf.LenMulti(buffers)
+	if dataLen > 16384 {
+		defer buf.ReleaseMulti(buffers)
+		for _, buffer := range buffers {
+			_, err := c.Write(buffer.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	var header [tlsHeaderSize]byte
 	header[0] = 23
-	dataLen := buf.LenMulti(buffers)
 	binary.BigEndian.PutUint16(header[1:3], tls.VersionTLS12)
 	binary.BigEndian.PutUint16(header[3:5], uint16(dataLen))
-	return c.writer.WriteVectorised(append([]*buf.Buffer{buf.As(header[:])}, buffers...))
+	err := c.writer.WriteVectorised(append([]*buf.Buffer{buf.As(header[:])}, buffers...))
+	if err == nil {
+		c.countBytes(dataLen)
+	}
+	return err
+}
+
+func (c *shadowConn) countBytes(n int) {
+	if c.bytesCounter != nil {
+		c.bytesCounter.Add(uint64(n))
+	}
+}
+
+// CloseWrite half-closes the underlying connection if supported and does nothing otherwise like the v3 wrappers,
+// v2 records carry no close_notify.
+func (c *shadowConn) CloseWrite() error {
+	if closer, isCloser := c.Conn.(interface{ CloseWrite() error }); isCloser {
+		return closer.CloseWrite()
+	}
+	return nil
 }
 
 func (c *shadowConn) NeedAdditionalReadDeadline() bool {
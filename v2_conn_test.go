@@ -0,0 +1,82 @@
+package shadowtls
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	"github.com/sagernet/sing/common/buf"
+)
+
+func TestCachedConnDeadline(t *testing.T) {
+	clientConn, serverConn := memconn.Pipe()
+	defer clientConn.Close()
+	cache := buf.New()
+	cache.WriteString("request")
+	conn := newCachedConn(serverConn, cache)
+	defer conn.Close()
+
+	err := conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request [4]byte
+	for _, expected := range []string{"requ", "est"} {
+		n, err := conn.Read(request[:])
+		if err != nil {
+			t.Fatal("cached read failed: ", err)
+		}
+		if string(request[:n]) != expected {
+			t.Fatalf("read %q, expected %q", request[:n], expected)
+		}
+	}
+	_, err = conn.Read(request[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline exceeded without cached data, got ", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	clientConn.Write(testRecord(applicationData, []byte("next")))
+	n, err := conn.Read(request[:])
+	if err != nil || string(request[:n]) != "next" {
+		t.Fatalf("read %q after clearing the deadline: %v", request[:n], err)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = conn.Write([]byte("response"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("write deadline not passed through: ", err)
+	}
+}
+
+func TestShadowConnSkipsZeroLengthRecords(t *testing.T) {
+	clientConn, serverConn := memconn.Pipe()
+	defer clientConn.Close()
+	conn := newConn(serverConn)
+	defer conn.Close()
+	go func() {
+		clientConn.Write(testRecord(applicationData, nil))
+		clientConn.Write(testRecord(applicationData, nil))
+		clientConn.Write(testRecord(applicationData, []byte("data")))
+	}()
+	var data [4]byte
+	n, err := conn.Read(data[:])
+	if err != nil || string(data[:n]) != "data" {
+		t.Fatalf("read %q after zero length records: %v", data[:n], err)
+	}
+}
+
+func TestShadowConnCloseWriteWithoutHalfClose(t *testing.T) {
+	clientConn, serverConn := memconn.Pipe()
+	defer clientConn.Close()
+	// hides CloseWrite of the pipe
+	conn := newConn(struct{ net.Conn }{serverConn})
+	defer conn.Close()
+	err := conn.CloseWrite()
+	if err != nil {
+		t.Fatal("CloseWrite without half-close support: ", err)
+	}
+}
@@ -1,6 +1,7 @@
 package shadowtls
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"hash"
@@ -32,41 +33,64 @@ func (c *hashReadConn) Sum() []byte {
 	return c.hmac.Sum(nil)[:8]
 }
 
+// hashWriteConn hashes the server records written to the client with the password of every user,
+// the client proves its password with the hash of the records it has seen.
 type hashWriteConn struct {
 	net.Conn
-	hmac       hash.Hash
+	hmacs      []hash.Hash
 	hasContent bool
-	lastSum    []byte
+	lastSums   [][]byte
 }
 
-func newHashWriteConn(conn net.Conn, password string) *hashWriteConn {
+func newHashWriteConn(conn net.Conn, passwords []string) *hashWriteConn {
+	hmacs := make([]hash.Hash, len(passwords))
+	for i, password := range passwords {
+		hmacs[i] = hmac.New(sha1.New, []byte(password))
+	}
 	return &hashWriteConn{
-		Conn: conn,
-		hmac: hmac.New(sha1.New, []byte(password)),
+		Conn:  conn,
+		hmacs: hmacs,
 	}
 }
 
 func (c *hashWriteConn) Write(p []byte) (n int, err error) {
-	if c.hmac != nil {
+	if c.hmacs != nil {
 		if c.hasContent {
-			c.lastSum = c.Sum()
+			c.lastSums = c.sums()
+		}
+		for _, hmac := range c.hmacs {
+			hmac.Write(p)
 		}
-		c.hmac.Write(p)
 		c.hasContent = true
 	}
 	return c.Conn.Write(p)
 }
 
-func (c *hashWriteConn) Sum() []byte {
-	return c.hmac.Sum(nil)[:8]
+func (c *hashWriteConn) sums() [][]byte {
+	sums := make([][]byte, len(c.hmacs))
+	for i, hmac := range c.hmacs {
+		sums[i] = hmac.Sum(nil)[:8]
+	}
+	return sums
 }
 
-func (c *hashWriteConn) LastSum() []byte {
-	return c.lastSum
+// Match returns the index of the password whose current or previous hash equals checksum, -1 if none does.
+func (c *hashWriteConn) Match(checksum []byte) int {
+	for i, sum := range c.sums() {
+		if bytes.Equal(checksum, sum) {
+			return i
+		}
+	}
+	for i, sum := range c.lastSums {
+		if bytes.Equal(checksum, sum) {
+			return i
+		}
+	}
+	return -1
 }
 
 func (c *hashWriteConn) Fallback() {
-	c.hmac = nil
+	c.hmacs = nil
 }
 
 func (c *hashWriteConn) HasContent() bool {
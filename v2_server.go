@@ -12,13 +12,21 @@ import (
 	"github.com/sagernet/sing/common/logger"
 )
 
-func copyUntilHandshakeFinishedV2(ctx context.Context, logger logger.ContextLogger, dst net.Conn, src io.Reader, hash *hashWriteConn, fallbackAfter int) (*buf.Buffer, error) {
+// copyUntilHandshakeFinishedV2 relays the client handshake until an application data record
+// starts with the HMAC of everything the handshake server sent so far, keyed by one of the passwords of hash,
+// and returns the index of that password. The size of every relayed record is added to relayed.
+//
+// The HMAC covers the server random of the relayed ServerHello, so an authenticator captured
+// from one connection never matches another handshake and replaying it only results in a fallback.
+// This is what v2 guarantees: the ClientHello itself is unauthenticated, and after the handshake
+// records are neither encrypted nor authenticated.
+func copyUntilHandshakeFinishedV2(ctx context.Context, logger logger.ContextLogger, dst net.Conn, src io.Reader, hash *hashWriteConn, fallbackAfter int, relayed *int64) (*buf.Buffer, int, error) {
 	var tlsHdr [tlsHeaderSize]byte
 	var applicationDataCount int
 	for {
 		_, err := io.ReadFull(src, tlsHdr[:])
 		if err != nil {
-			return nil, err
+			return nil, -1, err
 		}
 		length := binary.BigEndian.Uint16(tlsHdr[3:])
 		if tlsHdr[0] == applicationData {
@@ -26,21 +34,16 @@ func copyUntilHandshakeFinishedV2(ctx context.Context, logger logger.ContextLogg
 			_, err = data.ReadFullFrom(src, int(length))
 			if err != nil {
 				data.Release()
-				return nil, err
+				return nil, -1, err
 			}
 			if hash.HasContent() && length >= 8 {
-				checksum := hash.Sum()
-				if bytes.Equal(data.To(8), checksum) {
-					logger.TraceContext(ctx, "match current hashcode")
+				userIndex := hash.Match(data.To(8))
+				if userIndex >= 0 {
+					logger.TraceContext(ctx, "match hashcode")
 					data.Advance(8)
-					return data, nil
-				} else if hash.LastSum() != nil && bytes.Equal(data.To(8), hash.LastSum()) {
-					logger.TraceContext(ctx, "match last hashcode")
-					data.Advance(8)
-					return data, nil
-				} else {
-					logger.TraceContext(ctx, "hashcode mismatch")
+					return data, userIndex, nil
 				}
+				logger.TraceContext(ctx, "hashcode mismatch")
 			}
 			_, err = io.Copy(dst, io.MultiReader(bytes.NewReader(tlsHdr[:]), data))
 			data.Release()
@@ -49,10 +52,11 @@ func copyUntilHandshakeFinishedV2(ctx context.Context, logger logger.ContextLogg
 			_, err = io.Copy(dst, io.MultiReader(bytes.NewReader(tlsHdr[:]), io.LimitReader(src, int64(length))))
 		}
 		if err != nil {
-			return nil, err
+			return nil, -1, err
 		}
+		*relayed += int64(tlsHeaderSize) + int64(length)
 		if applicationDataCount > fallbackAfter {
-			return nil, os.ErrPermission
+			return nil, -1, os.ErrPermission
 		}
 	}
 }
@@ -16,33 +16,44 @@ import (
 )
 
 func generateSessionID(password string) func(clientHello []byte, sessionID []byte) error {
+	return defaultHMACLayout.generateSessionID(password)
+}
+
+func (l hmacLayout) generateSessionID(password string) func(clientHello []byte, sessionID []byte) error {
 	return func(clientHello []byte, sessionID []byte) error {
 		const sessionIDStart = 1 + 3 + 2 + tlsRandomSize + 1
-		if len(clientHello) < sessionIDStart+tlsSessionIDSize {
+		if len(clientHello) < sessionIDStart+l.sessionIDLength || len(sessionID) != l.sessionIDLength {
 			return E.New("unexpected client hello length")
 		}
-		_, err := rand.Read(sessionID[:tlsSessionIDSize-hmacSize])
+		_, err := rand.Read(sessionID)
 		if err != nil {
 			return err
 		}
+		hmacBytes := sessionID[l.hmacOffset : l.hmacOffset+hmacSize]
+		for i := range hmacBytes {
+			hmacBytes[i] = 0
+		}
 		hmacSHA1Hash := hmac.New(sha1.New, []byte(password))
 		hmacSHA1Hash.Write(clientHello[:sessionIDStart])
 		hmacSHA1Hash.Write(sessionID)
-		hmacSHA1Hash.Write(clientHello[sessionIDStart+tlsSessionIDSize:])
-		copy(sessionID[tlsSessionIDSize-hmacSize:], hmacSHA1Hash.Sum(nil)[:hmacSize])
+		hmacSHA1Hash.Write(clientHello[sessionIDStart+l.sessionIDLength:])
+		copy(hmacBytes, hmacSHA1Hash.Sum(nil)[:hmacSize])
 		return nil
 	}
 }
 
 type streamWrapper struct {
 	net.Conn
-	password     string
-	buffer       *buf.Buffer
-	serverRandom []byte
-	readHMAC     hash.Hash
-	readHMACKey  []byte
-	isTLS13      bool
-	authorized   bool
+	password      string
+	buffer        *buf.Buffer
+	serverRandom  []byte
+	readHMAC      hash.Hash
+	readHMACKey   []byte
+	isTLS13       bool
+	authorized    bool
+	onServerHello func(frame []byte)
+	holdWrites    bool
+	held          []byte
 }
 
 func newStreamWrapper(conn net.Conn, password string) *streamWrapper {
@@ -76,23 +87,69 @@ func (w *streamWrapper) Read(p []byte) (n int, err error) {
 	if err != nil {
 		return
 	}
+	w.inspectRecord()
+	return w.buffer.Read(p)
+}
+
+// Write holds the client flight sent after the authorized TLS 1.3 server Finished if holdWrites is set,
+// so that it can be sent together with the first data record.
+func (w *streamWrapper) Write(p []byte) (n int, err error) {
+	if w.holdWrites && w.isTLS13 && w.authorized {
+		w.held = append(w.held, p...)
+		return len(p), nil
+	}
+	return w.Conn.Write(p)
+}
+
+// writePayload writes the held handshake flight and the first record of payload at once,
+// unless payload passes through another layer or spans several records.
+func writePayload(conn net.Conn, verifiedConn *verifiedConn, dataConn net.Conn, held []byte, payload []byte) error {
+	if dataConn == net.Conn(verifiedConn) {
+		firstRecord := payload
+		if len(firstRecord) > verifiedConn.writeChunkSize {
+			firstRecord = firstRecord[:verifiedConn.writeChunkSize]
+		}
+		_, err := verifiedConn.writeWithPrefix(held, firstRecord)
+		if err != nil {
+			return err
+		}
+		payload = payload[len(firstRecord):]
+	} else if len(held) > 0 {
+		_, err := conn.Write(held)
+		if err != nil {
+			return err
+		}
+	}
+	if len(payload) > 0 {
+		_, err := dataConn.Write(payload)
+		return err
+	}
+	return nil
+}
+
+// inspectRecord extracts the server random from the ServerHello and
+// restores authenticated application data records in w.buffer.
+func (w *streamWrapper) inspectRecord() {
 	buffer := w.buffer.Bytes()
-	switch tlsHeader[0] {
+	switch buffer[0] {
 	case handshake:
 		if len(buffer) > serverRandomIndex+tlsRandomSize && buffer[5] == serverHello {
+			if w.onServerHello != nil {
+				w.onServerHello(append([]byte(nil), buffer...))
+			}
 			w.serverRandom = make([]byte, tlsRandomSize)
 			copy(w.serverRandom, buffer[serverRandomIndex:serverRandomIndex+tlsRandomSize])
 			w.readHMAC = hmac.New(sha1.New, []byte(w.password))
 			w.readHMAC.Write(w.serverRandom)
 			w.readHMACKey = kdf(w.password, w.serverRandom)
-			w.isTLS13 = isServerHelloSupportTLS13(buffer[5:])
+			w.isTLS13 = isServerHelloSupportTLS13(buffer)
 			if !w.isTLS13 {
 				w.authorized = true
 			}
 		}
 	case applicationData:
 		w.authorized = false
-		if len(buffer) > tlsHmacHeaderSize && w.readHMAC != nil {
+		if len(buffer) >= tlsHmacHeaderSize && w.readHMAC != nil {
 			w.readHMAC.Write(buffer[tlsHmacHeaderSize:])
 			if hmac.Equal(w.readHMAC.Sum(nil)[:hmacSize], buffer[tlsHeaderSize:tlsHmacHeaderSize]) {
 				xorSlice(buffer[tlsHmacHeaderSize:], w.readHMACKey)
@@ -103,9 +160,12 @@ func (w *streamWrapper) Read(p []byte) (n int, err error) {
 			}
 		}
 	}
-	return w.buffer.Read(p)
 }
 
+// KDFKeySize is the length of the key that masks relayed server application data in protocol version 3.
+const KDFKeySize = sha256.Size
+
+// kdf derives the mask key as SHA-256(password || serverRandom).
 func kdf(password string, serverRandom []byte) []byte {
 	hasher := sha256.New()
 	hasher.Write([]byte(password))
@@ -113,6 +173,8 @@ func kdf(password string, serverRandom []byte) []byte {
 	return hasher.Sum(nil)
 }
 
+// xorSlice repeats key over data, byte i is XORed with key[i%len(key)].
+// The position restarts at zero for every record payload.
 func xorSlice(data []byte, key []byte) {
 	for i := range data {
 		data[i] ^= key[i%len(key)]
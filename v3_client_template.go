@@ -0,0 +1,213 @@
+package shadowtls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+
+	"github.com/sagernet/sing-shadowtls/internal/mlkem768"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// hybrid key exchange groups, the ML-KEM-768 encapsulation key comes first in X25519MLKEM768 and last in the draft
+const (
+	groupX25519MLKEM768        = 0x11ec
+	groupX25519Kyber768Draft00 = 0x6399
+)
+
+// helloRetryRequestRandom is the fixed random of a HelloRetryRequest, RFC 8446 section 4.1.3.
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+func validateClientHelloTemplate(template []byte, requireTLS13 bool) error {
+	if len(template) < sessionIDLengthIndex+1+tlsSessionIDSize {
+		return E.New("too short")
+	} else if template[0] != handshake {
+		return E.New("unexpected record type: ", template[0])
+	} else if template[5] != clientHello {
+		return E.New("unexpected handshake type: ", template[5])
+	} else if int(binary.BigEndian.Uint16(template[3:tlsHeaderSize])) != len(template)-tlsHeaderSize {
+		return E.New("record length mismatch")
+	} else if int(template[6])<<16|int(template[7])<<8|int(template[8]) != len(template)-tlsHeaderSize-4 {
+		return E.New("handshake length mismatch, the ClientHello must fit in one record")
+	} else if template[sessionIDLengthIndex] != tlsSessionIDSize {
+		return E.New("session id length must be ", tlsSessionIDSize)
+	}
+	data := template[sessionIDLengthIndex+1+tlsSessionIDSize:]
+	if len(data) < 2 {
+		return E.New("missing cipher suites")
+	}
+	cipherSuitesLength := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+cipherSuitesLength+1 {
+		return E.New("truncated cipher suites")
+	}
+	data = data[2+cipherSuitesLength:]
+	compressionMethodsLength := int(data[0])
+	if len(data) < 1+compressionMethodsLength+2 {
+		return E.New("missing extensions")
+	}
+	data = data[1+compressionMethodsLength:]
+	extensionsLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != extensionsLength {
+		return E.New("extensions length mismatch")
+	}
+	var supportTLS13 bool
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return E.New("truncated extension")
+		}
+		extensionType := binary.BigEndian.Uint16(data)
+		extensionLength := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < extensionLength {
+			return E.New("truncated extension")
+		}
+		if extensionType == extensionSupportedVersions && extensionLength > 0 {
+			versions := data[1:extensionLength]
+			for len(versions) >= 2 {
+				if binary.BigEndian.Uint16(versions) == versionTLS13 {
+					supportTLS13 = true
+				}
+				versions = versions[2:]
+			}
+		}
+		data = data[extensionLength:]
+	}
+	if requireTLS13 && !supportTLS13 {
+		return E.New("TLS 1.3 not offered in supported_versions")
+	}
+	return nil
+}
+
+// refreshClientHello replaces the random and the key shares of a validated ClientHello record,
+// so that connections from one template can not be linked by them. Key shares of other groups are kept.
+func refreshClientHello(frame []byte) error {
+	_, err := rand.Read(frame[tlsHeaderSize+4+2 : tlsHeaderSize+4+2+tlsRandomSize])
+	if err != nil {
+		return err
+	}
+	keyShares := findClientHelloExtension(frame, extensionKeyShare)
+	if len(keyShares) < 2 {
+		return nil
+	}
+	keyShares = keyShares[2:]
+	for len(keyShares) >= 4 {
+		group := binary.BigEndian.Uint16(keyShares)
+		length := int(binary.BigEndian.Uint16(keyShares[2:]))
+		keyShares = keyShares[4:]
+		if len(keyShares) < length {
+			return E.New("truncated key share")
+		}
+		keyShare, err := newKeyShare(group)
+		if err != nil {
+			return E.Cause(err, "generate key share")
+		}
+		if len(keyShare) == length {
+			copy(keyShares, keyShare)
+		}
+		keyShares = keyShares[length:]
+	}
+	return nil
+}
+
+// findClientHelloExtension returns the data of an extension of a validated ClientHello record, nil if missing.
+func findClientHelloExtension(frame []byte, extensionType uint16) []byte {
+	data := frame[sessionIDLengthIndex+1+int(frame[sessionIDLengthIndex]):]
+	data = data[2+int(binary.BigEndian.Uint16(data)):]
+	data = data[1+int(data[0])+2:]
+	for len(data) >= 4 {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if binary.BigEndian.Uint16(data) == extensionType {
+			return data[4 : 4+length]
+		}
+		data = data[4+length:]
+	}
+	return nil
+}
+
+// newKeyShare returns a fresh public key of group, nil for groups a template keeps.
+func newKeyShare(group uint16) ([]byte, error) {
+	switch group {
+	case uint16(tls.X25519):
+		return newECDHKeyShare(ecdh.X25519())
+	case uint16(tls.CurveP256):
+		return newECDHKeyShare(ecdh.P256())
+	case uint16(tls.CurveP384):
+		return newECDHKeyShare(ecdh.P384())
+	case uint16(tls.CurveP521):
+		return newECDHKeyShare(ecdh.P521())
+	case groupX25519MLKEM768, groupX25519Kyber768Draft00:
+		decapsulationKey, err := mlkem768.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		x25519KeyShare, err := newECDHKeyShare(ecdh.X25519())
+		if err != nil {
+			return nil, err
+		}
+		if group == groupX25519MLKEM768 {
+			return append(decapsulationKey.EncapsulationKey(), x25519KeyShare...), nil
+		}
+		return append(x25519KeyShare, decapsulationKey.EncapsulationKey()...), nil
+	default:
+		return nil, nil
+	}
+}
+
+func newECDHKeyShare(curve ecdh.Curve) ([]byte, error) {
+	privateKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.PublicKey().Bytes(), nil
+}
+
+// handshakeWithTemplate sends the ClientHello template with the session id HMAC in place of a
+// TLS handshake, and reads the server flight until the client is authorized.
+// The handshake is never finished, the first data record takes the place of the client Finished.
+// It returns after the first application data record, the rest of the encrypted flight is left to the data phase.
+func (c *Client) handshakeWithTemplate(conn net.Conn, stream *streamWrapper) error {
+	clientHelloFrame := make([]byte, len(c.clientHelloTemplate))
+	copy(clientHelloFrame, c.clientHelloTemplate)
+	err := refreshClientHello(clientHelloFrame)
+	if err != nil {
+		return err
+	}
+	sessionID := clientHelloFrame[sessionIDLengthIndex+1 : sessionIDLengthIndex+1+tlsSessionIDSize]
+	copy(sessionID, make([]byte, tlsSessionIDSize))
+	err = generateSessionID(c.password)(clientHelloFrame[tlsHeaderSize:], sessionID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(clientHelloFrame)
+	if err != nil {
+		return E.Cause(err, "write client hello")
+	}
+	for {
+		stream.buffer, err = extractFrame(conn)
+		if err != nil {
+			return E.Cause(err, "read server handshake")
+		}
+		recordType := stream.buffer.Byte(0)
+		stream.inspectRecord()
+		stream.buffer.Release()
+		stream.buffer = nil
+		if stream.serverRandom == nil {
+			continue
+		}
+		if bytes.Equal(stream.serverRandom, helloRetryRequestRandom) {
+			return E.New("handshake server requested a HelloRetryRequest, which the ClientHello template can not answer")
+		}
+		if !stream.isTLS13 || recordType == applicationData {
+			return nil
+		}
+	}
+}
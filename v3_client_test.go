@@ -0,0 +1,162 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+)
+
+// TestMaskKeyGolden locks the mask key derivation and its cyclic application for other implementations.
+func TestMaskKeyGolden(t *testing.T) {
+	key := kdf(testPassword, testServerRandom)
+	if len(key) != KDFKeySize {
+		t.Fatalf("key size %d, expected %d", len(key), KDFKeySize)
+	}
+	if hex.EncodeToString(key) != "2aa4babc74672cc4c00b429789371d888e202cf06b4abbb4341fe4a8953b0973" {
+		t.Fatalf("unexpected key %x", key)
+	}
+	body := make([]byte, 70)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	xorSlice(body, key)
+	expected, _ := hex.DecodeString("2aa5b8bf70622ac3c802489c853a13879e313ee37f5fada32c06feb38926176c" +
+		"0a85989f50420ae3e82268bca51a33a7be111ec35f7f8d830c26de93a906374c6ae5f8ff3022")
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("unexpected masked body %x", body)
+	}
+}
+
+// captureTemplateClientHello returns the first record client writes.
+func captureTemplateClientHello(t *testing.T, client *Client) []byte {
+	t.Helper()
+	clientConn, serverConn := memconn.Pipe()
+	defer serverConn.Close()
+	go func() {
+		client.DialContextConn(context.Background(), clientConn)
+		clientConn.Close()
+	}()
+	frame, err := extractFrame(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer frame.Release()
+	return append([]byte(nil), frame.Bytes()...)
+}
+
+// testKeyShares returns the groups and the key shares of a ClientHello record.
+func testKeyShares(t *testing.T, frame []byte) ([]uint16, [][]byte) {
+	t.Helper()
+	data := findClientHelloExtension(frame, extensionKeyShare)
+	if len(data) < 2 {
+		t.Fatal("missing key_share")
+	}
+	var groups []uint16
+	var keyShares [][]byte
+	for data = data[2:]; len(data) >= 4; {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		groups = append(groups, binary.BigEndian.Uint16(data))
+		keyShares = append(keyShares, data[4:4+length])
+		data = data[4+length:]
+	}
+	return groups, keyShares
+}
+
+func TestClientHelloTemplateRefresh(t *testing.T) {
+	template := testClientHello(t)
+	templateGroups, _ := testKeyShares(t, template)
+	if len(templateGroups) == 0 {
+		t.Fatal("template without key shares")
+	}
+	for _, config := range []ClientConfig{
+		{ClientHelloTemplate: template},
+		{ClientHelloSpec: &ClientHelloSpec{
+			Random:       bytes.Repeat([]byte{1}, tlsRandomSize),
+			CipherSuites: []uint16{0x1301},
+			Extensions: []ClientHelloExtension{
+				{Type: extensionSupportedVersions, Data: []byte{2, 0x03, 0x04}},
+				{Type: extensionKeyShare, Data: append([]byte{0, 36, 0x00, 0x1d, 0, 32}, make([]byte, 32)...)},
+			},
+		}},
+	} {
+		client := newTestClient(t, config)
+		first := captureTemplateClientHello(t, client)
+		second := captureTemplateClientHello(t, client)
+		for _, frame := range [][]byte{first, second} {
+			_, err := verifyClientHello(frame, []User{{Password: testPassword}})
+			if err != nil {
+				t.Fatal("refreshed client hello does not authenticate: ", err)
+			}
+		}
+		randomRange := first[tlsHeaderSize+4+2 : tlsHeaderSize+4+2+tlsRandomSize]
+		if bytes.Equal(randomRange, second[tlsHeaderSize+4+2:tlsHeaderSize+4+2+tlsRandomSize]) {
+			t.Error("random not refreshed")
+		}
+		firstGroups, firstKeyShares := testKeyShares(t, first)
+		_, secondKeyShares := testKeyShares(t, second)
+		for i, group := range firstGroups {
+			if len(firstKeyShares[i]) > 1 && bytes.Equal(firstKeyShares[i], secondKeyShares[i]) {
+				t.Errorf("key share of group %#x not refreshed", group)
+			}
+		}
+	}
+}
+
+// TestClientHelloTemplateDial runs the data phase after a refreshed template against the handshake server.
+func TestClientHelloTemplateDial(t *testing.T) {
+	service := newTestService(t, ServiceConfig{Version: 3})
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{ClientHelloTemplate: testClientHello(t)}))
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || string(response) != "ping" {
+		t.Fatal("echo failed: ", err)
+	}
+}
+
+// TestClientHelloSpecBytes checks the ClientHello sent for a spec byte by byte, except the random
+// and the session id carrying the HMAC.
+func TestClientHelloSpecBytes(t *testing.T) {
+	client := newTestClient(t, ClientConfig{
+		ClientHelloSpec: &ClientHelloSpec{
+			CipherSuites: []uint16{0x1301},
+			Extensions: []ClientHelloExtension{
+				{Type: 0x0a0a},
+				{Type: 0xff01, Data: []byte{0}},
+				{Type: extensionSupportedVersions, Data: []byte{2, 0x03, 0x04}},
+			},
+		},
+	})
+	frame := captureTemplateClientHello(t, client)
+	randomIndex := tlsHeaderSize + 4 + 2
+	if len(frame) < sessionIDLengthIndex+1+tlsSessionIDSize {
+		t.Fatalf("short ClientHello %x", frame)
+	}
+	expected, _ := hex.DecodeString("160301005f" + "0100005b" + "0303" +
+		hex.EncodeToString(frame[randomIndex:randomIndex+tlsRandomSize]) +
+		"20" + hex.EncodeToString(frame[sessionIDLengthIndex+1:sessionIDLengthIndex+1+tlsSessionIDSize]) +
+		"00021301" + "0100" + "0010" + "0a0a0000" + "ff01000100" + "002b0003020304")
+	if !bytes.Equal(frame, expected) {
+		t.Fatalf("ClientHello %x, expected %x", frame, expected)
+	}
+	_, err := verifyClientHello(frame, []User{{Password: testPassword}})
+	if err != nil {
+		t.Fatal("session id not authenticated: ", err)
+	}
+	_, err = NewClient(ClientConfig{
+		Version:         3,
+		Password:        testPassword,
+		ClientHelloSpec: &ClientHelloSpec{CipherSuites: []uint16{0x1301}},
+	})
+	if err == nil {
+		t.Fatal("spec without TLS 1.3 accepted")
+	}
+}
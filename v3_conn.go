@@ -2,29 +2,69 @@ package shadowtls
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
+	"encoding/hex"
 	"hash"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/debug"
 	E "github.com/sagernet/sing/common/exceptions"
 	N "github.com/sagernet/sing/common/network"
 )
 
+var defaultRecordVersion = [2]byte{3, 3}
+
+// reusedReadBufferSize fits the largest TLS 1.3 record, larger records get their own buffer.
+const reusedReadBufferSize = tlsHeaderSize + maxRecordPayloadSize + 256
+
 type verifiedConn struct {
 	net.Conn
-	writer           N.ExtendedWriter
-	vectorisedWriter N.VectorisedWriter
-	access           sync.Mutex
-	hmacAdd          hash.Hash
-	hmacVerify       hash.Hash
-	hmacIgnore       hash.Hash
-	buffer           *buf.Buffer
+	reader            io.Reader
+	writer            N.ExtendedWriter
+	vectorisedWriter  N.VectorisedWriter
+	access            sync.Mutex
+	readAccess        sync.Mutex
+	hmacAdd           hash.Hash
+	hmacVerify        hash.Hash
+	hmacIgnore        hash.Hash
+	buffer            *buf.Buffer
+	transport         FrameTransport
+	pacer             *pacer
+	idleTimer         *idleTimer
+	keepAlive         *keepAlive
+	sampler           *throughputSampler
+	bytesCounter      *atomic.Uint64
+	broken            atomic.Bool
+	readClosed        bool
+	writeClosed       bool
+	closeRecord       bool
+	closed            bool
+	recordVersion     [2]byte
+	maxRecordSize     int
+	writeChunkSize    int
+	recordLimiter     *recordLimiter
+	onVerifyFailure   func()
+	frameDumper       FrameDumper
+	rekeyBytes        int64
+	writtenSinceRekey int64
+	reuseReadBuffer   bool
+	readBuffer        *buf.Buffer
+	manualDeadline    bool
+	firstByte         *firstByteTimer
+	padder            *padder
+	writeSum          [sha1.Size]byte
+	readSum           [sha1.Size]byte
 }
 
 func newVerifiedConn(
@@ -35,78 +75,236 @@ func newVerifiedConn(
 ) *verifiedConn {
 	return &verifiedConn{
 		Conn:             conn,
+		reader:           newBatchReader(conn, readBatchSize),
 		writer:           bufio.NewExtendedWriter(conn),
 		vectorisedWriter: bufio.NewVectorisedWriter(conn),
 		hmacAdd:          hmacAdd,
 		hmacVerify:       hmacVerify,
 		hmacIgnore:       hmacIgnore,
+		recordVersion:    defaultRecordVersion,
+		writeChunkSize:   maxRecordPayloadSize,
+	}
+}
+
+// NewVerifiedConn wraps conn as a protocol version 3 data phase connection that has not exchanged records yet.
+// The client writes with the "C" chain and reads the "S" chain, the server the opposite, both keyed by
+// the password of the respective writer and the server random of the relayed ServerHello. Options apply the data phase features.
+func NewVerifiedConn(conn net.Conn, readPassword string, writePassword string, serverRandom []byte, isClient bool, options ...Option) (net.Conn, error) {
+	if readPassword == "" || writePassword == "" {
+		return nil, E.New("missing password")
+	}
+	if len(serverRandom) != tlsRandomSize {
+		return nil, E.New("invalid server random length: ", len(serverRandom))
+	}
+	writeRole, readRole := "S", "C"
+	if isClient {
+		writeRole, readRole = "C", "S"
+	}
+	features := newFeatures(Features{}, options)
+	hmacAdd := hmac.New(sha1.New, []byte(writePassword))
+	hmacAdd.Write(serverRandom)
+	hmacAdd.Write(features.chainRole(writeRole))
+	hmacVerify := hmac.New(sha1.New, []byte(readPassword))
+	hmacVerify.Write(serverRandom)
+	hmacVerify.Write(features.chainRole(readRole))
+	verifiedConn := newVerifiedConn(conn, hmacAdd, hmacVerify, nil)
+	features.setupConn(verifiedConn, conn)
+	return features.wrapConn(verifiedConn), nil
+}
+
+// Reset reinitializes the connection over conn with fresh HMAC state, so the struct can be reused
+// after the previous underlying connection is recycled. Configured options are kept.
+// It must not be called while a Read or Write is in progress.
+func (c *verifiedConn) Reset(conn net.Conn, hmacAdd hash.Hash, hmacVerify hash.Hash, hmacIgnore hash.Hash) {
+	if c.keepAlive != nil {
+		c.keepAlive.stop()
+	}
+	if c.buffer != nil {
+		c.releaseBuffer()
+	}
+	if c.readBuffer != nil {
+		c.readBuffer.Release()
+		c.readBuffer = nil
+	}
+	c.Conn = conn
+	if reader, isBatchReader := c.reader.(*batchReader); isBatchReader {
+		reader.reset(conn)
+	} else {
+		c.reader = newBatchReader(conn, readBatchSize)
+	}
+	c.writer = bufio.NewExtendedWriter(conn)
+	c.vectorisedWriter = bufio.NewVectorisedWriter(conn)
+	c.hmacAdd = hmacAdd
+	c.hmacVerify = hmacVerify
+	c.hmacIgnore = hmacIgnore
+	c.broken.Store(false)
+	c.readClosed = false
+	c.writeClosed = false
+	c.closed = false
+	c.writtenSinceRekey = 0
+	c.firstByte = nil
+	if c.idleTimer != nil {
+		timeout := c.idleTimer.timeout
+		c.idleTimer.stop()
+		c.idleTimer = newIdleTimer(c.idleTimer.clock, timeout, func() {
+			conn.Close()
+		})
+	}
+	if c.keepAlive != nil {
+		c.keepAlive = newKeepAlive(c.keepAlive.clock, c.keepAlive.interval, c.writeKeepAlive)
 	}
 }
 
+// Read holds readAccess, so that Close does not release the buffers under a Read.
 func (c *verifiedConn) Read(b []byte) (n int, err error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.read(b)
+}
+
+func (c *verifiedConn) read(b []byte) (n int, err error) {
+	if c.readClosed {
+		return 0, io.EOF
+	}
 	if c.buffer != nil {
 		if !c.buffer.IsEmpty() {
 			return c.buffer.Read(b)
 		}
-		c.buffer.Release()
-		c.buffer = nil
+		c.releaseBuffer()
 	}
 	for {
-		var tlsHeader [tlsHeaderSize]byte
-		_, err = io.ReadFull(c.Conn, tlsHeader[:])
-		if err != nil {
+		c.buffer, err = c.readFrame()
+		if err == io.EOF {
+			if c.closeRecord {
+				// anyone on the path can end the stream, only a close record means the data is complete
+				c.broken.Store(true)
+				return 0, io.ErrUnexpectedEOF
+			}
+			// the peer closed its write side between records
+			c.readClosed = true
+			return
+		} else if err != nil {
+			c.broken.Store(true)
 			sendAlert(c.Conn)
 			return
 		}
-		length := int(binary.BigEndian.Uint16(tlsHeader[3:tlsHeaderSize]))
-		c.buffer = buf.NewSize(tlsHeaderSize + length)
-		common.Must1(c.buffer.Write(tlsHeader[:]))
-		_, err = c.buffer.ReadFullFrom(c.Conn, length)
-		if err != nil {
+		if c.frameDumper != nil {
+			c.frameDumper.dump(FrameDirectionRead, c.buffer.Bytes())
+		}
+		if c.idleTimer != nil {
+			c.idleTimer.update()
+		}
+		if c.recordLimiter != nil && !c.recordLimiter.allow() {
+			sendAlert(c.Conn)
+			err = c.fail(errRecordRateExceeded)
 			return
 		}
 		buffer := c.buffer.Bytes()
 		switch buffer[0] {
 		case alert:
-			err = E.Cause(net.ErrClosed, "remote alert")
+			if isCloseNotify(buffer) {
+				if c.closeRecord {
+					err = c.fail(E.Cause(net.ErrClosed, "unauthenticated close_notify"))
+					return
+				}
+				c.releaseBuffer()
+				c.readClosed = true
+				return 0, io.EOF
+			}
+			err = c.fail(newRemoteAlertError(buffer))
 			return
 		case applicationData:
 			if c.hmacIgnore != nil {
-				if verifyApplicationData(buffer, c.hmacIgnore, false) {
-					c.buffer.Release()
-					c.buffer = nil
+				if verifyApplicationData(buffer, defaultRecordVersion, c.hmacIgnore, c.readSum[:0], false) {
+					c.releaseBuffer()
 					continue
 				} else {
 					c.hmacIgnore = nil
 				}
 			}
-			if !verifyApplicationData(buffer, c.hmacVerify, true) {
+			kind := c.verifyRecord(buffer)
+			if kind == recordInvalid {
+				if c.onVerifyFailure != nil {
+					c.onVerifyFailure()
+				}
 				sendAlert(c.Conn)
-				err = E.New("application data verification failed")
+				err = c.fail(newVerificationError(buffer))
 				return
 			}
+			if kind == recordClose {
+				c.releaseBuffer()
+				c.readClosed = true
+				return 0, io.EOF
+			}
 			c.buffer.Advance(tlsHmacHeaderSize)
+			if kind == recordData && c.padder != nil && !unpad(c.buffer) {
+				sendAlert(c.Conn)
+				err = c.fail(E.New("invalid padding length"))
+				return
+			}
+			if kind == recordRekey || c.buffer.IsEmpty() {
+				// keepalive record
+				c.releaseBuffer()
+				continue
+			}
+			c.countRead(c.buffer.Len())
+		case handshake, changeCipherSpec:
+			// unmodified records from the handshake server still in flight
+			if c.hmacIgnore != nil {
+				c.releaseBuffer()
+				continue
+			}
+			sendAlert(c.Conn)
+			err = c.fail(E.New("unexpected TLS record type: ", buffer[0]))
+			return
 		default:
 			sendAlert(c.Conn)
-			err = E.New("unexpected TLS record type: ", buffer[0])
+			err = c.fail(E.New("unexpected TLS record type: ", buffer[0]))
 			return
 		}
 		return c.buffer.Read(b)
 	}
 }
 
+// fail drops the rejected record, so that it is never returned by a later Read.
+func (c *verifiedConn) fail(err error) error {
+	c.releaseBuffer()
+	c.broken.Store(true)
+	return err
+}
+
+// releaseBuffer drops the current record, keeping the reused read buffer.
+func (c *verifiedConn) releaseBuffer() {
+	if c.buffer != c.readBuffer {
+		c.buffer.Release()
+	}
+	c.buffer = nil
+}
+
+// IsHealthy reports whether the read side has not failed yet,
+// it returns false after an alert, a verification failure or a read error.
+func (c *verifiedConn) IsHealthy() bool {
+	return !c.broken.Load()
+}
+
 func (c *verifiedConn) Write(p []byte) (n int, err error) {
 	pTotal := len(p)
 	for len(p) > 0 {
 		var pWrite []byte
-		if len(p) > 16384 {
-			pWrite = p[:16384]
-			p = p[16384:]
+		if len(p) > c.writeChunkSize {
+			pWrite = p[:c.writeChunkSize]
+			p = p[c.writeChunkSize:]
 		} else {
 			pWrite = p
 			p = nil
 		}
 		_, err = c.write(pWrite)
+		if err != nil {
+			break
+		}
 	}
 	if err == nil {
 		n = pTotal
@@ -115,81 +313,408 @@ func (c *verifiedConn) Write(p []byte) (n int, err error) {
 }
 
 func (c *verifiedConn) write(p []byte) (n int, err error) {
+	return c.writeWithPrefix(nil, p)
+}
+
+// writeWithPrefix writes prefix unmodified before the record in the same write if possible.
+func (c *verifiedConn) writeWithPrefix(prefix []byte, p []byte) (n int, err error) {
+	payload, payloadLen := [][]byte{p}, len(p)
+	if c.padder != nil {
+		payload, payloadLen, err = c.padder.pad(p)
+		if err != nil {
+			return
+		}
+	}
+	c.beforeWrite(tlsHmacHeaderSize + payloadLen)
 	var header [tlsHmacHeaderSize]byte
 	header[0] = applicationData
-	header[1] = 3
-	header[2] = 3
-	binary.BigEndian.PutUint16(header[3:tlsHeaderSize], hmacSize+uint16(len(p)))
+	header[1] = c.recordVersion[0]
+	header[2] = c.recordVersion[1]
+	binary.BigEndian.PutUint16(header[3:tlsHeaderSize], hmacSize+uint16(payloadLen))
 	c.access.Lock()
-	c.hmacAdd.Write(p)
-	hmacHash := c.hmacAdd.Sum(nil)[:hmacSize]
+	for _, part := range payload {
+		c.hmacAdd.Write(part)
+	}
+	hmacHash := c.hmacAdd.Sum(c.writeSum[:0])[:hmacSize]
 	c.hmacAdd.Write(hmacHash)
-	c.access.Unlock()
 	copy(header[tlsHeaderSize:], hmacHash)
-	_, err = bufio.WriteVectorised(c.vectorisedWriter, [][]byte{header[:], p})
+	record := append([][]byte{header[:]}, payload...)
+	if c.frameDumper != nil {
+		c.frameDumper.dump(FrameDirectionWrite, record...)
+	}
+	if c.transport != nil {
+		if len(prefix) > 0 {
+			_, err = c.Conn.Write(prefix)
+		}
+		if err == nil {
+			err = c.transport.WriteFrame(c.vectorisedWriter, record)
+		}
+	} else if len(prefix) > 0 {
+		_, err = bufio.WriteVectorised(c.vectorisedWriter, append([][]byte{prefix}, record...))
+	} else {
+		_, err = bufio.WriteVectorised(c.vectorisedWriter, record)
+	}
+	if err == nil {
+		err = c.rekeyIfDue(len(p))
+	}
+	c.access.Unlock()
 	if err == nil {
 		n = len(p)
+		c.countWritten(n)
 	}
 	return
 }
 
 func (c *verifiedConn) WriteBuffer(buffer *buf.Buffer) error {
+	if c.transport != nil || c.padder != nil || buffer.Start() < tlsHmacHeaderSize || buffer.Len() > c.writeChunkSize {
+		defer buffer.Release()
+		_, err := c.Write(buffer.Bytes())
+		return err
+	}
+	c.beforeWrite(tlsHmacHeaderSize + buffer.Len())
 	c.access.Lock()
 	c.hmacAdd.Write(buffer.Bytes())
 	dateLen := buffer.Len()
 	header := buffer.ExtendHeader(tlsHmacHeaderSize)
 	header[0] = applicationData
-	header[1] = 3
-	header[2] = 3
+	header[1] = c.recordVersion[0]
+	header[2] = c.recordVersion[1]
 	binary.BigEndian.PutUint16(header[3:tlsHeaderSize], hmacSize+uint16(dateLen))
-	hmacHash := c.hmacAdd.Sum(nil)[:hmacSize]
+	hmacHash := c.hmacAdd.Sum(c.writeSum[:0])[:hmacSize]
 	c.hmacAdd.Write(hmacHash)
-	c.access.Unlock()
 	copy(header[tlsHeaderSize:], hmacHash)
-	return c.writer.WriteBuffer(buffer)
+	if c.frameDumper != nil {
+		c.frameDumper.dump(FrameDirectionWrite, buffer.Bytes())
+	}
+	err := c.writer.WriteBuffer(buffer)
+	if err == nil {
+		err = c.rekeyIfDue(dateLen)
+	}
+	c.access.Unlock()
+	if err == nil {
+		c.countWritten(dateLen)
+	}
+	return err
 }
 
 func (c *verifiedConn) WriteVectorised(buffers []*buf.Buffer) error {
+	dataLen := buf.LenMulti(buffers)
+	if c.transport != nil || c.padder != nil || dataLen > c.writeChunkSize {
+		defer buf.ReleaseMulti(buffers)
+		for _, buffer := range buffers {
+			_, err := c.Write(buffer.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	c.beforeWrite(tlsHmacHeaderSize + dataLen)
 	var header [tlsHmacHeaderSize]byte
 	header[0] = applicationData
-	header[1] = 3
-	header[2] = 3
-	binary.BigEndian.PutUint16(header[3:tlsHeaderSize], hmacSize+uint16(buf.LenMulti(buffers)))
+	header[1] = c.recordVersion[0]
+	header[2] = c.recordVersion[1]
+	binary.BigEndian.PutUint16(header[3:tlsHeaderSize], hmacSize+uint16(dataLen))
 	c.access.Lock()
 	for _, buffer := range buffers {
 		c.hmacAdd.Write(buffer.Bytes())
 	}
-	c.hmacAdd.Write(c.hmacAdd.Sum(nil)[:hmacSize])
-	hmacHash := c.hmacAdd.Sum(nil)[:hmacSize]
-	c.access.Unlock()
+	hmacHash := c.hmacAdd.Sum(c.writeSum[:0])[:hmacSize]
+	c.hmacAdd.Write(hmacHash)
 	copy(header[tlsHeaderSize:], hmacHash)
-	return c.vectorisedWriter.WriteVectorised(append([]*buf.Buffer{buf.As(header[:])}, buffers...))
+	if c.frameDumper != nil {
+		parts := [][]byte{header[:]}
+		for _, buffer := range buffers {
+			parts = append(parts, buffer.Bytes())
+		}
+		c.frameDumper.dump(FrameDirectionWrite, parts...)
+	}
+	err := c.vectorisedWriter.WriteVectorised(append([]*buf.Buffer{buf.As(header[:])}, buffers...))
+	if err == nil {
+		err = c.rekeyIfDue(dataLen)
+	}
+	c.access.Unlock()
+	if err == nil {
+		c.countWritten(dataLen)
+	}
+	return err
+}
+
+func (c *verifiedConn) beforeWrite(recordSize int) {
+	if c.idleTimer != nil {
+		c.idleTimer.update()
+	}
+	if c.keepAlive != nil {
+		c.keepAlive.update()
+	}
+	if c.pacer != nil {
+		c.pacer.wait(recordSize)
+	}
+}
+
+// writeKeepAlive writes an authenticated record without payload.
+func (c *verifiedConn) writeKeepAlive() error {
+	_, err := c.write(nil)
+	return err
+}
+
+func (c *verifiedConn) countRead(n int) {
+	if c.firstByte != nil {
+		c.firstByte.observe(FrameDirectionRead)
+	}
+	if c.bytesCounter != nil {
+		c.bytesCounter.Add(uint64(n))
+	}
+	if c.sampler != nil {
+		c.sampler.read.Add(uint64(n))
+	}
+}
+
+func (c *verifiedConn) countWritten(n int) {
+	if c.firstByte != nil && n > 0 {
+		c.firstByte.observe(FrameDirectionWrite)
+	}
+	if c.bytesCounter != nil {
+		c.bytesCounter.Add(uint64(n))
+	}
+	if c.sampler != nil {
+		c.sampler.written.Add(uint64(n))
+	}
+}
+
+func (c *verifiedConn) readFrame() (*buf.Buffer, error) {
+	if c.transport == nil {
+		if c.reuseReadBuffer {
+			return c.readFrameReused()
+		}
+		return extractFrameLimited(c.reader, c.maxRecordSize)
+	}
+	buffer, err := c.transport.ReadFrame(c.reader, c.maxRecordSize)
+	if err != nil {
+		return nil, err
+	}
+	if buffer.Len() < tlsHeaderSize {
+		buffer.Release()
+		return nil, io.ErrUnexpectedEOF
+	}
+	if c.maxRecordSize > 0 && buffer.Len()-tlsHeaderSize > c.maxRecordSize {
+		buffer.Release()
+		return nil, errRecordTooLarge
+	}
+	return buffer, nil
+}
+
+// readFrameReused reads the next record into the read buffer kept across records.
+// The header is read into that buffer as well, a local array would escape to the heap.
+func (c *verifiedConn) readFrameReused() (*buf.Buffer, error) {
+	if c.readBuffer == nil {
+		c.readBuffer = buf.NewSize(reusedReadBufferSize)
+	}
+	buffer := c.readBuffer
+	buffer.Reset()
+	_, err := buffer.ReadFullFrom(c.reader, tlsHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(buffer.Bytes()[3:]))
+	if c.maxRecordSize > 0 && length > c.maxRecordSize {
+		return nil, E.Cause(errRecordTooLarge, length, " > ", c.maxRecordSize)
+	}
+	if tlsHeaderSize+length > reusedReadBufferSize {
+		buffer = buf.NewSize(tlsHeaderSize + length)
+		common.Must1(buffer.Write(c.readBuffer.Bytes()))
+	}
+	_, err = buffer.ReadFullFrom(c.reader, length)
+	if err != nil {
+		if buffer != c.readBuffer {
+			buffer.Release()
+		}
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// With CloseRecord, a close record ends the data of its writer like close_notify in TLS, the reader returns io.EOF.
+// It is an application data record without payload carrying bytes 8 to 12 of the HMAC output
+// instead of the first 4. A plain close_notify alert or EOF can be injected by anyone on the path,
+// so both fail the read instead. Both data chains append closeRecordRole to their role, so that a peer
+// without CloseRecord fails the first record instead of the close record.
+const (
+	closeTagOffset  = 2 * hmacSize
+	closeRecordRole = "E"
+)
+
+// closeRecordTimeout limits writing the close record in Close, like crypto/tls does for close_notify.
+const closeRecordTimeout = 5 * time.Second
+
+// CloseWrite sends the close record with CloseRecord and closes the write side of the underlying connection
+// if supported, the peer reads io.EOF and may keep writing until it closes.
+func (c *verifiedConn) CloseWrite() error {
+	if c.keepAlive != nil {
+		c.keepAlive.stop()
+	}
+	if c.closeRecord {
+		c.access.Lock()
+		err := c.writeCloseRecord()
+		c.access.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if closer, isCloser := c.Conn.(interface{ CloseWrite() error }); isCloser {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+func (c *verifiedConn) Close() error {
+	if c.idleTimer != nil {
+		c.idleTimer.stop()
+	}
+	if c.sampler != nil {
+		c.sampler.stop()
+	}
+	if c.keepAlive != nil {
+		c.keepAlive.stop()
+	}
+	// a write in progress is abandoned, the peer then reads an unexpected EOF
+	if c.closeRecord && !c.broken.Load() && c.access.TryLock() {
+		if !c.writeClosed {
+			c.Conn.SetWriteDeadline(time.Now().Add(closeRecordTimeout))
+			c.writeCloseRecord()
+		}
+		c.access.Unlock()
+	}
+	err := c.Conn.Close()
+	if reader, isBatchReader := c.reader.(*batchReader); isBatchReader {
+		// a Read blocked on the connection returns before the buffer is released
+		reader.release()
+	}
+	c.readAccess.Lock()
+	if c.buffer != nil {
+		c.releaseBuffer()
+	}
+	if c.readBuffer != nil {
+		c.readBuffer.Release()
+		c.readBuffer = nil
+	}
+	c.closed = true
+	c.readAccess.Unlock()
+	return err
+}
+
+// writeCloseRecord is called with access held, it writes the close record once.
+func (c *verifiedConn) writeCloseRecord() error {
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	var record [tlsHmacHeaderSize]byte
+	record[0] = applicationData
+	record[1] = c.recordVersion[0]
+	record[2] = c.recordVersion[1]
+	binary.BigEndian.PutUint16(record[3:tlsHeaderSize], hmacSize)
+	sum := c.hmacAdd.Sum(c.writeSum[:0])
+	copy(record[tlsHeaderSize:], sum[closeTagOffset:closeTagOffset+hmacSize])
+	if c.frameDumper != nil {
+		c.frameDumper.dump(FrameDirectionWrite, record[:])
+	}
+	if c.transport != nil {
+		return c.transport.WriteFrame(c.vectorisedWriter, [][]byte{record[:]})
+	}
+	_, err := bufio.WriteVectorised(c.vectorisedWriter, [][]byte{record[:]})
+	return err
 }
 
 func (c *verifiedConn) FrontHeadroom() int {
 	return tlsHmacHeaderSize
 }
 
+// WriterMTU makes bufio.Copy read at most one record of payload into each buffer,
+// so that WriteBuffer frames it in place instead of splitting it with Write.
+func (c *verifiedConn) WriterMTU() int {
+	return c.writeChunkSize
+}
+
 func (c *verifiedConn) NeedAdditionalReadDeadline() bool {
-	return true
+	return !c.manualDeadline
 }
 
 func (c *verifiedConn) Upstream() any {
 	return c.Conn
 }
 
-func verifyApplicationData(frame []byte, hmac hash.Hash, update bool) bool {
-	if frame[1] != 3 || frame[2] != 3 || len(frame) < tlsHmacHeaderSize {
+func verifyApplicationData(frame []byte, recordVersion [2]byte, hmac hash.Hash, sumBuffer []byte, update bool) bool {
+	if len(frame) < tlsHmacHeaderSize || frame[1] != recordVersion[0] || frame[2] != recordVersion[1] {
 		return false
 	}
 	hmac.Write(frame[tlsHmacHeaderSize:])
-	hmacHash := hmac.Sum(nil)[:hmacSize]
+	hmacHash := hmac.Sum(sumBuffer)[:hmacSize]
 	if update {
 		hmac.Write(hmacHash)
 	}
 	return bytes.Equal(frame[tlsHeaderSize:tlsHeaderSize+hmacSize], hmacHash)
 }
 
+const verificationErrorDumpSize = 64
+
+// VerificationError is returned when an application data record fails HMAC verification.
+// Record holds the record header and the first bytes of the payload, it is only captured in debug builds.
+type VerificationError struct {
+	Length int
+	Record []byte
+}
+
+func newVerificationError(frame []byte) *VerificationError {
+	verificationErr := &VerificationError{Length: len(frame)}
+	if debug.Enabled {
+		dumpLen := len(frame)
+		if dumpLen > tlsHmacHeaderSize+verificationErrorDumpSize {
+			dumpLen = tlsHmacHeaderSize + verificationErrorDumpSize
+		}
+		verificationErr.Record = append([]byte(nil), frame[:dumpLen]...)
+	}
+	return verificationErr
+}
+
+func (e *VerificationError) Error() string {
+	if e.Record == nil {
+		return "application data verification failed"
+	}
+	return "application data verification failed: " + strconv.Itoa(e.Length) + " bytes record " + hex.EncodeToString(e.Record)
+}
+
+// RemoteAlertError is returned when the peer sends a plaintext alert record,
+// which comes from a TLS stack rather than from a ShadowTLS peer.
+type RemoteAlertError struct {
+	Level       uint8
+	Description uint8
+}
+
+// newRemoteAlertError parses alerts with a two byte body, alerts sent by sendAlert
+// have a random body and only report that the connection was closed.
+func newRemoteAlertError(frame []byte) error {
+	if len(frame) != tlsHeaderSize+2 {
+		return E.Cause(net.ErrClosed, "remote alert")
+	}
+	return &RemoteAlertError{
+		Level:       frame[tlsHeaderSize],
+		Description: frame[tlsHeaderSize+1],
+	}
+}
+
+func isCloseNotify(frame []byte) bool {
+	return len(frame) == tlsHeaderSize+2 && frame[tlsHeaderSize] == alertLevelWarning && frame[tlsHeaderSize+1] == alertCloseNotify
+}
+
+func (e *RemoteAlertError) Error() string {
+	return "remote alert: " + sTLSAlertError(e.Description).Error()
+}
+
+func (e *RemoteAlertError) Unwrap() error {
+	return net.ErrClosed
+}
+
 func sendAlert(writer io.Writer) {
 	const recordSize = 31
 	record := [recordSize]byte{
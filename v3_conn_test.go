@@ -0,0 +1,840 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/bufio/deadline"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// TestVerifiedConnCopyConn relays through sing's copy helpers, which must not unwrap the framed connections.
+func TestVerifiedConnCopyConn(t *testing.T) {
+	service := newTestService(t, ServiceConfig{
+		Version: 3,
+		Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+			if _, isRaw := N.UnwrapReader(conn).(*memconn.Conn); isRaw {
+				t.Error("reader unwrapped to the raw connection")
+			}
+			if _, isRaw := N.UnwrapWriter(conn).(*memconn.Conn); isRaw {
+				t.Error("writer unwrapped to the raw connection")
+			}
+			upstream, echo := memconn.Pipe()
+			go echoHandler(ctx, echo, metadata)
+			return bufio.CopyConn(ctx, conn, upstream)
+		}),
+	})
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{}))
+	request := make([]byte, 256*1024)
+	rand.Read(request)
+	go func() {
+		conn.Write(request)
+		conn.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, request) {
+		t.Fatal("echo corrupted")
+	}
+}
+
+var testServerRandom = bytes.Repeat([]byte{0x5a}, tlsRandomSize)
+
+// newVerifiedConnPair returns both ends of a data phase connection without running a handshake.
+func newVerifiedConnPair(t testing.TB, options ...Option) (net.Conn, net.Conn) {
+	t.Helper()
+	clientConn, serverConn := memconn.Pipe()
+	client, err := NewVerifiedConn(clientConn, testPassword, testPassword, testServerRandom, true, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewVerifiedConn(serverConn, testPassword, testPassword, testServerRandom, false, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// TestVerifiedConnWriteMethods checks that every write path continues the same HMAC chain.
+func TestVerifiedConnWriteMethods(t *testing.T) {
+	client, server := newVerifiedConnPair(t)
+	writer := client.(*verifiedConn)
+	var expected []byte
+	_, err := writer.Write([]byte("write"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "write"...)
+	buffer := buf.New()
+	buffer.Resize(writer.FrontHeadroom(), 0)
+	buffer.WriteString("buffer")
+	err = writer.WriteBuffer(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "buffer"...)
+	err = writer.WriteVectorised([]*buf.Buffer{buf.As([]byte("vector")), buf.As([]byte("ised"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "vectorised"...)
+	// larger than a record, so that bufio.Copy passes several record sized buffers to WriteBuffer
+	copied := bytes.Repeat([]byte("copy"), maxRecordPayloadSize/2)
+	_, err = bufio.Copy(writer, bytes.NewReader(copied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, copied...)
+	writer.CloseWrite()
+	received, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, expected) {
+		t.Fatalf("received %q, expected %q", received, expected)
+	}
+}
+
+// testLargeWrite sends size random bytes with write and checks that they arrive intact,
+// a record length overflowing uint16 would corrupt the stream.
+func testLargeWrite(t *testing.T, size int, write func(conn *verifiedConn, payload []byte) error) {
+	client, server := newVerifiedConnPair(t)
+	payload := make([]byte, size)
+	rand.Read(payload)
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- write(client.(*verifiedConn), payload)
+	}()
+	received := make([]byte, size)
+	_, err := io.ReadFull(server, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-writeErr
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatal("payload corrupted")
+	}
+}
+
+func TestVerifiedConnWriteVectorisedLarge(t *testing.T) {
+	testLargeWrite(t, 3*30000, func(conn *verifiedConn, payload []byte) error {
+		return conn.WriteVectorised([]*buf.Buffer{
+			buf.As(payload[:30000]),
+			buf.As(payload[30000:60000]),
+			buf.As(payload[60000:]),
+		})
+	})
+	testLargeWrite(t, 70000, func(conn *verifiedConn, payload []byte) error {
+		return conn.WriteVectorised([]*buf.Buffer{buf.As(payload)})
+	})
+}
+
+func TestVerifiedConnWriteBufferLarge(t *testing.T) {
+	testLargeWrite(t, 100*1024, func(conn *verifiedConn, payload []byte) error {
+		buffer := buf.With(make([]byte, conn.FrontHeadroom()+len(payload)))
+		buffer.Resize(conn.FrontHeadroom(), 0)
+		buffer.Write(payload)
+		return conn.WriteBuffer(buffer)
+	})
+}
+
+// TestVerifiedConnMaxRecordSize announces a large record and never sends its payload,
+// the read has to fail on the header instead of waiting for the payload.
+func TestVerifiedConnMaxRecordSize(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		options []Option
+	}{
+		{"records", nil},
+		{"reused buffer", []Option{WithReuseReadBuffer(true)}},
+		{"frame transport", []Option{WithFrameTransport(TLSRecordTransport{})}},
+	} {
+		clientConn, serverConn := memconn.Pipe()
+		server, err := NewVerifiedConn(serverConn, testPassword, testPassword, testServerRandom, false, append(testCase.options, WithMaxRecordSize(1024))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go clientConn.Write([]byte{applicationData, 0x03, 0x03, 0xFF, 0x00})
+		server.SetReadDeadline(time.Now().Add(testDialTimeout))
+		_, err = server.Read(make([]byte, 1024))
+		if !errors.Is(err, errRecordTooLarge) {
+			t.Errorf("%s: expected record too large, got %v", testCase.name, err)
+		}
+		clientConn.Close()
+		server.Close()
+	}
+}
+
+// TestVerifiedConnEmptyRecords sends authenticated records without payload, which are skipped by Read
+// and continue the HMAC chain, also as the first record the server sees after the handshake.
+func TestVerifiedConnEmptyRecords(t *testing.T) {
+	client, server := newVerifiedConnPair(t)
+	testEmptyRecords(t, client.(*verifiedConn), server)
+
+	service := newTestService(t, ServiceConfig{Version: 3})
+	conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{}))
+	testEmptyRecords(t, conn.(*verifiedConn), conn)
+}
+
+func testEmptyRecords(t *testing.T, writer *verifiedConn, reader net.Conn) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		_, err := writer.write(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := writer.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received [4]byte
+	reader.SetReadDeadline(time.Now().Add(testDialTimeout))
+	n, err := reader.Read(received[:])
+	if err != nil {
+		t.Fatal("read after empty records: ", err)
+	}
+	if string(received[:n]) != "data" {
+		t.Fatalf("received %q", received[:n])
+	}
+}
+
+// TestVerifiedConnZeroLengthRecord checks that a record without even an HMAC fails the read.
+func TestVerifiedConnZeroLengthRecord(t *testing.T) {
+	clientConn, serverConn := memconn.Pipe()
+	defer clientConn.Close()
+	server, err := NewVerifiedConn(serverConn, testPassword, testPassword, testServerRandom, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go clientConn.Write(testRecord(applicationData, nil))
+	server.SetReadDeadline(time.Now().Add(testDialTimeout))
+	_, err = server.Read(make([]byte, 16))
+	if err == nil || E.IsTimeout(err) {
+		t.Fatal("zero length record not rejected: ", err)
+	}
+}
+
+// TestVerifiedConnSkipsRelayedHandshakeRecords delivers a post-handshake NewSessionTicket and a
+// change_cipher_spec still in flight from the handshake server before the first server data record.
+func TestVerifiedConnSkipsRelayedHandshakeRecords(t *testing.T) {
+	clientConn, serverConn := memconn.Pipe()
+	server, err := NewVerifiedConn(serverConn, testPassword, testPassword, testServerRandom, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	hmacAdd := hmac.New(sha1.New, []byte(testPassword))
+	hmacAdd.Write(testServerRandom)
+	hmacAdd.Write([]byte("C"))
+	hmacVerify := hmac.New(sha1.New, []byte(testPassword))
+	hmacVerify.Write(testServerRandom)
+	hmacVerify.Write([]byte("S"))
+	client := newVerifiedConn(clientConn, hmacAdd, hmacVerify, hmac.New(sha1.New, []byte(testPassword)))
+	defer client.Close()
+
+	newSessionTicket := []byte{4, 0, 0, 4, 0, 0, 0, 0}
+	go func() {
+		serverConn.Write(testRecord(handshake, newSessionTicket))
+		serverConn.Write(testRecord(changeCipherSpec, []byte{1}))
+		server.Write([]byte("data"))
+		serverConn.Write(testRecord(handshake, newSessionTicket))
+	}()
+	client.SetReadDeadline(time.Now().Add(testDialTimeout))
+	var received [4]byte
+	n, err := client.Read(received[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received[:n]) != "data" {
+		t.Fatalf("received %q", received[:n])
+	}
+	_, err = client.Read(received[:])
+	if err == nil {
+		t.Fatal("handshake record accepted after verified server data")
+	}
+}
+
+type discardConn struct {
+	net.Conn
+}
+
+func (c discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c discardConn) Close() error {
+	return nil
+}
+
+var benchmarkWriteSizes = []int{64, 1024, 16384, 65536}
+
+// BenchmarkVerifiedConnWrite measures the single core write path, which is bound by BenchmarkRecordHMAC
+// since the chained HMAC has to be computed in record order.
+func BenchmarkVerifiedConnWrite(b *testing.B) {
+	for _, size := range benchmarkWriteSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			conn, err := NewVerifiedConn(discardConn{}, testPassword, testPassword, testServerRandom, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			payload := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = conn.Write(payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkVerifiedConnWriteChunkSize measures 1 MiB writes over TCP loopback with different record payload sizes,
+// run it on each platform before changing the default of Features.WriteChunkSize.
+func BenchmarkVerifiedConnWriteChunkSize(b *testing.B) {
+	for _, size := range []int{1024, 4096, 8192, 11 * 1448, maxRecordPayloadSize} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Skip(err)
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				server, err := NewVerifiedConn(conn, testPassword, testPassword, testServerRandom, false)
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, server)
+			}()
+			rawConn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn, err := NewVerifiedConn(rawConn, testPassword, testPassword, testServerRandom, true, WithWriteChunkSize(size))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			payload := make([]byte, 1024*1024)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = conn.Write(payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// BenchmarkVerifiedConnUpload copies a 100 MB upload with bufio.Copy, through Write
+// and through WriteBuffer with record sized buffers.
+func BenchmarkVerifiedConnUpload(b *testing.B) {
+	const uploadSize = 100 * 1024 * 1024
+	for _, extended := range []bool{false, true} {
+		name := "write"
+		if extended {
+			name = "extended"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn, err := NewVerifiedConn(discardConn{}, testPassword, testPassword, testServerRandom, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var destination io.Writer = conn
+			if !extended {
+				destination = struct{ io.Writer }{conn}
+			}
+			b.SetBytes(uploadSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = bufio.Copy(destination, io.LimitReader(zeroReader{}, uploadSize))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRecordHMAC(b *testing.B) {
+	for _, size := range benchmarkWriteSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			hmacAdd := hmac.New(sha1.New, []byte(testPassword))
+			payload := make([]byte, size)
+			var sum [sha1.Size]byte
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hmacAdd.Write(payload)
+				hmacAdd.Write(hmacAdd.Sum(sum[:0])[:hmacSize])
+			}
+		})
+	}
+}
+
+func TestVerifiedConnWriteBufferWithoutHeadroom(t *testing.T) {
+	client, server := newVerifiedConnPair(t)
+	for _, headroom := range []int{0, tlsHmacHeaderSize - 1, tlsHmacHeaderSize} {
+		buffer := buf.New()
+		buffer.Resize(headroom, 0)
+		buffer.WriteString("payload")
+		err := client.(*verifiedConn).WriteBuffer(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received [7]byte
+		_, err = io.ReadFull(server, received[:])
+		if err != nil {
+			t.Fatal("headroom ", headroom, ": ", err)
+		}
+		if string(received[:]) != "payload" {
+			t.Fatalf("headroom %d: received %q", headroom, received[:])
+		}
+	}
+}
+
+func TestVerifiedConnIdleTimeout(t *testing.T) {
+	clientConn, serverConn := memconn.Pipe()
+	defer clientConn.Close()
+	client, err := NewVerifiedConn(clientConn, testPassword, testPassword, testServerRandom, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewVerifiedConn(serverConn, testPassword, testPassword, testServerRandom, false, WithIdleTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// traffic keeps the connection open past the timeout
+	go func() {
+		for i := 0; i < 10; i++ {
+			client.Write([]byte{byte(i)})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	var data [1]byte
+	for i := 0; i < 10; i++ {
+		_, err = io.ReadFull(server, data[:])
+		if err != nil {
+			t.Fatal("active connection closed: ", err)
+		}
+	}
+
+	// the stalled peer is dropped
+	start := time.Now()
+	_, err = server.Read(data[:])
+	if err == nil {
+		t.Fatal("read from a stalled peer succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("idle connection closed after ", elapsed)
+	}
+}
+
+func TestVerifyApplicationDataShortFrames(t *testing.T) {
+	for length := 0; length < tlsHmacHeaderSize; length++ {
+		frame := make([]byte, length)
+		if length > 0 {
+			frame[0] = applicationData
+		}
+		if verifyApplicationData(frame, defaultRecordVersion, hmac.New(sha1.New, []byte(testPassword)), nil, false) {
+			t.Fatalf("%d byte frame verified", length)
+		}
+	}
+}
+
+func FuzzVerifyApplicationData(f *testing.F) {
+	hmacAdd := hmac.New(sha1.New, []byte(testPassword))
+	payload := []byte("payload")
+	hmacAdd.Write(payload)
+	f.Add(testRecord(applicationData, append(hmacAdd.Sum(nil)[:hmacSize], payload...)))
+	f.Add([]byte{applicationData, 3})
+	f.Add([]byte{applicationData, 3, 3, 0, 4})
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		var sum [sha1.Size]byte
+		verifyApplicationData(frame, defaultRecordVersion, hmac.New(sha1.New, []byte(testPassword)), sum[:0], true)
+		conn := newVerifiedConn(nil, hmac.New(sha1.New, []byte(testPassword)), hmac.New(sha1.New, []byte(testPassword)), nil)
+		conn.verifyRecord(frame)
+	})
+}
+
+// recordingConn keeps a copy of everything written to the connection.
+type recordingConn struct {
+	*memconn.Conn
+	access  sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.access.Lock()
+	c.written.Write(p)
+	c.access.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) recordTypes() []byte {
+	c.access.Lock()
+	defer c.access.Unlock()
+	var types []byte
+	written := c.written.Bytes()
+	for len(written) >= tlsHeaderSize {
+		types = append(types, written[0])
+		written = written[tlsHeaderSize+int(binary.BigEndian.Uint16(written[3:tlsHeaderSize])):]
+	}
+	return types
+}
+
+// TestVerifiedConnCloseWrite checks that after a half-close the peer reads io.EOF and the other direction
+// keeps working, with the plain EOF of other implementations and with the authenticated close record.
+func TestVerifiedConnCloseWrite(t *testing.T) {
+	for _, closeRecord := range []bool{false, true} {
+		t.Run(fmt.Sprint("close record ", closeRecord), func(t *testing.T) {
+			clientRaw, serverRaw := memconn.Pipe()
+			recorder := &recordingConn{Conn: clientRaw.(*memconn.Conn)}
+			client, err := NewVerifiedConn(recorder, testPassword, testPassword, testServerRandom, true, WithCloseRecord(closeRecord))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			server, err := NewVerifiedConn(serverRaw, testPassword, testPassword, testServerRandom, false, WithCloseRecord(closeRecord))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			go func() {
+				client.Write([]byte("request"))
+				client.(N.WriteCloser).CloseWrite()
+			}()
+			request, err := io.ReadAll(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(request) != "request" {
+				t.Fatalf("received %q", request)
+			}
+			go func() {
+				server.Write([]byte("response"))
+				server.(N.WriteCloser).CloseWrite()
+			}()
+			response, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(response) != "response" {
+				t.Fatalf("received %q", response)
+			}
+			types := recorder.recordTypes()
+			expectedRecords := 1
+			if closeRecord {
+				expectedRecords = 2
+			}
+			if len(types) != expectedRecords {
+				t.Fatalf("%d records written, expected %d", len(types), expectedRecords)
+			}
+			for _, recordType := range types {
+				if recordType != applicationData {
+					t.Fatalf("record of type %d written", recordType)
+				}
+			}
+		})
+	}
+}
+
+// TestVerifiedConnGolden locks the data phase records of a fixed server random: the HMAC chain
+// over two data records, then with CloseRecord the close record.
+func TestVerifiedConnGolden(t *testing.T) {
+	for _, testCase := range []struct {
+		closeRecord bool
+		expected    string
+	}{
+		{false, "1703030009f217996768656c6c6f" +
+			"17030300095d0370f7776f726c64"},
+		{true, "17030300097268f90f68656c6c6f" +
+			"1703030009d630ad55776f726c64" +
+			"1703030004feafb87e"},
+	} {
+		t.Run(fmt.Sprint("close record ", testCase.closeRecord), func(t *testing.T) {
+			expected, _ := hex.DecodeString(testCase.expected)
+			clientRaw, serverRaw := memconn.Pipe()
+			recorder := &recordingConn{Conn: clientRaw.(*memconn.Conn)}
+			client, err := NewVerifiedConn(recorder, testPassword, testPassword, testServerRandom, true, WithCloseRecord(testCase.closeRecord))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				client.Write([]byte("hello"))
+				client.Write([]byte("world"))
+				client.Close()
+			}()
+			server, err := NewVerifiedConn(serverRaw, testPassword, testPassword, testServerRandom, false, WithCloseRecord(testCase.closeRecord))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			received, err := io.ReadAll(server)
+			if err != nil || string(received) != "helloworld" {
+				t.Fatalf("received %q: %v", received, err)
+			}
+			recorder.access.Lock()
+			defer recorder.access.Unlock()
+			if !bytes.Equal(recorder.written.Bytes(), expected) {
+				t.Fatalf("unexpected records %x", recorder.written.Bytes())
+			}
+		})
+	}
+}
+
+// TestVerifiedConnUnauthenticatedClose checks that a plain close_notify or EOF ends the read side like a half-close,
+// and that with CloseRecord neither ends the stream cleanly.
+func TestVerifiedConnUnauthenticatedClose(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		closeRecord bool
+		close       func(conn net.Conn)
+		err         error
+	}{
+		{"close_notify", false, func(conn net.Conn) {
+			conn.Write([]byte{alert, 3, 3, 0, 2, alertLevelWarning, alertCloseNotify})
+		}, nil},
+		{"EOF", false, func(conn net.Conn) {
+			conn.(N.WriteCloser).CloseWrite()
+		}, nil},
+		{"close_notify with close record", true, func(conn net.Conn) {
+			conn.Write([]byte{alert, 3, 3, 0, 2, alertLevelWarning, alertCloseNotify})
+		}, net.ErrClosed},
+		{"EOF with close record", true, func(conn net.Conn) {
+			conn.(N.WriteCloser).CloseWrite()
+		}, io.ErrUnexpectedEOF},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			clientRaw, serverRaw := memconn.Pipe()
+			defer clientRaw.Close()
+			server, err := NewVerifiedConn(serverRaw, testPassword, testPassword, testServerRandom, false, WithCloseRecord(testCase.closeRecord))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			testCase.close(clientRaw)
+			_, err = io.ReadAll(server)
+			if testCase.err == nil {
+				if err != nil {
+					t.Fatal("read error after a half-close: ", err)
+				}
+				if !server.(*verifiedConn).IsHealthy() {
+					t.Fatal("half-closed connection reported unhealthy")
+				}
+				// the write side stays usable
+				go server.Write([]byte("response"))
+				var response [tlsHmacHeaderSize + 8]byte
+				clientRaw.SetReadDeadline(time.Now().Add(testDialTimeout))
+				_, err = io.ReadFull(clientRaw, response[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.Is(err, testCase.err) {
+				t.Fatalf("read error %v, expected %v", err, testCase.err)
+			}
+		})
+	}
+}
+
+// TestManualReadDeadline checks the connections passed to the handler and returned by the client
+// with sing's check for additional read deadlines, through the compression wrapper as well.
+func TestManualReadDeadline(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		for _, manual := range []bool{false, true} {
+			handlerNeeds := make(chan bool, 1)
+			service := newTestService(t, ServiceConfig{
+				Version:            3,
+				Compression:        compression,
+				ManualReadDeadline: manual,
+				Handler: handlerFunc(func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+					handlerNeeds <- deadline.NeedAdditionalReadDeadline(conn)
+					return echoHandler(ctx, conn, metadata)
+				}),
+			})
+			conn, _ := dialTestConn(t, service, newTestClient(t, ClientConfig{
+				Compression:        compression,
+				ManualReadDeadline: manual,
+			}))
+			testEcho(t, conn, []byte("deadline"), false)
+			if need := deadline.NeedAdditionalReadDeadline(conn); need == manual {
+				t.Fatalf("compression %v, manual %v: client needs additional read deadline %v", compression, manual, need)
+			}
+			if need := <-handlerNeeds; need == manual {
+				t.Fatalf("compression %v, manual %v: handler conn needs additional read deadline %v", compression, manual, need)
+			}
+		}
+	}
+}
+
+// recordSourceConn reads an endless stream of server data records without allocating,
+// so that read benchmarks only count the allocations of the reader.
+type recordSourceConn struct {
+	net.Conn
+	hmacAdd hash.Hash
+	sum     [sha1.Size]byte
+	record  []byte
+	pending []byte
+}
+
+func newRecordSourceConn(payloadSize int) *recordSourceConn {
+	hmacAdd := hmac.New(sha1.New, []byte(testPassword))
+	hmacAdd.Write(testServerRandom)
+	hmacAdd.Write([]byte("S"))
+	record := make([]byte, tlsHmacHeaderSize+payloadSize)
+	record[0] = applicationData
+	record[1], record[2] = defaultRecordVersion[0], defaultRecordVersion[1]
+	binary.BigEndian.PutUint16(record[3:], uint16(hmacSize+payloadSize))
+	return &recordSourceConn{hmacAdd: hmacAdd, record: record}
+}
+
+func (c *recordSourceConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.hmacAdd.Write(c.record[tlsHmacHeaderSize:])
+		hmacHash := c.hmacAdd.Sum(c.sum[:0])[:hmacSize]
+		c.hmacAdd.Write(hmacHash)
+		copy(c.record[tlsHeaderSize:], hmacHash)
+		c.pending = c.record
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *recordSourceConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *recordSourceConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *recordSourceConn) Close() error {
+	return nil
+}
+
+// BenchmarkVerifiedConnReuseReadBuffer measures a steady download of full records, ReuseReadBuffer should remove
+// the allocation per record.
+func BenchmarkVerifiedConnReuseReadBuffer(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		b.Run("reuse="+strconv.FormatBool(reuse), func(b *testing.B) {
+			conn, err := NewVerifiedConn(newRecordSourceConn(maxRecordPayloadSize), testPassword, testPassword, testServerRandom, true, WithReuseReadBuffer(reuse))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			payload := make([]byte, maxRecordPayloadSize)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = io.ReadFull(conn, payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestVerifiedConnCloseReleasesBuffers closes connections holding a partly read record, the reused read buffer
+// and a blocked Read, all buffers must return to the pool.
+func TestVerifiedConnCloseReleasesBuffers(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		t.Run("reuse="+strconv.FormatBool(reuse), func(t *testing.T) {
+			allocator := trackBuffers(t)
+			client, server := newVerifiedConnPair(t, WithReuseReadBuffer(reuse))
+			_, err := client.Write([]byte("partly read"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.ReadFull(server, make([]byte, 6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+			server.Close()
+			_, err = server.Read(make([]byte, 6))
+			if err == nil {
+				t.Fatal("read after close succeeded")
+			}
+			allocator.check(t, "partly read")
+
+			client, server = newVerifiedConnPair(t, WithReuseReadBuffer(reuse))
+			_, err = client.Write([]byte("read"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.ReadFull(server, make([]byte, 4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			readDone := make(chan error, 1)
+			go func() {
+				_, rErr := server.Read(make([]byte, 4))
+				readDone <- rErr
+			}()
+			time.Sleep(10 * time.Millisecond)
+			server.Close()
+			select {
+			case err = <-readDone:
+				if err == nil {
+					t.Fatal("blocked read succeeded")
+				}
+			case <-time.After(testDialTimeout):
+				t.Fatal("blocked read not interrupted by close")
+			}
+			client.Close()
+			allocator.check(t, "blocked read")
+		})
+	}
+}
@@ -13,8 +13,17 @@ const (
 	handshake        = 22
 	applicationData  = 23
 
+	alertLevelWarning = 1
+	alertCloseNotify  = 0
+
+	extensionSupportedVersions = 43
+	extensionKeyShare          = 51
+	versionTLS13               = 0x0304
+
 	serverRandomIndex    = tlsHeaderSize + 1 + 3 + 2
 	sessionIDLengthIndex = tlsHeaderSize + 1 + 3 + 2 + tlsRandomSize
 	tlsHmacHeaderSize    = tlsHeaderSize + hmacSize
 	hmacSize             = 4
+
+	maxRecordPayloadSize = 16384
 )
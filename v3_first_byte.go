@@ -0,0 +1,49 @@
+package shadowtls
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// FirstByteObserver may be implemented by an Observer to learn how long a v3 connection took from the end of
+// the handshake to its first data in each direction, which tells a slow handshake from a slow data path.
+// direction is FrameDirectionRead for data from the client and FrameDirectionWrite for data to it.
+// Data the client sent with its authenticating record is reported at once.
+type FirstByteObserver interface {
+	FirstByte(ctx context.Context, direction string, latency time.Duration)
+}
+
+type firstByteTimer struct {
+	ctx      context.Context
+	clock    Clock
+	start    time.Time
+	observer FirstByteObserver
+	read     atomic.Bool
+	written  atomic.Bool
+}
+
+func (s *Service) newFirstByteTimer(ctx context.Context) *firstByteTimer {
+	firstByteObserver, isFirstByteObserver := s.observer.(FirstByteObserver)
+	if !isFirstByteObserver {
+		return nil
+	}
+	return &firstByteTimer{
+		ctx:      ctx,
+		clock:    s.features.Clock,
+		start:    s.features.Clock.Now(),
+		observer: firstByteObserver,
+	}
+}
+
+// observe reports the first call per direction, later calls cost one atomic load.
+func (t *firstByteTimer) observe(direction string) {
+	done := &t.read
+	if direction == FrameDirectionWrite {
+		done = &t.written
+	}
+	if done.Load() || done.Swap(true) {
+		return
+	}
+	t.observer.FirstByte(t.ctx, direction, t.clock.Now().Sub(t.start))
+}
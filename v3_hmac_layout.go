@@ -0,0 +1,25 @@
+package shadowtls
+
+// hmacLayout places the protocol version 3 HMAC in the ClientHello session id.
+// Protocol variants may use another layout, the HMAC always covers the handshake message
+// with the HMAC bytes zeroed and is truncated to hmacSize.
+type hmacLayout struct {
+	sessionIDLength int // required length of the session id
+	hmacOffset      int // offset of the HMAC within the session id
+}
+
+// defaultHMACLayout is the wire format: the last 4 bytes of a 32 byte session id.
+var defaultHMACLayout = hmacLayout{
+	sessionIDLength: tlsSessionIDSize,
+	hmacOffset:      tlsSessionIDSize - hmacSize,
+}
+
+// hmacIndex returns the offset of the HMAC in a ClientHello record including its header.
+func (l hmacLayout) hmacIndex() int {
+	return sessionIDLengthIndex + 1 + l.hmacOffset
+}
+
+// minRecordLength is the shortest ClientHello record that contains the whole session id.
+func (l hmacLayout) minRecordLength() int {
+	return sessionIDLengthIndex + 1 + l.sessionIDLength
+}
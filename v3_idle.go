@@ -0,0 +1,61 @@
+package shadowtls
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type idleTimer struct {
+	access     sync.Mutex
+	timeout    time.Duration
+	clock      Clock
+	timer      Timer
+	lastActive atomic.Int64
+	stopped    bool
+	onIdle     func()
+}
+
+func newIdleTimer(clock Clock, timeout time.Duration, onIdle func()) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTimer{
+		clock:   clock,
+		timeout: timeout,
+		onIdle:  onIdle,
+	}
+	t.update()
+	t.access.Lock()
+	t.timer = clock.AfterFunc(timeout, t.fire)
+	t.access.Unlock()
+	return t
+}
+
+func (t *idleTimer) update() {
+	t.lastActive.Store(t.clock.Now().UnixNano())
+}
+
+func (t *idleTimer) fire() {
+	t.access.Lock()
+	if t.stopped {
+		t.access.Unlock()
+		return
+	}
+	idle := t.clock.Now().Sub(time.Unix(0, t.lastActive.Load()))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		t.access.Unlock()
+		return
+	}
+	t.stopped = true
+	t.access.Unlock()
+	t.onIdle()
+}
+
+func (t *idleTimer) stop() {
+	t.access.Lock()
+	t.stopped = true
+	t.timer.Stop()
+	t.access.Unlock()
+}
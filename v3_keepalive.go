@@ -0,0 +1,60 @@
+package shadowtls
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type keepAlive struct {
+	clock     Clock
+	interval  time.Duration
+	lastWrite atomic.Int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newKeepAlive(clock Clock, interval time.Duration, write func() error) *keepAlive {
+	if interval <= 0 {
+		return nil
+	}
+	k := &keepAlive{
+		clock:    clock,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	k.update()
+	go k.loop(write)
+	return k
+}
+
+func (k *keepAlive) update() {
+	k.lastWrite.Store(k.clock.Now().UnixNano())
+}
+
+func (k *keepAlive) loop(write func() error) {
+	timer := k.clock.NewTimer(k.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-timer.C():
+		}
+		wait := k.interval - k.clock.Now().Sub(time.Unix(0, k.lastWrite.Load()))
+		if wait > 0 {
+			timer.Reset(wait)
+			continue
+		}
+		if write() != nil {
+			return
+		}
+		timer.Reset(k.interval)
+	}
+}
+
+func (k *keepAlive) stop() {
+	k.closeOnce.Do(func() {
+		close(k.done)
+	})
+}
@@ -0,0 +1,68 @@
+package shadowtls
+
+import (
+	"sync"
+	"time"
+)
+
+// Pacing spaces out application data records written in the data phase.
+// Both limits may be combined, the zero value disables pacing.
+type Pacing struct {
+	BytesPerSecond int
+	RecordInterval time.Duration
+}
+
+type pacer struct {
+	clock      Clock
+	access     sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	interval   time.Duration
+	lastFill   time.Time
+	lastRecord time.Time
+}
+
+func newPacer(clock Clock, pacing Pacing) *pacer {
+	if pacing.BytesPerSecond <= 0 && pacing.RecordInterval <= 0 {
+		return nil
+	}
+	p := &pacer{
+		clock:    clock,
+		interval: pacing.RecordInterval,
+	}
+	if pacing.BytesPerSecond > 0 {
+		p.rate = float64(pacing.BytesPerSecond)
+		p.burst = tlsHmacHeaderSize + 16384
+		p.tokens = p.burst
+		p.lastFill = clock.Now()
+	}
+	return p
+}
+
+func (p *pacer) wait(recordSize int) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	now := p.clock.Now()
+	var delay time.Duration
+	if p.rate > 0 {
+		p.tokens += now.Sub(p.lastFill).Seconds() * p.rate
+		if p.tokens > p.burst {
+			p.tokens = p.burst
+		}
+		p.lastFill = now
+		p.tokens -= float64(recordSize)
+		if p.tokens < 0 {
+			delay = time.Duration(-p.tokens / p.rate * float64(time.Second))
+		}
+	}
+	if p.interval > 0 && !p.lastRecord.IsZero() {
+		if intervalDelay := p.lastRecord.Add(p.interval).Sub(now); intervalDelay > delay {
+			delay = intervalDelay
+		}
+	}
+	p.lastRecord = now.Add(delay)
+	if delay > 0 {
+		clockSleep(p.clock, delay)
+	}
+}
@@ -0,0 +1,105 @@
+package shadowtls
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mRand "math/rand"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+// Padding pads written data records with less payload than Threshold, so that record lengths
+// follow the configured sizes instead of the write sizes. The zero value disables padding.
+// Enabled padding changes the record format and must be enabled on both peers, the sizes may differ.
+type Padding struct {
+	Threshold int // records with less payload are padded, 0 disables padding
+	MinSize   int // payload size of a padded record, larger payloads are not padded
+	MaxSize   int // padded records get a random size between MinSize and MaxSize, MinSize if not larger
+}
+
+// A padded record carries a 2 byte padding length after the HMAC, then the payload and the padding,
+// all covered by the HMAC. Both data chains of a connection with padding append paddingRole to their role,
+// so that a peer disagreeing on padding fails the first record like a corrupted one.
+const (
+	paddingHeaderSize = 2
+	paddingRole       = "P"
+)
+
+type padder struct {
+	threshold int
+	minSize   int
+	maxSize   int
+}
+
+func newPadder(padding Padding) *padder {
+	if padding.Threshold <= 0 {
+		return nil
+	}
+	p := &padder{
+		threshold: padding.Threshold,
+		minSize:   padding.MinSize,
+		maxSize:   padding.MaxSize,
+	}
+	if p.minSize > maxRecordPayloadSize-paddingHeaderSize {
+		p.minSize = maxRecordPayloadSize - paddingHeaderSize
+	}
+	if p.maxSize > maxRecordPayloadSize-paddingHeaderSize {
+		p.maxSize = maxRecordPayloadSize - paddingHeaderSize
+	}
+	if p.maxSize < p.minSize {
+		p.maxSize = p.minSize
+	}
+	return p
+}
+
+// pad returns the parts of the record payload carrying payload and their total length.
+func (p *padder) pad(payload []byte) ([][]byte, int, error) {
+	var paddingLength int
+	if len(payload) < p.threshold {
+		size := p.minSize
+		if p.maxSize > p.minSize {
+			size += mRand.Intn(p.maxSize - p.minSize + 1)
+		}
+		if size > len(payload) {
+			paddingLength = size - len(payload)
+		}
+	}
+	header := make([]byte, paddingHeaderSize+paddingLength)
+	binary.BigEndian.PutUint16(header, uint16(paddingLength))
+	padding := header[paddingHeaderSize:]
+	if paddingLength > 0 {
+		_, err := rand.Read(padding)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return [][]byte{header[:paddingHeaderSize], payload, padding}, paddingHeaderSize + len(payload) + paddingLength, nil
+}
+
+// chainRole returns the role written into a data chain after the server random.
+func (f *Features) chainRole(role string) []byte {
+	if f.Padding.Threshold > 0 {
+		role += paddingRole
+	}
+	if f.Compression {
+		role += compressionRole
+	}
+	if f.CloseRecord {
+		role += closeRecordRole
+	}
+	return []byte(role)
+}
+
+// unpad strips the padding header and the padding from a verified record payload.
+func unpad(buffer *buf.Buffer) bool {
+	if buffer.Len() < paddingHeaderSize {
+		return false
+	}
+	paddingLength := int(binary.BigEndian.Uint16(buffer.Bytes()))
+	if paddingLength > buffer.Len()-paddingHeaderSize {
+		return false
+	}
+	buffer.Advance(paddingHeaderSize)
+	buffer.Truncate(buffer.Len() - paddingLength)
+	return true
+}
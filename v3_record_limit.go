@@ -0,0 +1,31 @@
+package shadowtls
+
+import "time"
+
+// recordLimiter counts records read in fixed one second windows, it is only used by the reading goroutine.
+type recordLimiter struct {
+	clock       Clock
+	maxRate     int
+	windowStart time.Time
+	count       int
+}
+
+func newRecordLimiter(clock Clock, maxRate int) *recordLimiter {
+	if maxRate <= 0 {
+		return nil
+	}
+	return &recordLimiter{
+		clock:   clock,
+		maxRate: maxRate,
+	}
+}
+
+func (l *recordLimiter) allow() bool {
+	now := l.clock.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.count = 0
+	}
+	l.count++
+	return l.count <= l.maxRate
+}
@@ -0,0 +1,85 @@
+package shadowtls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+
+	"github.com/sagernet/sing/common/bufio"
+)
+
+// A rekey record replaces the HMAC chain of its writer, so that long connections do not
+// authenticate every record under the key derived from the ServerHello alone.
+//
+// It is an application data record carrying a 32 byte random nonce. The writer feeds the nonce
+// into its chain like a payload, but sends bytes 4 to 8 of the HMAC output instead of the first 4,
+// and the full 20 byte output becomes the key of the next chain, which starts empty.
+// A reader without rekey support fails such a record like a corrupted one, so RekeyBytes must
+// only be set if the peer accepts rekey records. Every reader here does, whether or not it sends them.
+const rekeyNonceSize = 32
+
+// rekeyIfDue is called with access held after a record with n payload bytes was written.
+func (c *verifiedConn) rekeyIfDue(n int) error {
+	if c.rekeyBytes <= 0 {
+		return nil
+	}
+	c.writtenSinceRekey += int64(n)
+	if c.writtenSinceRekey < c.rekeyBytes {
+		return nil
+	}
+	c.writtenSinceRekey = 0
+	var record [tlsHmacHeaderSize + rekeyNonceSize]byte
+	_, err := rand.Read(record[tlsHmacHeaderSize:])
+	if err != nil {
+		return err
+	}
+	record[0] = applicationData
+	record[1] = c.recordVersion[0]
+	record[2] = c.recordVersion[1]
+	binary.BigEndian.PutUint16(record[3:tlsHeaderSize], hmacSize+rekeyNonceSize)
+	c.hmacAdd.Write(record[tlsHmacHeaderSize:])
+	sum := c.hmacAdd.Sum(nil)
+	copy(record[tlsHeaderSize:], sum[hmacSize:2*hmacSize])
+	c.hmacAdd = hmac.New(sha1.New, sum)
+	if c.frameDumper != nil {
+		c.frameDumper.dump(FrameDirectionWrite, record[:])
+	}
+	if c.transport != nil {
+		return c.transport.WriteFrame(c.vectorisedWriter, [][]byte{record[:]})
+	}
+	_, err = bufio.WriteVectorised(c.vectorisedWriter, [][]byte{record[:]})
+	return err
+}
+
+type recordKind uint8
+
+const (
+	recordInvalid recordKind = iota
+	recordData
+	recordRekey
+	recordClose
+)
+
+// verifyRecord verifies a data phase record and switches to the next chain on a rekey record.
+func (c *verifiedConn) verifyRecord(frame []byte) recordKind {
+	if len(frame) < tlsHmacHeaderSize || frame[1] != c.recordVersion[0] || frame[2] != c.recordVersion[1] {
+		return recordInvalid
+	}
+	c.hmacVerify.Write(frame[tlsHmacHeaderSize:])
+	sum := c.hmacVerify.Sum(c.readSum[:0])
+	tag := frame[tlsHeaderSize:tlsHmacHeaderSize]
+	if bytes.Equal(tag, sum[:hmacSize]) {
+		c.hmacVerify.Write(sum[:hmacSize])
+		return recordData
+	}
+	if len(frame) == tlsHmacHeaderSize+rekeyNonceSize && bytes.Equal(tag, sum[hmacSize:2*hmacSize]) {
+		c.hmacVerify = hmac.New(sha1.New, append([]byte(nil), sum...))
+		return recordRekey
+	}
+	if c.closeRecord && len(frame) == tlsHmacHeaderSize && bytes.Equal(tag, sum[closeTagOffset:closeTagOffset+hmacSize]) {
+		return recordClose
+	}
+	return recordInvalid
+}
@@ -5,59 +5,108 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
-	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"hash"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/debug"
 	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
 )
 
-func extractFrame(conn net.Conn) (*buf.Buffer, error) {
+var (
+	errHMACMismatch   = E.New("hmac mismatch")
+	errRecordTooLarge = E.New("record too large")
+
+	errRecordRateExceeded = E.New("record rate exceeded")
+
+	errHandshakeServerNotTLS = E.New("handshake server is not TLS")
+)
+
+func extractFrame(reader io.Reader) (*buf.Buffer, error) {
+	return extractFrameLimited(reader, 0)
+}
+
+// extractFrameLimited rejects records longer than maxLength before allocating them, 0 for no limit.
+func extractFrameLimited(reader io.Reader, maxLength int) (*buf.Buffer, error) {
 	var tlsHeader [tlsHeaderSize]byte
-	_, err := io.ReadFull(conn, tlsHeader[:])
+	_, err := io.ReadFull(reader, tlsHeader[:])
 	if err != nil {
 		return nil, err
 	}
 	length := int(binary.BigEndian.Uint16(tlsHeader[3:]))
+	if maxLength > 0 && length > maxLength {
+		return nil, E.Cause(errRecordTooLarge, length, " > ", maxLength)
+	}
 	buffer := buf.NewSize(tlsHeaderSize + length)
 	common.Must1(buffer.Write(tlsHeader[:]))
-	_, err = buffer.ReadFullFrom(conn, length)
+	_, err = buffer.ReadFullFrom(reader, length)
 	if err != nil {
 		buffer.Release()
+		return nil, err
 	}
-	return buffer, err
+	return buffer, nil
 }
 
+// extractServerHelloFrame reads the first record from the handshake server,
+// failing early if it does not look like TLS, e.g. a plain HTTP response.
+func extractServerHelloFrame(reader io.Reader) (*buf.Buffer, error) {
+	var tlsHeader [tlsHeaderSize]byte
+	_, err := io.ReadFull(reader, tlsHeader[:])
+	if err != nil {
+		return nil, err
+	}
+	if (tlsHeader[0] != handshake && tlsHeader[0] != alert) || tlsHeader[1] != 3 {
+		return nil, E.Cause(errHandshakeServerNotTLS, "unexpected response ", strconv.Quote(string(tlsHeader[:])))
+	}
+	return extractFrame(io.MultiReader(bytes.NewReader(tlsHeader[:]), reader))
+}
+
+// extractServerName returns the server_name of a ClientHello record, an empty name without one.
+// Like crypto/tls, names with a trailing dot are rejected.
 func extractServerName(frame []byte) (string, error) {
-	var hello *tls.ClientHelloInfo
-	err := tls.Server(bufio.NewReadOnlyConn(bytes.NewReader(frame)), &tls.Config{
-		GetConfigForClient: func(argHello *tls.ClientHelloInfo) (*tls.Config, error) {
-			hello = argHello
-			return nil, nil
-		},
-	}).HandshakeContext(context.Background())
-	if hello != nil {
-		return hello.ServerName, nil
-	}
-	return "", err
+	serverName, err := clientHelloServerName(frame)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(serverName, ".") {
+		return "", E.New("invalid server name: ", serverName)
+	}
+	return serverName, nil
 }
 
-func verifyClientHello(frame []byte, users []User) (*User, error) {
-	const minLen = tlsHeaderSize + 1 + 3 + 2 + tlsRandomSize + 1 + tlsSessionIDSize
-	const hmacIndex = sessionIDLengthIndex + 1 + tlsSessionIDSize - hmacSize
-	if len(frame) < minLen {
-		return nil, io.ErrUnexpectedEOF
+// ClientHelloHMACRange returns where the protocol version 3 HMAC is placed in a ClientHello record,
+// as offsets into frame including the record header: the last 4 bytes of the 32 byte session id.
+// The HMAC is HMAC-SHA1 keyed by the password over the handshake message with the range zeroed,
+// truncated to 4 bytes.
+func ClientHelloHMACRange(frame []byte) (start int, end int, err error) {
+	return defaultHMACLayout.hmacRange(frame)
+}
+
+func (l hmacLayout) hmacRange(frame []byte) (start int, end int, err error) {
+	if len(frame) < l.minRecordLength() {
+		return 0, 0, io.ErrUnexpectedEOF
 	} else if frame[0] != handshake {
-		return nil, E.New("unexpected record type")
+		return 0, 0, E.New("unexpected record type")
 	} else if frame[5] != clientHello {
-		return nil, E.New("unexpected handshake type")
-	} else if frame[sessionIDLengthIndex] != tlsSessionIDSize {
-		return nil, E.New("unexpected session id length")
+		return 0, 0, E.New("unexpected handshake type")
+	} else if int(frame[sessionIDLengthIndex]) != l.sessionIDLength {
+		return 0, 0, E.New("unexpected session id length")
+	}
+	return l.hmacIndex(), l.hmacIndex() + hmacSize, nil
+}
+
+func verifyClientHello(frame []byte, users []User) (*User, error) {
+	hmacIndex, _, err := defaultHMACLayout.hmacRange(frame)
+	if err != nil {
+		return nil, err
 	}
 	for _, user := range users {
 		hmacSHA1Hash := hmac.New(sha1.New, []byte(user.Password))
@@ -68,7 +117,7 @@ func verifyClientHello(frame []byte, users []User) (*User, error) {
 			return &user, nil
 		}
 	}
-	return nil, E.New("hmac mismatch")
+	return nil, errHMACMismatch
 }
 
 func extractServerRandom(frame []byte) []byte {
@@ -83,72 +132,67 @@ func extractServerRandom(frame []byte) []byte {
 	return serverRandom
 }
 
-func isServerHelloSupportTLS13(frame []byte) bool {
-	if len(frame) < sessionIDLengthIndex {
-		return false
+// serverHelloCipherSuite returns the cipher suite selected in a ServerHello record, 0 if it is malformed.
+// It is sent in the clear even in TLS 1.3.
+func serverHelloCipherSuite(frame []byte) uint16 {
+	if len(frame) <= sessionIDLengthIndex || frame[0] != handshake || frame[5] != serverHello {
+		return 0
 	}
+	cipherSuiteIndex := sessionIDLengthIndex + 1 + int(frame[sessionIDLengthIndex])
+	if len(frame) < cipherSuiteIndex+2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(frame[cipherSuiteIndex:])
+}
 
-	reader := bytes.NewReader(frame[sessionIDLengthIndex:])
-
-	var sessionIdLength uint8
-	err := binary.Read(reader, binary.BigEndian, &sessionIdLength)
-	if err != nil {
+func isServerHelloSupportTLS13(frame []byte) bool {
+	if len(frame) <= sessionIDLengthIndex || frame[0] != handshake || frame[5] != serverHello {
 		return false
 	}
-	_, err = io.CopyN(io.Discard, reader, int64(sessionIdLength))
-	if err != nil {
+	if int(binary.BigEndian.Uint16(frame[3:tlsHeaderSize])) != len(frame)-tlsHeaderSize {
 		return false
 	}
-
-	_, err = io.CopyN(io.Discard, reader, 3)
-	if err != nil {
+	sessionIDLength := int(frame[sessionIDLengthIndex])
+	extensions := frame[sessionIDLengthIndex+1:]
+	// session id, cipher suite, compression method and extension list length
+	if len(extensions) < sessionIDLength+3+2 {
 		return false
 	}
-
-	var extensionListLength uint16
-	err = binary.Read(reader, binary.BigEndian, &extensionListLength)
-	if err != nil {
+	extensions = extensions[sessionIDLength+3:]
+	extensionListLength := int(binary.BigEndian.Uint16(extensions))
+	extensions = extensions[2:]
+	if len(extensions) < extensionListLength {
 		return false
 	}
-	for i := uint16(0); i < extensionListLength; i++ {
-		var extensionType uint16
-		err = binary.Read(reader, binary.BigEndian, &extensionType)
-		if err != nil {
-			return false
-		}
-		var extensionLength uint16
-		err = binary.Read(reader, binary.BigEndian, &extensionLength)
-		if err != nil {
+	extensions = extensions[:extensionListLength]
+	for len(extensions) >= 4 {
+		extensionType := binary.BigEndian.Uint16(extensions)
+		extensionLength := int(binary.BigEndian.Uint16(extensions[2:]))
+		extensions = extensions[4:]
+		if len(extensions) < extensionLength {
 			return false
 		}
-		if extensionType != 43 {
-			_, err = io.CopyN(io.Discard, reader, int64(extensionLength))
-			if err != nil {
-				return false
-			}
-			continue
-		}
-		if extensionLength != 2 {
-			return false
+		if extensionType == extensionSupportedVersions {
+			return extensionLength == 2 && binary.BigEndian.Uint16(extensions) == versionTLS13
 		}
-		var extensionValue uint16
-		err = binary.Read(reader, binary.BigEndian, &extensionValue)
-		if err != nil {
-			return false
-		}
-		return extensionValue == 0x0304
+		extensions = extensions[extensionLength:]
 	}
 	return false
 }
 
-func copyByFrameUntilHMACMatches(conn net.Conn, handshakeConn net.Conn, hmacVerify hash.Hash, hmacReset func()) (*buf.Buffer, error) {
+// copyByFrameUntilHMACMatches relays client records to the handshake server until one carries the HMAC of
+// the client chain and returns its payload. The size of every relayed record is added to relayed.
+func copyByFrameUntilHMACMatches(conn io.Reader, handshakeConn net.Conn, hmacVerify hash.Hash, hmacReset func(), frameDumper FrameDumper, relayed *int64) (*buf.Buffer, error) {
 	for {
 		frameBuffer, err := extractFrame(conn)
 		if err != nil {
 			return nil, E.Cause(err, "read client record")
 		}
 		frame := frameBuffer.Bytes()
-		if len(frame) > tlsHmacHeaderSize && frame[0] == applicationData {
+		if frameDumper != nil {
+			frameDumper.dump(FrameDirectionClient, frame)
+		}
+		if len(frame) >= tlsHmacHeaderSize && frame[0] == applicationData {
 			hmacReset()
 			hmacVerify.Write(frame[tlsHmacHeaderSize:])
 			hmacHash := hmacVerify.Sum(nil)[:4]
@@ -160,39 +204,122 @@ func copyByFrameUntilHMACMatches(conn net.Conn, handshakeConn net.Conn, hmacVeri
 				return frameBuffer, nil
 			}
 		}
+		// everything else, including the middlebox compatibility change_cipher_spec, goes to the handshake server
 		_, err = handshakeConn.Write(frame)
 		frameBuffer.Release()
 		if err != nil {
 			return nil, E.Cause(err, "write clint frame")
 		}
+		*relayed += int64(len(frame))
 	}
 }
 
-func copyByFrameWithModification(conn net.Conn, handshakeConn net.Conn, password string, serverRandom []byte, hmacWrite hash.Hash) error {
+// copyByFrameWithModification relays server records to the client, adding the HMAC of the server chain to
+// application data records. The size of every record read from the handshake server is added to relayed.
+func copyByFrameWithModification(ctx context.Context, logger logger.ContextLogger, conn io.Reader, handshakeConn net.Conn, password string, serverRandom []byte, hmacWrite hash.Hash, frameDumper FrameDumper, relayed *int64) error {
 	writeKey := kdf(password, serverRandom)
+	if debug.Enabled {
+		logger.TraceContext(ctx, "server random: ", hex.EncodeToString(serverRandom), ", write key: ", hex.EncodeToString(writeKey))
+	}
 	writer := bufio.NewVectorisedWriter(handshakeConn)
+	dumpFrame := debug.Enabled
+	relayBuffer := buf.NewSize(relayBufferSize)
+	defer relayBuffer.Release()
+	var tlsHeader [tlsHeaderSize]byte
 	for {
-		frameBuffer, err := extractFrame(conn)
+		_, err := io.ReadFull(conn, tlsHeader[:])
 		if err != nil {
 			return E.Cause(err, "read server record")
 		}
-		frame := frameBuffer.Bytes()
-		if frame[0] == applicationData {
-			xorSlice(frame[tlsHeaderSize:], writeKey)
-			hmacWrite.Write(frame[tlsHeaderSize:])
-			binary.BigEndian.PutUint16(frame[3:], uint16(len(frame)-tlsHeaderSize+hmacSize))
-			hmacHash := hmacWrite.Sum(nil)[:4]
-			_, err = bufio.WriteVectorised(writer, [][]byte{frame[:tlsHeaderSize], hmacHash, frame[tlsHeaderSize:]})
-			frameBuffer.Release()
+		if tlsHeader[0] != applicationData {
+			// handshake, change_cipher_spec and alert records are relayed unmodified
+			if frameDumper != nil {
+				err = relayFrameDumped(handshakeConn, conn, tlsHeader[:], frameDumper)
+			} else {
+				err = relayFrame(handshakeConn, conn, tlsHeader[:], relayBuffer.FreeBytes())
+			}
 			if err != nil {
-				return E.Cause(err, "write modified server frame")
+				return E.Cause(err, "relay server frame")
 			}
-		} else {
-			_, err = handshakeConn.Write(frame)
+			*relayed += int64(tlsHeaderSize) + int64(binary.BigEndian.Uint16(tlsHeader[3:]))
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(tlsHeader[3:]))
+		frameBuffer := buf.NewSize(tlsHeaderSize + length)
+		common.Must1(frameBuffer.Write(tlsHeader[:]))
+		_, err = frameBuffer.ReadFullFrom(conn, length)
+		if err != nil {
 			frameBuffer.Release()
+			return E.Cause(err, "read server record")
+		}
+		frame := frameBuffer.Bytes()
+		if dumpFrame {
+			logger.TraceContext(ctx, "first server frame before modification: ", hex.EncodeToString(frame))
+		}
+		xorSlice(frame[tlsHeaderSize:], writeKey)
+		hmacWrite.Write(frame[tlsHeaderSize:])
+		binary.BigEndian.PutUint16(frame[3:], uint16(len(frame)-tlsHeaderSize+hmacSize))
+		hmacHash := hmacWrite.Sum(nil)[:4]
+		if dumpFrame {
+			logger.TraceContext(ctx, "first server frame after modification: ", hex.EncodeToString(frame[:tlsHeaderSize]), hex.EncodeToString(hmacHash), hex.EncodeToString(frame[tlsHeaderSize:]))
+			dumpFrame = false
+		}
+		if frameDumper != nil {
+			frameDumper.dump(FrameDirectionServer, frame[:tlsHeaderSize], hmacHash, frame[tlsHeaderSize:])
+		}
+		_, err = bufio.WriteVectorised(writer, [][]byte{frame[:tlsHeaderSize], hmacHash, frame[tlsHeaderSize:]})
+		frameBuffer.Release()
+		if err != nil {
+			return E.Cause(err, "write modified server frame")
+		}
+		*relayed += int64(tlsHeaderSize + length)
+	}
+}
+
+const relayBufferSize = 2048
+
+// relayFrame copies a record that is passed through unmodified without holding its whole body.
+func relayFrame(dst io.Writer, src io.Reader, tlsHeader []byte, relayBuffer []byte) error {
+	_, err := dst.Write(tlsHeader)
+	if err != nil {
+		return err
+	}
+	// not io.CopyBuffer, which skips relayBuffer for a destination implementing io.ReaderFrom like *net.TCPConn
+	remaining := int(binary.BigEndian.Uint16(tlsHeader[3:]))
+	for remaining > 0 {
+		chunk := relayBuffer
+		if len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, readErr := src.Read(chunk)
+		if n > 0 {
+			_, err = dst.Write(chunk[:n])
 			if err != nil {
-				return E.Cause(err, "write server frame")
+				return err
+			}
+			remaining -= n
+		}
+		if readErr != nil && remaining > 0 {
+			if readErr == io.EOF {
+				return io.ErrUnexpectedEOF
 			}
+			return readErr
 		}
 	}
+	return nil
+}
+
+// relayFrameDumped reads the whole record to hand it to the dumper before relaying it.
+func relayFrameDumped(dst io.Writer, src io.Reader, tlsHeader []byte, frameDumper FrameDumper) error {
+	length := int(binary.BigEndian.Uint16(tlsHeader[3:]))
+	frameBuffer := buf.NewSize(tlsHeaderSize + length)
+	defer frameBuffer.Release()
+	common.Must1(frameBuffer.Write(tlsHeader))
+	_, err := frameBuffer.ReadFullFrom(src, length)
+	if err != nil {
+		return err
+	}
+	frameDumper.dump(FrameDirectionServer, frameBuffer.Bytes())
+	_, err = dst.Write(frameBuffer.Bytes())
+	return err
 }
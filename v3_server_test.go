@@ -0,0 +1,451 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/sagernet/sing-shadowtls/internal/memconn"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/logger"
+)
+
+func testRecord(contentType byte, payload []byte) []byte {
+	record := make([]byte, tlsHeaderSize+len(payload))
+	record[0] = contentType
+	record[1], record[2] = 3, 3
+	binary.BigEndian.PutUint16(record[3:], uint16(len(payload)))
+	copy(record[tlsHeaderSize:], payload)
+	return record
+}
+
+// testClientDataRecord returns a client record authenticated by the handshake relay chain of serverRandom.
+func testClientDataRecord(password string, serverRandom []byte, payload []byte) []byte {
+	hmacVerify := hmac.New(sha1.New, []byte(password))
+	hmacVerify.Write(serverRandom)
+	hmacVerify.Write([]byte("C"))
+	hmacVerify.Write(payload)
+	return testRecord(applicationData, append(hmacVerify.Sum(nil)[:hmacSize], payload...))
+}
+
+func TestCopyByFrameUntilHMACMatchesReleasesBuffers(t *testing.T) {
+	serverRandom := bytes.Repeat([]byte{1}, tlsRandomSize)
+	hmacVerify := hmac.New(sha1.New, []byte(testPassword))
+	hmacReset := func() {
+		hmacVerify.Reset()
+		hmacVerify.Write(serverRandom)
+		hmacVerify.Write([]byte("C"))
+	}
+	handshakeRecord := testRecord(handshake, make([]byte, 64))
+	dataRecord := testClientDataRecord(testPassword, serverRandom, []byte("payload"))
+	for _, testCase := range []struct {
+		name        string
+		input       []byte
+		closeServer bool
+		expectFrame bool
+	}{
+		{"eof", nil, false, false},
+		{"truncated header", handshakeRecord[:3], false, false},
+		{"truncated body", handshakeRecord[:20], false, false},
+		{"relayed then eof", handshakeRecord, false, false},
+		{"relay write failure", handshakeRecord, true, false},
+		{"unauthenticated data", testRecord(applicationData, make([]byte, 64)), false, false},
+		{"authenticated", append(append([]byte(nil), handshakeRecord...), dataRecord...), false, true},
+		{"zero length relayed", append(testRecord(applicationData, nil), dataRecord...), false, true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			allocator := trackBuffers(t)
+			handshakeConn, handshakePeer := memconn.Pipe()
+			if testCase.closeServer {
+				handshakePeer.Close()
+			}
+			go io.Copy(io.Discard, handshakePeer)
+			var relayed int64
+			frame, err := copyByFrameUntilHMACMatches(bytes.NewReader(testCase.input), handshakeConn, hmacVerify, hmacReset, nil, &relayed)
+			if testCase.expectFrame {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(frame.Bytes(), []byte("payload")) {
+					t.Fatalf("unexpected first frame %q", frame.Bytes())
+				}
+				if relayed != int64(len(testCase.input)-len(dataRecord)) {
+					t.Fatalf("counted %d relayed bytes, relayed %d", relayed, len(testCase.input)-len(dataRecord))
+				}
+				frame.Release()
+			} else if err == nil {
+				t.Fatal("expected error")
+			}
+			handshakeConn.Close()
+			allocator.check(t, testCase.name)
+		})
+	}
+}
+
+func TestCopyByFrameWithModificationReleasesBuffers(t *testing.T) {
+	serverRandom := bytes.Repeat([]byte{1}, tlsRandomSize)
+	dataRecord := testRecord(applicationData, make([]byte, 512))
+	handshakeRecord := testRecord(handshake, make([]byte, 512))
+	for _, testCase := range []struct {
+		name         string
+		input        []byte
+		closeClient  bool
+		frameDumper  FrameDumper
+		expectOutput bool
+	}{
+		{"eof", nil, false, nil, false},
+		{"truncated data", dataRecord[:100], false, nil, false},
+		{"truncated relay", handshakeRecord[:100], false, nil, false},
+		{"truncated dumped relay", handshakeRecord[:100], false, func(string, []byte) {}, false},
+		{"data write failure", dataRecord, true, nil, false},
+		{"relay write failure", handshakeRecord, true, nil, false},
+		{"relayed", append(append([]byte(nil), handshakeRecord...), dataRecord...), false, nil, true},
+		{"relayed dumped", append(append([]byte(nil), handshakeRecord...), dataRecord...), false, func(string, []byte) {}, true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			allocator := trackBuffers(t)
+			clientConn, clientPeer := memconn.Pipe()
+			if testCase.closeClient {
+				clientPeer.Close()
+			}
+			hmacWrite := hmac.New(sha1.New, []byte(testPassword))
+			hmacWrite.Write(serverRandom)
+			var relayed int64
+			err := copyByFrameWithModification(context.Background(), logger.NOP(), bytes.NewReader(testCase.input), clientConn, testPassword, serverRandom, hmacWrite, testCase.frameDumper, &relayed)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			clientConn.Close()
+			if testCase.expectOutput {
+				output, _ := io.ReadAll(clientPeer)
+				if len(output) != len(testCase.input)+hmacSize {
+					t.Fatalf("relayed %d bytes, expected %d", len(output), len(testCase.input)+hmacSize)
+				}
+				if relayed != int64(len(testCase.input)) {
+					t.Fatalf("counted %d relayed bytes, read %d", relayed, len(testCase.input))
+				}
+			}
+			allocator.check(t, testCase.name)
+		})
+	}
+}
+
+// TestRelayChangeCipherSpec checks that change_cipher_spec records are relayed unmodified in both directions
+// and do not enter the HMAC chains.
+func TestRelayChangeCipherSpec(t *testing.T) {
+	serverRandom := bytes.Repeat([]byte{1}, tlsRandomSize)
+	changeCipherSpecRecord := testRecord(changeCipherSpec, []byte{1})
+	t.Run("client", func(t *testing.T) {
+		hmacVerify := hmac.New(sha1.New, []byte(testPassword))
+		hmacReset := func() {
+			hmacVerify.Reset()
+			hmacVerify.Write(serverRandom)
+			hmacVerify.Write([]byte("C"))
+		}
+		input := append(append([]byte(nil), changeCipherSpecRecord...), testClientDataRecord(testPassword, serverRandom, []byte("payload"))...)
+		handshakeConn, handshakePeer := memconn.Pipe()
+		defer handshakeConn.Close()
+		relayed := make(chan []byte, 1)
+		go func() {
+			record := make([]byte, len(changeCipherSpecRecord))
+			io.ReadFull(handshakePeer, record)
+			relayed <- record
+		}()
+		frame, err := copyByFrameUntilHMACMatches(bytes.NewReader(input), handshakeConn, hmacVerify, hmacReset, nil, new(int64))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer frame.Release()
+		if string(frame.Bytes()) != "payload" {
+			t.Fatalf("unexpected first frame %q", frame.Bytes())
+		}
+		if record := <-relayed; !bytes.Equal(record, changeCipherSpecRecord) {
+			t.Fatalf("relayed %x, expected %x", record, changeCipherSpecRecord)
+		}
+	})
+	t.Run("server", func(t *testing.T) {
+		payload := []byte("encrypted extensions")
+		input := append(append([]byte(nil), changeCipherSpecRecord...), testRecord(applicationData, payload)...)
+		clientConn, clientPeer := memconn.Pipe()
+		hmacWrite := hmac.New(sha1.New, []byte(testPassword))
+		hmacWrite.Write(serverRandom)
+		hmacWrite.Write([]byte("S"))
+		go func() {
+			copyByFrameWithModification(context.Background(), logger.NOP(), bytes.NewReader(input), clientConn, testPassword, serverRandom, hmacWrite, nil, new(int64))
+			clientConn.Close()
+		}()
+		output, _ := io.ReadAll(clientPeer)
+		if !bytes.HasPrefix(output, changeCipherSpecRecord) {
+			t.Fatalf("change_cipher_spec modified: %x", output)
+		}
+		modified := append([]byte(nil), payload...)
+		xorSlice(modified, kdf(testPassword, serverRandom))
+		expectedHMAC := hmac.New(sha1.New, []byte(testPassword))
+		expectedHMAC.Write(serverRandom)
+		expectedHMAC.Write([]byte("S"))
+		expectedHMAC.Write(modified)
+		expected := testRecord(applicationData, append(expectedHMAC.Sum(nil)[:hmacSize], modified...))
+		if !bytes.Equal(output[len(changeCipherSpecRecord):], expected) {
+			t.Fatalf("data record %x, expected %x", output[len(changeCipherSpecRecord):], expected)
+		}
+	})
+}
+
+// TestModifiedFrameGolden locks the format of server records modified with a fixed server random:
+// handshake records pass unmodified, application data is masked and prefixed with the chained HMAC.
+func TestModifiedFrameGolden(t *testing.T) {
+	input := append(testRecord(handshake, []byte("hello")), testRecord(applicationData, []byte("encrypted extensions"))...)
+	input = append(input, testRecord(applicationData, []byte("finished"))...)
+	clientConn, clientPeer := memconn.Pipe()
+	hmacWrite := hmac.New(sha1.New, []byte(testPassword))
+	hmacWrite.Write(testServerRandom)
+	go func() {
+		copyByFrameWithModification(context.Background(), logger.NOP(), bytes.NewReader(input), clientConn, testPassword, testServerRandom, hmacWrite, nil, new(int64))
+		clientConn.Close()
+	}()
+	output, _ := io.ReadAll(clientPeer)
+	expected, _ := hex.DecodeString("160303000568656c6c6f" +
+		"1703030018e4980c124fcad9ce0d1758a1a42b27effd5273fbe74f4283" +
+		"170303000c4d15cde84ccdd4d5070f49a0")
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("unexpected modified records %x", output)
+	}
+}
+
+func testExtension(extensionType uint16, data []byte) []byte {
+	extension := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(extension, extensionType)
+	binary.BigEndian.PutUint16(extension[2:], uint16(len(data)))
+	return append(extension, data...)
+}
+
+// testServerHello returns a ServerHello record with the given extensions and a 32 byte session id.
+func testServerHello(serverRandom []byte, extensions ...[]byte) []byte {
+	body := []byte{3, 3}
+	body = append(body, serverRandom...)
+	body = append(body, tlsSessionIDSize)
+	body = append(body, make([]byte, tlsSessionIDSize)...)
+	body = append(body, 0x13, 0x01, 0)
+	var extensionList []byte
+	for _, extension := range extensions {
+		extensionList = append(extensionList, extension...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensionList)))
+	body = append(body, extensionList...)
+	message := []byte{serverHello, 0, 0, 0}
+	message[1] = byte(len(body) >> 16)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(body)))
+	return testRecord(handshake, append(message, body...))
+}
+
+func TestIsServerHelloSupportTLS13(t *testing.T) {
+	supportedVersions := testExtension(extensionSupportedVersions, []byte{3, 4})
+	keyShare := testExtension(51, make([]byte, 36))
+	padding := testExtension(21, make([]byte, 4000))
+	random := bytes.Repeat([]byte{7}, tlsRandomSize)
+	for _, testCase := range []struct {
+		name   string
+		frame  []byte
+		expect bool
+	}{
+		{"first", testServerHello(random, supportedVersions, keyShare, padding), true},
+		{"middle", testServerHello(random, keyShare, supportedVersions, padding), true},
+		{"last", testServerHello(random, keyShare, padding, supportedVersions), true},
+		{"only", testServerHello(random, supportedVersions), true},
+		{"tls12", testServerHello(random, testExtension(extensionSupportedVersions, []byte{3, 3}), keyShare), false},
+		{"missing", testServerHello(random, keyShare, padding), false},
+		{"no extensions", testServerHello(random), false},
+		{"truncated", testServerHello(random, keyShare, padding, supportedVersions)[:200], false},
+		{"overlong extension", testServerHello(random, keyShare, testExtension(extensionSupportedVersions, []byte{3, 4})[:5]), false},
+	} {
+		if result := isServerHelloSupportTLS13(testCase.frame); result != testCase.expect {
+			t.Errorf("%s: detected TLS 1.3 %v, expected %v", testCase.name, result, testCase.expect)
+		}
+	}
+}
+
+func FuzzVerifyClientHello(f *testing.F) {
+	users := []User{{Password: "other"}, {Password: testPassword}}
+	record := testClientHello(f)
+	if user, err := verifyClientHello(record, users); err != nil || user.Password != testPassword {
+		f.Fatal("seed ClientHello not authenticated: ", err)
+	}
+	f.Add(record)
+	f.Add(record[:sessionIDLengthIndex+1])
+	f.Add(record[:defaultHMACLayout.minRecordLength()])
+	f.Add(testRecord(handshake, []byte{clientHello}))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		user, err := verifyClientHello(frame, users)
+		if err == nil && user.Password != testPassword && user.Password != "other" {
+			t.Fatal("unknown user")
+		}
+		ClientHelloHMACRange(frame)
+		extractServerName(frame)
+		if info, parseErr := parseClientHello(frame); parseErr == nil {
+			info.checkTLS13()
+			info.ja3()
+		}
+	})
+}
+
+// cryptoTLSServerName is the former extractServerName, which ran a crypto/tls server handshake
+// over a read-only connection to reach GetConfigForClient.
+func cryptoTLSServerName(frame []byte) (string, error) {
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(bufio.NewReadOnlyConn(bytes.NewReader(frame)), &tls.Config{
+		GetConfigForClient: func(argHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = argHello
+			return nil, nil
+		},
+	}).HandshakeContext(context.Background())
+	if hello != nil {
+		return hello.ServerName, nil
+	}
+	return "", err
+}
+
+// testServerNameClientHellos returns ClientHellos with a host name, without server_name, and with a trailing dot.
+func testServerNameClientHellos(t testing.TB) [][]byte {
+	withTrailingDot := testClientHello(t)
+	offset := bytes.Index(withTrailingDot, []byte(testServerName))
+	// keep the lengths by replacing the last character
+	withTrailingDot[offset+len(testServerName)-1] = '.'
+	return [][]byte{
+		testClientHello(t),
+		captureClientHello(t, DefaultTLSHandshakeFunc(testPassword, &tls.Config{InsecureSkipVerify: true}), generateSessionID(testPassword)),
+		withTrailingDot,
+	}
+}
+
+func TestExtractServerNameMatchesCryptoTLS(t *testing.T) {
+	for i, frame := range testServerNameClientHellos(t) {
+		expected, expectedErr := cryptoTLSServerName(frame)
+		serverName, err := extractServerName(frame)
+		if serverName != expected || (err == nil) != (expectedErr == nil) {
+			t.Errorf("ClientHello %d: %q, %v, crypto/tls %q, %v", i, serverName, err, expected, expectedErr)
+		}
+	}
+}
+
+func BenchmarkExtractServerName(b *testing.B) {
+	frame := testClientHello(b)
+	for _, testCase := range []struct {
+		name    string
+		extract func(frame []byte) (string, error)
+	}{
+		{"crypto/tls", cryptoTLSServerName},
+		{"full parse", func(frame []byte) (string, error) {
+			info, err := parseClientHello(frame)
+			if err != nil {
+				return "", err
+			}
+			return info.serverName, nil
+		}},
+		{"parser", extractServerName},
+	} {
+		b.Run(testCase.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				serverName, _ := testCase.extract(frame)
+				if serverName != testServerName {
+					b.Fatal("unexpected server name ", serverName)
+				}
+			}
+		})
+	}
+}
+
+// FuzzExtractServerName checks that the server_name walk agrees with the full ClientHello parse.
+func FuzzExtractServerName(f *testing.F) {
+	for _, frame := range testServerNameClientHellos(f) {
+		f.Add(frame)
+	}
+	f.Add(testRecord(handshake, []byte{clientHello, 0, 0, 0}))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		serverName, err := clientHelloServerName(frame)
+		info, parseErr := parseClientHello(frame)
+		if parseErr == nil && (err != nil || serverName != info.serverName) {
+			t.Fatalf("server name %q, %v, full parse %q", serverName, err, info.serverName)
+		}
+		extractServerName(frame)
+	})
+}
+
+func FuzzExtractFrame(f *testing.F) {
+	f.Add(testRecord(handshake, make([]byte, 16)), uint16(0))
+	f.Add(testRecord(applicationData, make([]byte, 16)), uint16(8))
+	f.Add([]byte{handshake, 3, 3, 0xff, 0xff}, uint16(0))
+	f.Add([]byte("HTTP/1.1 400 Bad Request\r\n"), uint16(0))
+	f.Fuzz(func(t *testing.T, data []byte, maxLength uint16) {
+		frame, err := extractFrameLimited(bytes.NewReader(data), int(maxLength))
+		if err == nil {
+			length := int(binary.BigEndian.Uint16(data[3:tlsHeaderSize]))
+			if frame.Len() != tlsHeaderSize+length || !bytes.Equal(frame.Bytes(), data[:frame.Len()]) {
+				t.Fatal("frame does not match the record")
+			}
+			if maxLength > 0 && length > int(maxLength) {
+				t.Fatal("record above the limit accepted")
+			}
+			frame.Release()
+		}
+		frame, err = extractServerHelloFrame(bytes.NewReader(data))
+		if err == nil {
+			frame.Release()
+		}
+	})
+}
+
+func FuzzIsServerHelloSupportTLS13(f *testing.F) {
+	random := bytes.Repeat([]byte{7}, tlsRandomSize)
+	f.Add(testServerHello(random, testExtension(extensionSupportedVersions, []byte{3, 4})))
+	f.Add(testServerHello(random, testExtension(51, make([]byte, 36)), testExtension(extensionSupportedVersions, []byte{3, 4})))
+	f.Add(testServerHello(random))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		isServerHelloSupportTLS13(frame)
+		serverHelloCipherSuite(frame)
+		if serverRandom := extractServerRandom(frame); serverRandom != nil && len(serverRandom) != tlsRandomSize {
+			t.Fatal("invalid server random length")
+		}
+	})
+}
+
+// BenchmarkCopyByFrameWithModification relays a flood of 16 KiB server records to a TCP connection, B/op shows
+// that unmodified records are streamed through the relay buffer while application data is held whole.
+func BenchmarkCopyByFrameWithModification(b *testing.B) {
+	for _, testCase := range []struct {
+		name        string
+		contentType byte
+	}{
+		{"passthrough", handshake},
+		{"modified", applicationData},
+	} {
+		b.Run(testCase.name, func(b *testing.B) {
+			var flood []byte
+			for i := 0; i < 64; i++ {
+				flood = append(flood, testRecord(testCase.contentType, make([]byte, maxRecordPayloadSize))...)
+			}
+			serverRandom := bytes.Repeat([]byte{1}, tlsRandomSize)
+			reader := bytes.NewReader(flood)
+			client, server := tcpPipe(b)
+			go io.Copy(io.Discard, server)
+			b.SetBytes(int64(len(flood)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reader.Reset(flood)
+				hmacWrite := hmac.New(sha1.New, []byte(testPassword))
+				err := copyByFrameWithModification(context.Background(), logger.NOP(), reader, client, testPassword, serverRandom, hmacWrite, nil, new(int64))
+				if !errors.Is(err, io.EOF) {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
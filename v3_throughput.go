@@ -0,0 +1,50 @@
+package shadowtls
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type throughputSampler struct {
+	clock     Clock
+	interval  time.Duration
+	read      atomic.Uint64
+	written   atomic.Uint64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newThroughputSampler(clock Clock, interval time.Duration, report func(readRate uint64, writeRate uint64)) *throughputSampler {
+	if interval <= 0 {
+		return nil
+	}
+	s := &throughputSampler{
+		clock:    clock,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	go s.loop(report)
+	return s
+}
+
+func (s *throughputSampler) loop(report func(readRate uint64, writeRate uint64)) {
+	timer := s.clock.NewTimer(s.interval)
+	defer timer.Stop()
+	seconds := s.interval.Seconds()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-timer.C():
+		}
+		report(uint64(float64(s.read.Swap(0))/seconds), uint64(float64(s.written.Swap(0))/seconds))
+		timer.Reset(s.interval)
+	}
+}
+
+func (s *throughputSampler) stop() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,55 @@
+package shadowtls
+
+// WireSpecVersion changes whenever this package changes the protocol version 3 wire format.
+const WireSpecVersion = 4
+
+// WireFormat describes the protocol version 3 constants and algorithms of this package, so that
+// interoperability tests of other implementations can compare it, e.g. in its JSON encoding.
+type WireFormat struct {
+	Version              int    `json:"version"`
+	TLSHeaderSize        int    `json:"tls_header_size"`
+	HMAC                 string `json:"hmac"`
+	HMACSize             int    `json:"hmac_size"` // truncated length sent on the wire
+	SessionIDSize        int    `json:"session_id_size"`
+	SessionIDHMACOffset  int    `json:"session_id_hmac_offset"`
+	ClientHelloHMACIndex int    `json:"client_hello_hmac_index"` // offset in the ClientHello record including its header
+	ServerRandomIndex    int    `json:"server_random_index"`     // offset in the ServerHello record including its header
+	KDF                  string `json:"kdf"`
+	KDFKeySize           int    `json:"kdf_key_size"`
+	ClientRole           string `json:"client_role"` // appended to the server random to key the client data chain
+	ServerRole           string `json:"server_role"`
+	MaxRecordPayloadSize int    `json:"max_record_payload_size"`
+	RekeyNonceSize       int    `json:"rekey_nonce_size"`
+	RekeyTagOffset       int    `json:"rekey_tag_offset"` // offset of the rekey record tag in the HMAC output
+	CloseTagOffset       int    `json:"close_tag_offset"` // offset of the close record tag in the HMAC output
+	PaddingHeaderSize    int    `json:"padding_header_size"`
+	PaddingRole          string `json:"padding_role"`
+	CompressionRole      string `json:"compression_role"`  // appended after the padding role
+	CloseRecordRole      string `json:"close_record_role"` // appended after the compression role
+}
+
+// WireSpec returns the wire format implemented by this package.
+func WireSpec() WireFormat {
+	return WireFormat{
+		Version:              WireSpecVersion,
+		TLSHeaderSize:        tlsHeaderSize,
+		HMAC:                 "HMAC-SHA1",
+		HMACSize:             hmacSize,
+		SessionIDSize:        defaultHMACLayout.sessionIDLength,
+		SessionIDHMACOffset:  defaultHMACLayout.hmacOffset,
+		ClientHelloHMACIndex: defaultHMACLayout.hmacIndex(),
+		ServerRandomIndex:    serverRandomIndex,
+		KDF:                  "SHA-256(password || server_random)",
+		KDFKeySize:           KDFKeySize,
+		ClientRole:           "C",
+		ServerRole:           "S",
+		MaxRecordPayloadSize: maxRecordPayloadSize,
+		RekeyNonceSize:       rekeyNonceSize,
+		RekeyTagOffset:       hmacSize,
+		CloseTagOffset:       closeTagOffset,
+		PaddingHeaderSize:    paddingHeaderSize,
+		PaddingRole:          paddingRole,
+		CompressionRole:      compressionRole,
+		CloseRecordRole:      closeRecordRole,
+	}
+}